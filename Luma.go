@@ -2,7 +2,14 @@ package main
 
 import (
 	"bufio"
-	"flag"
+	"bytes"
+	"cmp"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"slices"
@@ -12,18 +19,27 @@ import (
 	_ "image/jpeg"
 	"io"
 	"log"
+	"maps"
 	"math"
 	"math/rand"
+	"net/http"
+	httppprof "net/http/pprof"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"runtime/pprof"
+	"runtime/trace"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unsafe"
 
-	fastpng "github.com/amarburg/go-fast-png"
 	"gocv.io/x/gocv"
 
 	_ "golang.org/x/image/bmp"
@@ -33,14 +49,10 @@ import (
 
 import "C"
 
-var start = time.Now().UnixNano()
-
 //var arraySize = 0
 
 //var wg sync.WaitGroup
 
-var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
-
 /*
 Grids defined below have a variable dimCornAvg, which stores the
 dimensions, corners, and average brightness. It was originally added
@@ -48,17 +60,33 @@ to aid in sorting, but other uses have been found. The following
 global variables suffixed with _64 are ANDed with the dimCornAvg
 value in order to focus on certain aspects without having to
 make array calls or to check several different aspects at onece.
+The top two bits hold the state of a grid: 0 for shallow, 1 for deep,
+and 3 for eliminated. The width and height take eleven bits each below
+them, so neither can be above MAX_DIM.
 */
-var W_64 uint64 = 0xFF00000000000000
-var H_64 uint64 = 0x00FF000000000000
+var STATE_64 uint64 = 0xC000000000000000
+var DEEP_64 uint64 = 0x4000000000000000
+var ELIMINATED_64 uint64 = 0xC000000000000000
+var W_64 uint64 = 0x3FF8000000000000
+var H_64 uint64 = 0x0007FF0000000000
 var DIM_64 uint64 = W_64 | H_64
-var C1_64 uint64 = 0x000000FF00000000
-var C2_64 uint64 = 0x00000000FF000000
-var C3_64 uint64 = 0x0000000000FF0000
-var C4_64 uint64 = 0x000000000000FF00
-var AVG_64 uint64 = 0x0000FF0000000000
+var AVG_64 uint64 = 0x000000FF00000000
+var C1_64 uint64 = 0x00000000FF000000
+var C2_64 uint64 = 0x0000000000FF0000
+var C3_64 uint64 = 0x000000000000FF00
+var C4_64 uint64 = 0x00000000000000FF
 var RAN_64 uint64 = 0x00000000000000FF
 
+/*The largest width or height of a grid*/
+const MAX_DIM = 2047
+
+/*
+The source of the random numbers which split images into fragments.
+Tests replace it with a seeded source, so that their results can be
+compared with those of earlier versions.
+*/
+var randomUint64 = rand.Uint64
+
 /*Absolute difference between two unsigned 8-bit numbers.*/
 func byteAbsDiff(a uint8, b uint8) uint8 {
 	if a == b {
@@ -89,15 +117,17 @@ but the sorting involved was time-consuming and of limited
 utility.
 */
 type Grid struct {
-	w__     uint8
-	h__     uint8
+	w__     uint16
+	h__     uint16
 	avgLuma uint8
 	medLuma uint8
 	maxLuma uint8
 	minLuma uint8
 	//array      [][]uint8
 	sum        uint8
-	coord      uint64
+	priority   uint8  /*Priority of the source the grid came from, higher is preferred*/
+	source     uint32 /*Index of the image or dataset the grid came from*/
+	coord      uint64 /*Top y-coordinate in the upper 32 bits, leftmost x-coordinate in the lower*/
 	dimCornAvg uint64 /*DIMensions, CORNers, AVeraGE, used for sorting and other purposes*/
 	corners    uint32
 	offset     int
@@ -105,14 +135,27 @@ type Grid struct {
 	minLoc     int
 }
 
-func (g Grid) getW() uint8 {
+func (g Grid) getW() uint16 {
 	return g.w__
 }
 
-func (g Grid) getH() uint8 {
+func (g Grid) getH() uint16 {
 	return g.h__
 }
 
+func (g Grid) getX() int {
+	return int(g.coord & 0xFFFFFFFF)
+}
+
+func (g Grid) getY() int {
+	return int(g.coord >> 32)
+}
+
+/*Packs the coordinates of a grid into its coord*/
+func packCoord(x int, y int) uint64 {
+	return (uint64(y) << 32) | uint64(uint32(x))
+}
+
 /*
 This is a struct for a tree containing bounding x and y values, minimum
 split values, children, and a two-bit variable to determine if it has
@@ -130,8 +173,12 @@ type Tree struct {
 	leafNum     int
 }
 
-/*This is a recursive instantiation method for a tree.*/
-func generateTree(x1In uint64, x2In uint64, y1In uint64, y2In uint64, minIn uint64, maxIn uint64, rBits uint64, rBytes uint64) *Tree {
+/*
+This is a recursive instantiation method for a tree. The minimum and
+maximum widths of its leaves are minW and maxW, and their minimum and
+maximum heights are minH and maxH.
+*/
+func generateTree(x1In uint64, x2In uint64, y1In uint64, y2In uint64, minW uint64, maxW uint64, minH uint64, maxH uint64, rBits uint64, rBytes uint64) *Tree {
 	t := Tree{
 		x1:          x1In,
 		x2:          x2In,
@@ -142,30 +189,30 @@ func generateTree(x1In uint64, x2In uint64, y1In uint64, y2In uint64, minIn uint
 	}
 	/*This determines which axis is divided if both are above the maximum allowable dimensions*/
 	for rBits == 0 {
-		rBits = rand.Uint64()
+		rBits = randomUint64()
 	}
 	/*This determines the size of a division*/
-	for (rBytes & 0xFFFF) < 2*minIn {
-		rBytes = rand.Uint64()
+	for (rBytes & 0xFFFF) < 2*max(minW, minH) {
+		rBytes = randomUint64()
 	}
 	/*If the horizontal endpoints are greater than the maximum allowed and the vertical is not OR the lowest
 	bit in rBits is 0, subdivide horizontally*/
-	if t.x2-t.x1 > maxIn && (t.y2-t.y1 <= maxIn || rBits%2 == 0) {
+	if t.x2-t.x1 > maxW && (t.y2-t.y1 <= maxH || rBits%2 == 0) {
 		rBits >>= 1
-		mid := (t.x1 + minIn) + ((rBytes & 0xFFFF) % (t.x2 - t.x1 - (2 * minIn)))
+		mid := (t.x1 + minW) + ((rBytes & 0xFFFF) % (t.x2 - t.x1 - (2 * minW)))
 		rBytes >>= 16
 		t.hasChildren = 3
-		t.lTree = generateTree(t.x1, mid, t.y1, t.y2, minIn, maxIn, rBits, rBytes)
-		t.rTree = generateTree(mid, t.x2, t.y1, t.y2, minIn, maxIn, rBits, rBytes)
+		t.lTree = generateTree(t.x1, mid, t.y1, t.y2, minW, maxW, minH, maxH, rBits, rBytes)
+		t.rTree = generateTree(mid, t.x2, t.y1, t.y2, minW, maxW, minH, maxH, rBits, rBytes)
 		t.leafNum = t.lTree.leafNum + t.rTree.leafNum
 		/*If the vertical endpoints are greater than the maximum allowed and the horizontal is not OR the lowest
 		bit in rBits is 1, subdivide verically*/
-	} else if t.y2-t.y1 > maxIn {
-		mid := (t.y1 + minIn) + ((rBytes & 0xFFFF) % (t.y2 - t.y1 - (2 * minIn)))
+	} else if t.y2-t.y1 > maxH {
+		mid := (t.y1 + minH) + ((rBytes & 0xFFFF) % (t.y2 - t.y1 - (2 * minH)))
 		t.hasChildren = 3
 		rBytes >>= 16
-		t.lTree = generateTree(t.x1, t.x2, t.y1, mid, minIn, maxIn, rBits, rBytes)
-		t.rTree = generateTree(t.x1, t.x2, mid, t.y2, minIn, maxIn, rBits, rBytes)
+		t.lTree = generateTree(t.x1, t.x2, t.y1, mid, minW, maxW, minH, maxH, rBits, rBytes)
+		t.rTree = generateTree(t.x1, t.x2, mid, t.y2, minW, maxW, minH, maxH, rBits, rBytes)
 		t.leafNum = t.lTree.leafNum + t.rTree.leafNum
 		/*If both are within the proper range, set this tree to a leaf*/
 	} else {
@@ -416,6 +463,9 @@ func gridDiffNaphil(g1 Grid, maxSum uint32, naphilArray1 []uint8, naphilArray2 [
 	return sum
 }
 
+/*The priority of grids from sources given no priority.*/
+const DEFAULT_PRIORITY uint8 = 1
+
 /*This is Brian Kernighan's bit-counting algorithm.*/
 func kern(x uint8) int {
 	count := 0
@@ -499,7 +549,7 @@ to overhead concerns.
 func binarySearchGridArray(array []Grid, a int, b int, shift_amount uint64, query uint64) int {
 	var m int
 searchStart:
-	if a < len(array) && b < len(array) && a < b {
+	if a < len(array) && b <= len(array) && a < b {
 		m = a + ((b - a) / 2)
 		if (array[m].dimCornAvg>>shift_amount)&255 < query {
 			a = m + 1
@@ -530,7 +580,7 @@ func findEndpoints(array []Grid, cursor int, shift_amount uint64, end_in int, m_
 	}
 	marg_end = end_in
 	if query < 255-m_64 {
-		marg_end = binarySearchGridArray(array, end_out+1, end_in, shift_amount, query+m_64)
+		marg_end = binarySearchGridArray(array, min(end_out+1, end_in), end_in, shift_amount, query+m_64)
 	}
 	return query, end_out, marg_end
 }
@@ -573,925 +623,738 @@ func findNewEndpointsMarg(array []Grid, start int, end int, shift_amount uint64,
 	return new_start, new_end, marg_end
 }
 
-func removeRedundantGrids(array []Grid, margin float64, tNum int, naphilArray []uint8) []Grid {
-	tellTime := false
-	startTime := time.Now().Unix()
+/*
+A step of the splitmix64 generator. The coin tosses between redundant
+grids draw their bits from it, seeded by where the grids are in the array,
+so that the same grids are removed however many threads remove them.
+*/
+func splitMix64(state *uint64) uint64 {
+	*state += 0x9E3779B97F4A7C15
+	z := *state
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	return z ^ (z >> 31)
+}
+
+/*
+A band of grids from start to end with the same dimensions and depth
+and averages within a range, and the end of the block of grids with the
+same dimensions and depth.
+*/
+type redundancyBand struct {
+	block      int
+	start, end int
+	blockEnd   int
+	deep       bool
+}
 
+/*
+Removes grids which are redundant with one another, keeping the one from
+the source with the higher priority, or either one if the priorities are
+equal. Only grids with the same dimensions and depth are compared, so
+each block of them in the sorted array is handled on its own. Blocks are
+split further into bands of averages at least as wide as the margin, so
+that a grid is never compared with one more than a band away. The even
+bands of every block are handled by tNum threads first, then the odd
+ones, so that no two threads handle the same grids at once. The bands do
+not depend on the number of threads, and neither does the result. The
+progress is logged at the given level.
+*/
+func removeRedundantGrids(array []Grid, margin float64, tNum int, naphilArray []uint8, level int) []Grid {
 	arrayLen := len(array)
 
 	/*The margin that is used to determine whether grids stay or go.*/
 	margInt := uint8(margin * 256.0)
-	m_64 := uint64(margInt)
-	margin_signed := int(margInt)
 
-	/*Used in binary searches*/
-	x_ := 0
-	y_ := arrayLen
+	/*Grids are marked here once eliminated, instead of in their metadata,
+	so that threads searching the metadata of other bands never read what
+	another thread is writing.*/
+	eliminated := make([]bool, arrayLen)
+	bandWidth := max(uint64(margInt), 16)
+
+	/*Finding the blocks of grids with the same dimensions and depth, and
+	the bands within them. Shallow grids (those with lesser differences
+	between min-max luma values) and deep grids (those with greater
+	differences) are compared differently. With the greatest margin, every
+	grid is compared as a shallow one.*/
+	var bands [2][]redundancyBand
+	var blockBands []int32
+	start := 0
+	for start < arrayLen {
+		dims := array[start].dimCornAvg >> 40
+		a := start + 1
+		b := arrayLen
+		for a < b {
+			m := a + ((b - a) / 2)
+			if array[m].dimCornAvg>>40 == dims {
+				a = m + 1
+			} else {
+				b = m
+			}
+		}
+		end := a
+		/*Grids eliminated before being passed in stay that way*/
+		if dims>>22 == 3 {
+			for i := start; i < end; i++ {
+				eliminated[i] = true
+			}
+			start = end
+			continue
+		}
+		deep := dims>>22 != 0 && margInt != 255
+		block := len(blockBands)
+		blockBands = append(blockBands, 0)
+		bandStart := start
+		for k := uint64(0); bandStart < end; k++ {
+			bandEnd := binarySearchGridArray(array, bandStart, end, 32, (k+1)*bandWidth)
+			if bandEnd > bandStart {
+				bands[k%2] = append(bands[k%2], redundancyBand{block: block, start: bandStart, end: bandEnd, blockEnd: end, deep: deep})
+				blockBands[block]++
+			}
+			bandStart = bandEnd
+		}
+		start = end
+	}
 
-	/*Finding where shallow grids (those with lesser differences
-	between min-max luma values) end and deep grids (those with
-	greater differences) begin.*/
-	var rangeCutoff int
-	if margInt == 255 {
-		rangeCutoff = arrayLen
-	} else {
-		for x_ < y_ {
-			mid := x_ + ((y_ - x_) / 2)
-			if array[mid].dimCornAvg>>56 == 0 {
-				x_ = mid + 1
+	/*Progress is reported as each block is finished*/
+	progress := newProgressLog(level, "dedup", "Removing redundant grids", len(blockBands))
+	for phase := range bands {
+		workerPool(len(bands[phase]), tNum, func(k int) {
+			band := bands[phase][k]
+			if band.deep {
+				removeRedundantDeep(array, eliminated, band.start, band.end, band.blockEnd, margInt, naphilArray, uint64(band.start))
 			} else {
-				y_ = mid
+				removeRedundantShallow(array, eliminated, band.start, band.end, band.blockEnd, margInt, naphilArray, uint64(band.start))
+			}
+			if atomic.AddInt32(&blockBands[band.block], -1) == 0 {
+				progress.add(1)
 			}
+		})
+	}
+
+	/*This "yanks" all remaining grids towards the front, keeping their
+	order, and erases all eliminated grids*/
+	remaining := 0
+	for i := range arrayLen {
+		if !eliminated[i] {
+			array[remaining] = array[i]
+			remaining++
 		}
-		rangeCutoff = x_
 	}
+	array = array[:remaining]
+	progress.finish(remaining)
+
+	return array
+}
+
+/*
+Compares the shallow grids from start to end with the grids after them,
+up to blockEnd where their block ends, eliminating those which are
+redundant. Shallow grids are redundant if the average difference between
+their pixels is within the margin.
+*/
+func removeRedundantShallow(array []Grid, eliminated []bool, start int, end int, blockEnd int, margInt uint8, naphilArray []uint8, seed uint64) {
+	m_64 := uint64(margInt)
+	margin_signed := int(margInt)
 
 	/*These will store the cross-range (greatest possible difference
 	between two pixels in different grids) and the corner that is
-	mismatche between two grids.*/
+	mismatche between two grids, and the offset in the pixel array that
+	the current grid points to.*/
 	var crossRange, mis uint8
-	/*These will store the product of the area of the grid and margin
-	(for the purposes of comparing shallow grids with each other), and
-	offsets in the pixel array that grids point to.*/
 	var g1_offset int
 
-	/*The dimensions of the first grid.*/
-	dims := (array[0].dimCornAvg >> 40) & 0xFFFF
-
-	/*Determining the beginning and end of parallelized subsections of the loop below. The endpoints
-	are set to dimension-based boundaries in the array to ensure all grids are compared with similar
-	grids. Some possible comparisons would be missed if the loop divisions fell in the middle of
-	a subset of grids with equal dimensions.*/
-	var loopDivs []int
-	if tNum > 1 {
-		loopDivs = make([]int, tNum+1)
-		loopDivs[0] = 0
-		loopDivs[tNum] = rangeCutoff
-		for i := 1; i < tNum; i++ {
-			tempDiv := i * arrayLen / tNum
-			dims := (array[tempDiv].dimCornAvg >> 40) & 0xFFFF
-			wTemp := array[tempDiv].getW()
-			hTemp := array[tempDiv].getH()
-			/*The initial boundary falls in the middle of a subset of gris with equal dimensions.*/
-			if (array[tempDiv-1].dimCornAvg>>40)&0xFFFF == dims && (array[tempDiv+1].dimCornAvg>>40)&0xFFFF == dims {
-				a := loopDivs[i-1]
-				b := max(0, tempDiv-1)
-				var m int
-				var gTemp Grid
-
-				/*Finnding the first grid that matches the dimensions*/
-				for a < b {
-					m = a + ((b - a) / 2)
-					gTemp = array[m]
-					if gTemp.getH() == hTemp && gTemp.getW() == wTemp {
-						b = m
-					} else {
-						a = m + 1
+	/*A signed variable containing the grid's area, used both to determine
+	the total allowable difference between two shallow grids and use for
+	offsets in the pixel data array.*/
+	area_signed := int(array[start].getW()) * int(array[start].getH())
+	areaMarg := area_signed * margin_signed
+	dim_end := blockEnd
+
+	rBits := splitMix64(&seed)
+	i := start
+
+	/*Determining the last grids similar to the first grid in various aspects.*/
+	_, avg_end, avg_marg_end := findEndpoints(array, start, 32, dim_end, m_64)
+	c1, c1_end, c1_marg_end := findEndpoints(array, start, 24, avg_end, m_64)
+	c2, c2_end, c2_marg_end := findEndpoints(array, start, 16, c1_end, m_64)
+	c3, c3_end, c3_marg_end := findEndpoints(array, start, 8, c2_end, m_64)
+	c4, c4_end, c4_marg_end := findEndpoints(array, start, 0, c3_end, m_64)
+
+	/*These are used to reset the above values below.*/
+	var new_c1_start, new_c1_end, new_c2_start, new_c2_end, new_c3_start, new_c3_end, new_avg_start, new_avg_end, j, new_j int
+
+	var g1 Grid
+
+	var breakLoop bool
+
+loopStart_shallow:
+	if i < end {
+		/*Grids already eliminated are skipped*/
+		if !eliminated[i] {
+			/*If nothing changes between the dimensions, averages, or corners
+			between the previous and current grid, go to the section of code
+			where the current grid is compared to subsequent grids. Otherwise,
+			change the indices.*/
+			if i < c4_end {
+				g1 = array[i]
+				j = i + 1
+				g1_offset = g1.offset
+				goto comparison_shallow
+			}
+			if i >= c3_end {
+				if i >= c2_end {
+					if i >= c1_end {
+						if i >= avg_end {
+							goto reset_avg_shallow
+						}
+						goto reset_c1_shallow
 					}
+					goto reset_c2_shallow
 				}
-				div1 := a
-
-				/*Finnding the last grid that matches the dimensions*/
-				a = min(tempDiv+1, rangeCutoff)
-				b = rangeCutoff
-				for a < b {
-					m = a + ((b - a) / 2)
-					if gTemp.getH() == hTemp && gTemp.getW() == wTemp {
-						a = m + 1
+				goto reset_c3_shallow
+			}
+			goto reset_c4_shallow
+		reset_avg_shallow:
+			_, avg_end, avg_marg_end = findEndpoints(array, i, 32, dim_end, m_64)
+		reset_c1_shallow:
+			c1, c1_end, c1_marg_end = findEndpoints(array, i, 24, avg_end, m_64)
+		reset_c2_shallow:
+			c2, c2_end, c2_marg_end = findEndpoints(array, i, 16, c1_end, m_64)
+		reset_c3_shallow:
+			c3, c3_end, c3_marg_end = findEndpoints(array, i, 8, c2_end, m_64)
+		reset_c4_shallow:
+			c4, c4_end, c4_marg_end = findEndpoints(array, i, 0, c3_end, m_64)
+
+			/*Comparing grids to other grids*/
+		comparison_shallow:
+			if j < c4_marg_end {
+				/*If the grid at j has not been eliminated*/
+				if !eliminated[j] {
+					g2 := array[j]
+					/*It will actually be fairly common among adjacent shallow grids
+					for their metadata variables to have a difference less than the
+					margin. If not, however, it checks if there is a significant
+					mismatch.*/
+					if g2.dimCornAvg-g1.dimCornAvg >= m_64 {
+						mis = gridMismatchCorn(g1.dimCornAvg&0xFFFFFFFF, g2.dimCornAvg&0xFFFFFFFF, m_64)
+						/*The general algorithm for a mismatch is to find new endpoints
+						(including margin) for level above the mismatch, then at the level
+						of the mismatch and everthing downstream (excluding margin) before
+						stopping at the fourth corner.*/
+						if mis != 0 {
+							if mis == 1 {
+								goto check_1
+							} else if mis < 3 {
+								goto check_2
+							} else if mis < 4 {
+								goto check_3
+							} else {
+								goto check_4
+							}
+						check_1:
+							new_avg_start, new_avg_end, breakLoop = findNewEndpoints(array, i, j, 32, avg_marg_end)
+							if breakLoop {
+								j = c4_marg_end
+								goto increment_shallow
+							}
+							new_c1_start, new_c1_end, c1_marg_end = findNewEndpointsMarg(array, new_avg_start, new_avg_end, 24, c1, m_64)
+							goto skip_2
+						check_2:
+							new_c1_start, new_c1_end, breakLoop = findNewEndpoints(array, i, j, 24, c1_marg_end)
+							if breakLoop {
+								j = c4_marg_end
+								goto increment_shallow
+							}
+						skip_2:
+							new_c2_start, new_c2_end, c2_marg_end = findNewEndpointsMarg(array, new_c1_start, new_c1_end, 16, c2, m_64)
+							goto skip_3
+						check_3:
+							new_c2_start, new_c2_end, breakLoop = findNewEndpoints(array, i, j, 16, c2_marg_end)
+							if breakLoop {
+								j = c4_marg_end
+								goto increment_shallow
+							}
+						skip_3:
+							new_c3_start, new_c3_end, c3_marg_end = findNewEndpointsMarg(array, new_c2_start, new_c2_end, 8, c3, m_64)
+							goto skip4
+						check_4:
+							new_c3_start, new_c3_end, breakLoop = findNewEndpoints(array, i, j, 8, c3_marg_end)
+							if breakLoop {
+								j = c4_marg_end
+								goto increment_shallow
+							}
+						skip4:
+							new_j = binarySearchGridArray(array, new_c3_start, new_c3_end, 0, c4) - 1
+							/*This solved a softlock issue.*/
+							if new_j >= j {
+								j = new_j
+							}
+							goto increment_shallow
+						}
+					}
+					/*The algorithm for determining a cross-range (or even deciding
+					to calculate one) is as follows:
+					If two grids have the same min-max values, then it goes to the
+					cointoss, since shallow grids by definition already have a difference
+					of min-max values below the margin.
+					If the maximum or the minimum between two grids is equal, but not both,
+					but both are still within the margin, it goes to the cointoss. If they
+					are not necessarily in the margin, the cross range is the difference of
+					the shared value and the furthest unshared value.
+					Finally, if min-max are both different between the grids, cross-range is
+					whichever is the greatest difference between opposite grids.*/
+					max1 := g1.maxLuma
+					max2 := g2.maxLuma
+					min1 := g1.minLuma
+					min2 := g2.minLuma
+					if min1 == min2 {
+						if max1 == max2 {
+							goto coinToss_shallow
+						}
+						if max1-min1 < margInt {
+							if max2-min1 < margInt {
+								goto coinToss_shallow
+							}
+							crossRange = max2 - min1
+						}
+						if max1 > max2 {
+							crossRange = max1 - min1
+						} else {
+							crossRange = max2 - min1
+						}
+					} else if max1 == max2 {
+						if max1-min1 < margInt {
+							if max1-min2 < margInt {
+								goto coinToss_shallow
+							}
+							crossRange = max1 - min2
+						}
+						if min1 < min2 {
+							crossRange = max1 - min1
+						} else {
+							crossRange = max1 - min2
+						}
+					} else if max2-min1 > max2-min1 {
+						crossRange = max2 - min1
 					} else {
-						b = 1
+						crossRange = max2 - min1
 					}
-				}
-				div2 := a
 
-				/*Choose the beginning or end of this subset depending
-				on which is closer to the original estimate*/
-				if tempDiv-div1 > div2-tempDiv {
-					tempDiv = div2
-				} else {
-					tempDiv = div1
+					/*If there is a substantial cross-range, and the average difference between pixels in
+					the grid is substantial, then both remain.*/
+					if crossRange >= margInt {
+						/*Check to ensure neither grid has its darkest pixel too much above the brightest of
+						the other.*/
+						if (max2 < 255-margInt && min1 > max2+margInt) || (max1 < 255-margInt && min2 > max1+margInt) {
+							goto increment_shallow
+						}
+
+						sum := 0
+
+						/*The above sum, minus the sum of the differences of pixels
+						already calculated.*/
+						maxSum_diff := areaMarg
+
+						i_1 := g1_offset
+						end_1 := g1_offset + area_signed
+						end_l := end_1 - (area_signed % 4)
+						i_2 := g2.offset
+						cr := int(crossRange)
+						var diff, p1, p2 uint8
+						/*The product of the remaining number of pixels and the
+						cross-range between grids.*/
+						i_cr := area_signed * cr
+						/*The loop ends if the sum of the differences between
+						corresponding pixels exceeds the product of the area
+						and the margin OR if the sum plus the product of the
+						remaining pixels and the cross-range is less than this
+						total permitted sum, meaining that it is no longer
+						mathetmatically possible for the grids to have such
+						a great average distance. This tightrope balance
+						fixed a slowdown issue.
+						This is unrolled, examining four pixels a cycle.*/
+						for i_1 < end_l {
+							p1 = naphilArray[i_1]
+							p2 = naphilArray[i_2]
+							if p1 != p2 {
+								diff = p1 - p2
+								if p2 > p1 {
+									diff = p2 - p1
+								}
+								sum += int(diff)
+								maxSum_diff -= int(diff)
+							}
+							i_cr -= cr
+							i_1++
+							i_2++
+							p1 = naphilArray[i_1]
+							p2 = naphilArray[i_2]
+							if p1 != p2 {
+								diff = p1 - p2
+								if p2 > p1 {
+									diff = p2 - p1
+								}
+								sum += int(diff)
+								maxSum_diff -= int(diff)
+							}
+							i_cr -= cr
+							i_1++
+							i_2++
+							p1 = naphilArray[i_1]
+							p2 = naphilArray[i_2]
+							if p1 != p2 {
+								diff = p1 - p2
+								if p2 > p1 {
+									diff = p2 - p1
+								}
+								sum += int(diff)
+								maxSum_diff -= int(diff)
+							}
+							i_cr -= cr
+							i_1++
+							i_2++
+							p1 = naphilArray[i_1]
+							p2 = naphilArray[i_2]
+							if p1 != p2 {
+								diff = p1 - p2
+								if p2 > p1 {
+									diff = p2 - p1
+								}
+								sum += int(diff)
+								maxSum_diff -= int(diff)
+							}
+							i_cr -= cr
+							if sum > areaMarg {
+								goto increment_shallow
+							}
+							if i_cr < maxSum_diff {
+								goto coinToss_shallow
+							}
+							i_1++
+							i_2++
+						}
+						for i_1 < end_1 && i_cr < maxSum_diff {
+							p1 = naphilArray[i_1]
+							p2 = naphilArray[i_2]
+							if p1 != p2 {
+								diff = p1 - p2
+								if p2 > p1 {
+									diff = p2 - p1
+								}
+								sum += int(diff)
+								maxSum_diff -= int(diff)
+							}
+							if sum > areaMarg {
+								goto increment_shallow
+							}
+							i_1++
+							i_2++
+						}
+					}
+
+					/*If the grids are so similar that cross-range is not substantial or the average difference
+					is not substantial, randomly decide which stays and which goes.*/
+				coinToss_shallow:
+					/*If the grids come from sources of different priorities, the grid
+					from the preferred source stays.*/
+					if array[i].priority < array[j].priority || (array[i].priority == array[j].priority && rBits%2 == 0) {
+						eliminated[i] = true
+						j = c4_marg_end
+					} else {
+						eliminated[j] = true
+					}
+					/*Instead of randomly generating a number only to use one of its bits each cointoss, a random
+					64-bit number is generated at the beginning of the loop, shifted each coinn-toss, and reset
+					whenever its bits run out.*/
+					rBits >>= 1
+					if rBits == 0 {
+						rBits = splitMix64(&seed)
+					}
 				}
+			increment_shallow:
+				j++
+				goto comparison_shallow
 			}
-			loopDivs[i] = tempDiv
 		}
+		i++
+		goto loopStart_shallow
 	}
+}
 
-	/*This loop is concerned with comparing shallow grids with each other.
-	The cross-range calculation procedure and the comparison function is
-	different between these and the deep grids, in addition to occupying
-	different sections of the array.*/
-	wg := sync.WaitGroup{}
-	for i__ := range tNum {
-		var start, end int
-		if tNum > 1 {
-			start, end = loopDivs[i__], loopDivs[i__+1]
-		} else {
-			start, end = 0, rangeCutoff
-		}
-		wg.Add(1)
-		go func(start, end int) {
-			defer wg.Done()
-			rBits := rand.Uint64()
-			i := start
-			w_curr := array[start].getW()
-			h_curr := array[start].getH()
-
-			/*A signed variable containing the grid's area, used both to determine
-			the total allowable difference between two shallow grids and use for
-			offsets in the pixel data array.*/
-			area_signed := int(w_curr) * int(h_curr)
-			areaMarg := area_signed * margin_signed
-
-			x_ := start + 1
-			y_ = end
-			var gTemp Grid
-			for x_ < y_ {
-				mid := x_ + ((y_ - x_) / 2)
-				gTemp = array[mid]
-				if gTemp.getW() != w_curr || gTemp.getH() != h_curr {
-					y_ = mid
-				} else {
-					x_ = mid + 1
-				}
-			}
-			dim_end := x_
-
-			/*Determining the last grids similar to the first grid in various aspects.*/
-			_, avg_end, avg_marg_end := findEndpoints(array, 0, 32, dim_end, m_64)
-			c1, c1_end, c1_marg_end := findEndpoints(array, 0, 24, avg_end, m_64)
-			c2, c2_end, c2_marg_end := findEndpoints(array, 0, 16, c1_end, m_64)
-			c3, c3_end, c3_marg_end := findEndpoints(array, 0, 8, c2_end, m_64)
-			c4, c4_end, c4_marg_end := findEndpoints(array, 0, 0, c3_end, m_64)
-
-			/*These are used to reset the above values below.*/
-			var new_c1_start, new_c1_end, new_c2_start, new_c2_end, new_c3_start, new_c3_end, new_avg_start, new_avg_end, j, new_j int
-
-			var g1 Grid
-
-			var breakLoop bool
-
-		loopStart_shallow:
-			if i < end {
-				if tellTime && time.Now().Unix() > startTime {
-					fmt.Printf("%d	%d\n", i, j)
-					startTime = time.Now().Unix()
-				}
-				/*If a grid is eliminated, its metadata value will have 0xFF placed
-				at the highest 16 bits.*/
-				if array[i].dimCornAvg>>56 != 255 {
-					/*If nothing changes between the dimensions, averages, or corners
-					between the previous and current grid, go to the section of code
-					where the current grid is compared to subsequent grids. Otherwise,
-					change the indices.*/
-					if i < c4_end {
-						g1 = array[i]
-						j = i + 1
-						g1_offset = g1.offset
-						goto comparison_shallow
+/*
+Compares the deep grids from start to end with the grids after them, up
+to blockEnd where their block ends, eliminating those which are
+redundant. Instead of determining average differences between grids,
+this checks the single greatest difference between corresponding pixels.
+*/
+func removeRedundantDeep(array []Grid, eliminated []bool, start int, end int, blockEnd int, margInt uint8, naphilArray []uint8, seed uint64) {
+	m_64 := uint64(margInt)
+
+	var crossRange, mis uint8
+	var g1_offset int
+
+	area_signed := int(array[start].getW()) * int(array[start].getH())
+	remainder_area := area_signed % 4
+	dim_end := blockEnd
+
+	rBits := splitMix64(&seed)
+	i := start
+
+	/*Determining the last grids similar to the first grid in various aspects.*/
+	_, avg_end, avg_marg_end := findEndpoints(array, start, 32, dim_end, m_64)
+	c1, c1_end, c1_marg_end := findEndpoints(array, start, 24, avg_end, m_64)
+	c2, c2_end, c2_marg_end := findEndpoints(array, start, 16, c1_end, m_64)
+	c3, c3_end, c3_marg_end := findEndpoints(array, start, 8, c2_end, m_64)
+	c4, c4_end, c4_marg_end := findEndpoints(array, start, 0, c3_end, m_64)
+
+	/*These are used to reset the above values below.*/
+	var new_c1_start, new_c1_end, new_c2_start, new_c2_end, new_c3_start, new_c3_end, new_avg_start, new_avg_end, j, new_j int
+
+	var g1 Grid
+
+	var breakLoop bool
+
+loopStart_deep:
+	if i < end {
+		if !eliminated[i] {
+			if i < c4_end {
+				g1 = array[i]
+				j = i + 1
+				g1_offset = g1.offset
+				goto comparison_deep
+			}
+			if i >= c3_end {
+				if i >= c2_end {
+					if i >= c1_end {
+						if i >= avg_end {
+							goto reset_avg_deep
+						}
+						goto reset_c1_deep
 					}
-					if i >= c3_end {
-						if i >= c2_end {
-							if i >= c1_end {
-								if i >= avg_end {
-									if i >= dim_end {
-										goto reset_dim_shallow
-									}
-									goto reset_avg_shallow
+					goto reset_c2_deep
+				}
+				goto reset_c3_deep
+			}
+			goto reset_c4_deep
+		reset_avg_deep:
+			_, avg_end, avg_marg_end = findEndpoints(array, i, 32, dim_end, m_64)
+		reset_c1_deep:
+			c1, c1_end, c1_marg_end = findEndpoints(array, i, 24, avg_end, m_64)
+		reset_c2_deep:
+			c2, c2_end, c2_marg_end = findEndpoints(array, i, 16, c1_end, m_64)
+		reset_c3_deep:
+			c3, c3_end, c3_marg_end = findEndpoints(array, i, 8, c2_end, m_64)
+		reset_c4_deep:
+			c4, c4_end, c4_marg_end = findEndpoints(array, i, 0, c3_end, m_64)
+		comparison_deep:
+			if j < c4_marg_end {
+				if !eliminated[j] {
+					g2 := array[j]
+					if g2.dimCornAvg-g1.dimCornAvg >= m_64 {
+						mis = gridMismatchCorn(g1.dimCornAvg&0xFFFFFFFF, g2.dimCornAvg&0xFFFFFFFF, m_64)
+						if mis != 0 {
+							/*The general algorithm for a mismatch is to find new endpoints
+							(including margin) for level above the mismatch, then at the level
+							of the mismatch and everthing downstream (excluding margin) before
+							stopping at the fourth corner.*/
+							if mis != 0 {
+								if mis == 1 {
+									goto check_1
+								} else if mis < 3 {
+									goto check_2
+								} else if mis < 4 {
+									goto check_3
+								} else {
+									goto check_4
+								}
+							check_1:
+								new_avg_start, new_avg_end, breakLoop = findNewEndpoints(array, i, j, 32, avg_marg_end)
+								if breakLoop {
+									j = c4_marg_end
+									goto increment_deep
+								}
+								new_c1_start, new_c1_end, c1_marg_end = findNewEndpointsMarg(array, new_avg_start, new_avg_end, 24, c1, m_64)
+								goto skip_2
+							check_2:
+								new_c1_start, new_c1_end, breakLoop = findNewEndpoints(array, i, j, 24, c1_marg_end)
+								if breakLoop {
+									j = c4_marg_end
+									goto increment_deep
 								}
-								goto reset_c1_shallow
+							skip_2:
+								new_c2_start, new_c2_end, c2_marg_end = findNewEndpointsMarg(array, new_c1_start, new_c1_end, 16, c2, m_64)
+								goto skip_3
+							check_3:
+								new_c2_start, new_c2_end, breakLoop = findNewEndpoints(array, i, j, 16, c2_marg_end)
+								if breakLoop {
+									j = c4_marg_end
+									goto increment_deep
+								}
+							skip_3:
+								new_c3_start, new_c3_end, c3_marg_end = findNewEndpointsMarg(array, new_c2_start, new_c2_end, 8, c3, m_64)
+								goto skip4
+							check_4:
+								new_c3_start, new_c3_end, breakLoop = findNewEndpoints(array, i, j, 8, c3_marg_end)
+								if breakLoop {
+									j = c4_marg_end
+									goto increment_deep
+								}
+							skip4:
+								new_j = binarySearchGridArray(array, new_c3_start, new_c3_end, 0, c4) - 1
+								if new_j >= j {
+									j = new_j
+								}
+								goto increment_deep
 							}
-							goto reset_c2_shallow
 						}
-						goto reset_c3_shallow
 					}
-					goto reset_c4_shallow
-				reset_dim_shallow:
-					w_curr = array[i].getW()
-					h_curr = array[i].getH()
-					area_signed = int(w_curr) * int(h_curr)
-					areaMarg = area_signed * margin_signed
-
-					x_ = i + 1
-					y_ = end
-					/*Find the last grid with dimensions equal to the current one.*/
-				binarySearchLoop_shallow:
-					if x_ < y_ {
-						mid := x_ + ((y_ - x_) / 2)
-						gTemp = array[mid]
-						if gTemp.getW() == w_curr && gTemp.getH() == h_curr {
-							x_ = mid + 1
-							goto binarySearchLoop_shallow
+					max1 := g1.maxLuma
+					max2 := g2.maxLuma
+					min1 := g1.minLuma
+					min2 := g2.minLuma
+					if min1 == min2 {
+						if max1 >= max2 {
+							crossRange = max1 - min1
+						} else {
+							crossRange = max2 - min1
 						}
-						y_ = mid
-						goto binarySearchLoop_shallow
-					}
-					dim_end = x_
-
-					/*Reset the appropriate dimension values accordingly.*/
-					area_signed = int(w_curr) * int(h_curr)
-					areaMarg = area_signed * margin_signed
-
-					/*Resetting everything else besides dimensions*/
-				reset_avg_shallow:
-					_, avg_end, avg_marg_end = findEndpoints(array, i, 32, dim_end, m_64)
-				reset_c1_shallow:
-					c1, c1_end, c1_marg_end = findEndpoints(array, i, 24, avg_end, m_64)
-				reset_c2_shallow:
-					c2, c2_end, c2_marg_end = findEndpoints(array, i, 16, c1_end, m_64)
-				reset_c3_shallow:
-					c3, c3_end, c3_marg_end = findEndpoints(array, i, 8, c2_end, m_64)
-				reset_c4_shallow:
-					c4, c4_end, c4_marg_end = findEndpoints(array, i, 0, c3_end, m_64)
-
-					/*Comparing grids to other grids*/
-				comparison_shallow:
-					if j < c4_marg_end {
-						if tellTime && time.Now().Unix() > startTime {
-							fmt.Printf("%d	%d\n", i, j)
-							startTime = time.Now().Unix()
+					} else if max1 == max2 {
+						if max1 < max2 {
+							crossRange = max1 - min1
+						} else {
+							crossRange = max1 - min2
 						}
-						/*If the grid at j has not been eliminated*/
-						if array[j].dimCornAvg>>56 != 255 {
-							g2 := array[j]
-							/*It will actually be fairly common among adjacent shallow grids
-							for their metadata variables to have a difference less than the
-							margin. If not, however, it checks if there is a significant
-							mismatch.*/
-							if g2.dimCornAvg-g1.dimCornAvg >= m_64 {
-								mis = gridMismatchCorn(g1.dimCornAvg&0xFFFFFFFF, g2.dimCornAvg&0xFFFFFFFF, m_64)
-								/*The general algorithm for a mismatch is to find new endpoints
-								(including margin) for level above the mismatch, then at the level
-								of the mismatch and everthing downstream (excluding margin) before
-								stopping at the fourth corner.*/
-								if mis != 0 {
-									if mis == 1 {
-										goto check_1
-									} else if mis < 3 {
-										goto check_2
-									} else if mis < 4 {
-										goto check_3
-									} else {
-										goto check_4
-									}
-								check_1:
-									new_avg_start, new_avg_end, breakLoop = findNewEndpoints(array, i, j, 32, avg_marg_end)
-									if breakLoop {
-										j = c4_marg_end
-										goto increment_shallow
-									}
-									new_c1_start, new_c1_end, c1_marg_end = findNewEndpointsMarg(array, new_avg_start, new_avg_end, 24, c1, m_64)
-									goto skip_2
-								check_2:
-									new_c1_start, new_c1_end, breakLoop = findNewEndpoints(array, i, j, 24, c1_marg_end)
-									if breakLoop {
-										j = c4_marg_end
-										goto increment_shallow
-									}
-								skip_2:
-									new_c2_start, new_c2_end, c2_marg_end = findNewEndpointsMarg(array, new_c1_start, new_c1_end, 16, c2, m_64)
-									goto skip_3
-								check_3:
-									new_c2_start, new_c2_end, breakLoop = findNewEndpoints(array, i, j, 16, c2_marg_end)
-									if breakLoop {
-										j = c4_marg_end
-										goto increment_shallow
-									}
-								skip_3:
-									new_c3_start, new_c3_end, c3_marg_end = findNewEndpointsMarg(array, new_c2_start, new_c2_end, 8, c3, m_64)
-									goto skip4
-								check_4:
-									new_c3_start, new_c3_end, breakLoop = findNewEndpoints(array, i, j, 8, c3_marg_end)
-									if breakLoop {
-										j = c4_marg_end
-										goto increment_shallow
-									}
-								skip4:
-									new_j = binarySearchGridArray(array, new_c3_start, new_c3_end, 0, c4) - 1
-									/*This solved a softlock issue.*/
-									if new_j >= j {
-										j = new_j
-									}
-									goto increment_shallow
+					} else {
+						crossRange = max(max2-min1, max1-min2)
+					}
+
+					if crossRange >= margInt {
+						var end_l int
+						var p1, p2, diff uint8
+						end_l = g1_offset + area_signed - remainder_area
+						i_1 := g1_offset
+						i_2 := g2.offset
+						/*This loop is unrolled, checking four pairs of pixels in a cycle.*/
+						for i_1 < end_l {
+							p1 = naphilArray[i_1]
+							p2 = naphilArray[i_2]
+							if p1 != p2 {
+								diff = p1 - p2
+								if p1 < p2 {
+									diff = p2 - p1
+								}
+								if diff >= margInt {
+									goto increment_deep
 								}
 							}
-							/*The algorithm for determining a cross-range (or even deciding
-							to calculate one) is as follows:
-							If two grids have the same min-max values, then it goes to the
-							cointoss, since shallow grids by definition already have a difference
-							of min-max values below the margin.
-							If the maximum or the minimum between two grids is equal, but not both,
-							but both are still within the margin, it goes to the cointoss. If they
-							are not necessarily in the margin, the cross range is the difference of
-							the shared value and the furthest unshared value.
-							Finally, if min-max are both different between the grids, cross-range is
-							whichever is the greatest difference between opposite grids.*/
-							max1 := g1.maxLuma
-							max2 := g2.maxLuma
-							min1 := g1.minLuma
-							min2 := g2.minLuma
-							if min1 == min2 {
-								if max1 == max2 {
-									goto coinToss_shallow
+							i_1++
+							i_2++
+							p1 = naphilArray[i_1]
+							p2 = naphilArray[i_2]
+							if p1 != p2 {
+								diff = p1 - p2
+								if p1 < p2 {
+									diff = p2 - p1
 								}
-								if max1-min1 < margInt {
-									if max2-min1 < margInt {
-										goto coinToss_shallow
-									}
-									crossRange = max2 - min1
+								if diff >= margInt {
+									goto increment_deep
 								}
-								if max1 > max2 {
-									crossRange = max1 - min1
-								} else {
-									crossRange = max2 - min1
+							}
+							i_1++
+							i_2++
+							p1 = naphilArray[i_1]
+							p2 = naphilArray[i_2]
+							if p1 != p2 {
+								diff = p1 - p2
+								if p1 < p2 {
+									diff = p2 - p1
 								}
-							} else if max1 == max2 {
-								if max1-min1 < margInt {
-									if max1-min2 < margInt {
-										goto coinToss_shallow
-									}
-									crossRange = max1 - min2
+								if diff >= margInt {
+									goto increment_deep
 								}
-								if min1 < min2 {
-									crossRange = max1 - min1
-								} else {
-									crossRange = max1 - min2
+							}
+							i_1++
+							i_2++
+							p1 = naphilArray[i_1]
+							p2 = naphilArray[i_2]
+							if p1 != p2 {
+								diff = p1 - p2
+								if p1 < p2 {
+									diff = p2 - p1
+								}
+								if diff >= margInt {
+									goto increment_deep
 								}
-							} else if max2-min1 > max2-min1 {
-								crossRange = max2 - min1
-							} else {
-								crossRange = max2 - min1
 							}
-
-							/*If there is a substantial cross-range, and the average difference between pixels in
-							the grid is substantial, then both remain.*/
-							if crossRange >= margInt {
-								/*Check to ensure neither grid has its darkest pixel too much above the brightest of
-								the other.*/
-								if (max2 < 255-margInt && min1 > max2+margInt) || (max1 < 255-margInt && min2 > max1+margInt) {
-									goto increment_shallow
+							i_1++
+							i_2++
+						}
+						if remainder_area != 0 {
+							p1 = naphilArray[i_1]
+							p2 = naphilArray[i_2]
+							if p1 != p2 {
+								diff = p1 - p2
+								if p1 < p2 {
+									diff = p2 - p1
 								}
-
-								sum := 0
-
-								/*The above sum, minus the sum of the differences of pixels
-								already calculated.*/
-								maxSum_diff := areaMarg
-
-								i_1 := g1_offset
-								end_1 := g1_offset + area_signed
-								end_l := end_1 - (area_signed % 4)
-								i_2 := g2.offset
-								cr := int(crossRange)
-								var diff, p1, p2 uint8
-								/*The product of the remaining number of pixels and the
-								cross-range between grids.*/
-								i_cr := area_signed * cr
-								/*The loop ends if the sum of the differences between
-								corresponding pixels exceeds the product of the area
-								and the margin OR if the sum plus the product of the
-								remaining pixels and the cross-range is less than this
-								total permitted sum, meaining that it is no longer
-								mathetmatically possible for the grids to have such
-								a great average distance. This tightrope balance
-								fixed a slowdown issue.
-								This is unrolled, examining four pixels a cycle.*/
-								for i_1 < end_l {
-									p1 = naphilArray[i_1]
-									p2 = naphilArray[i_2]
-									if p1 != p2 {
-										diff = p1 - p2
-										if p2 > p1 {
-											diff = p2 - p1
-										}
-										sum += int(diff)
-										maxSum_diff -= int(diff)
-									}
-									i_cr -= cr
-									i_1++
-									i_2++
-									p1 = naphilArray[i_1]
-									p2 = naphilArray[i_2]
-									if p1 != p2 {
-										diff = p1 - p2
-										if p2 > p1 {
-											diff = p2 - p1
-										}
-										sum += int(diff)
-										maxSum_diff -= int(diff)
+								if diff >= margInt {
+									goto increment_deep
+								}
+							}
+							if remainder_area > 1 {
+								i_1++
+								i_2++
+								p1 = naphilArray[i_1]
+								p2 = naphilArray[i_2]
+								if p1 != p2 {
+									diff = p1 - p2
+									if p1 < p2 {
+										diff = p2 - p1
 									}
-									i_cr -= cr
-									i_1++
-									i_2++
-									p1 = naphilArray[i_1]
-									p2 = naphilArray[i_2]
-									if p1 != p2 {
-										diff = p1 - p2
-										if p2 > p1 {
-											diff = p2 - p1
-										}
-										sum += int(diff)
-										maxSum_diff -= int(diff)
+									if diff >= margInt {
+										goto increment_deep
 									}
-									i_cr -= cr
+								}
+								if remainder_area > 2 {
 									i_1++
 									i_2++
 									p1 = naphilArray[i_1]
 									p2 = naphilArray[i_2]
 									if p1 != p2 {
 										diff = p1 - p2
-										if p2 > p1 {
+										if p1 < p2 {
 											diff = p2 - p1
 										}
-										sum += int(diff)
-										maxSum_diff -= int(diff)
-									}
-									i_cr -= cr
-									if sum > areaMarg {
-										goto increment_shallow
-									}
-									if i_cr < maxSum_diff {
-										goto coinToss_shallow
-									}
-									i_1++
-									i_2++
-								}
-								for i_1 < end_1 && i_cr < maxSum_diff {
-									p1 = naphilArray[i_1]
-									p2 = naphilArray[i_2]
-									if p1 != p2 {
-										diff = p1 - p2
-										if p2 > p1 {
-											diff = p2 - p1
+										if diff >= margInt {
+											goto increment_deep
 										}
-										sum += int(diff)
-										maxSum_diff -= int(diff)
 									}
-									if sum > areaMarg {
-										goto increment_shallow
-									}
-									i_1++
-									i_2++
 								}
 							}
-
-							/*If the grids are so similar that cross-range is not substantial or the average difference
-							is not substantial, randomly decide which stays and which goes.*/
-						coinToss_shallow:
-							if rBits%2 == 0 {
-								array[i].dimCornAvg |= 0xFF00000000000000
-								j = c4_marg_end
-							} else {
-								array[j].dimCornAvg |= 0xFF00000000000000
-							}
-							/*Instead of randomly generating a number only to use one of its bits each cointoss, a random
-							64-bit number is generated at the beginning of the loop, shifted each coinn-toss, and reset
-							whenever its bits run out.*/
-							rBits >>= 1
-							if rBits == 0 {
-								rBits = rand.Uint64()
-							}
 						}
-					increment_shallow:
-						j++
-						goto comparison_shallow
 					}
-				}
-				i++
-				goto loopStart_shallow
-			}
-		}(start, end)
-	}
-	wg.Wait()
-	if tNum > 1 {
-		loopDivs = make([]int, tNum+1)
-		loopDivs[0] = rangeCutoff
-		loopDivs[tNum] = arrayLen
-		for i := 1; i < tNum; i++ {
-			tempDiv := (i * (arrayLen - rangeCutoff) / tNum) + rangeCutoff
-			dims := (array[tempDiv].dimCornAvg >> 40) & 0xFFFF
-			if (array[tempDiv-1].dimCornAvg>>40)&0xFFFF == dims && (array[tempDiv+1].dimCornAvg>>40)&0xFFFF == dims {
-				a := loopDivs[i-1]
-				b := max(tempDiv-1, rangeCutoff)
-				var m int
-				for a < b {
-					m = a + ((b - a) / 2)
-					if (array[m].dimCornAvg>>40)&0xFFFF == dims {
-						b = m
+
+					if array[i].priority < array[j].priority || (array[i].priority == array[j].priority && rBits%2 == 0) {
+						eliminated[i] = true
+						j = c4_marg_end
 					} else {
-						a = m + 1
+						eliminated[j] = true
 					}
-				}
-				div1 := a
-				a = min(tempDiv+1, arrayLen)
-				b = arrayLen
-				for a < b {
-					m = a + ((b - a) / 2)
-					if (array[m].dimCornAvg>>40)&0xFFFF == dims {
-						a = m + 1
-					} else {
-						b = 1
+					rBits >>= 1
+					if rBits == 0 {
+						rBits = splitMix64(&seed)
 					}
 				}
-				div2 := a
-				if tempDiv-div1 > div2-tempDiv {
-					tempDiv = div2
-				} else {
-					tempDiv = div1
-				}
+			increment_deep:
+				j++
+				goto comparison_deep
 			}
-			loopDivs[i] = tempDiv
 		}
+		i++
+		goto loopStart_deep
 	}
-	/*Instead of determining average differences between grids, this checks the single greatest
-	difference between corresponding pixels.*/
-	wg = sync.WaitGroup{}
-	for i__ := range tNum {
-		var start, end int
-		if tNum > 1 {
-			start, end = loopDivs[i__], loopDivs[i__+1]
-		} else {
-			start, end = rangeCutoff, arrayLen
-		}
-		wg.Add(1)
-		go func(start, end int) {
-			defer wg.Done()
-			rBits := rand.Uint64()
-			i := start
-			w_curr := array[start].getW()
-			h_curr := array[start].getH()
-
-			area_signed := int(w_curr) * int(h_curr)
-
-			remainder_area := area_signed % 4
-
-			x_ := start + 1
-			y_ = end
-			var gTemp Grid
-			for x_ < y_ {
-				mid := x_ + ((y_ - x_) / 2)
-				gTemp = array[mid]
-				if gTemp.getW() != w_curr || gTemp.getH() != h_curr {
-					y_ = mid
-				} else {
-					x_ = mid + 1
-				}
-			}
-			dim_end := x_
-
-			/*Determining the last grids similar to the first grid in various aspects.*/
-			_, avg_end, avg_marg_end := findEndpoints(array, 0, 32, dim_end, m_64)
-			c1, c1_end, c1_marg_end := findEndpoints(array, 0, 24, avg_end, m_64)
-			c2, c2_end, c2_marg_end := findEndpoints(array, 0, 16, c1_end, m_64)
-			c3, c3_end, c3_marg_end := findEndpoints(array, 0, 8, c2_end, m_64)
-			c4, c4_end, c4_marg_end := findEndpoints(array, 0, 0, c3_end, m_64)
-
-			/*These are used to reset the above values below.*/
-			var new_c1_start, new_c1_end, new_c2_start, new_c2_end, new_c3_start, new_c3_end, new_avg_start, new_avg_end, j, new_j int
-
-			var g1 Grid
-
-			var breakLoop bool
-		loopStart_deep:
-			if i < end {
-				if tellTime && time.Now().Unix() > startTime {
-					fmt.Printf("%d	%d\n", i, j)
-					startTime = time.Now().Unix()
-				}
-				if array[i].dimCornAvg>>56 != 255 {
-					if i < c4_end {
-						g1 = array[i]
-						j = i + 1
-						goto comparison_deep
-					}
-					if i >= c3_end {
-						if i >= c2_end {
-							if i >= c1_end {
-								if i >= avg_end {
-									if i >= dim_end {
-										goto reset_dim_deep
-									}
-									goto reset_avg_deep
-								}
-								goto reset_c1_deep
-							}
-							goto reset_c2_deep
-						}
-						goto reset_c3_deep
-					}
-					goto reset_c4_deep
-				reset_dim_deep:
-					dims = (array[i].dimCornAvg >> 40) & 0xFFFF
-					x_ = i + 1
-					y_ = end
-					for x_ < y_ {
-						mid := x_ + ((y_ - x_) / 2)
-						gTemp = array[mid]
-						if (gTemp.dimCornAvg>>40)&0xFFFF <= dims {
-							x_ = mid + 1
-						} else {
-							y_ = mid
-						}
-					}
-					dim_end = x_
-					area_signed = int(dims & 255)
-					area_signed *= int((dims >> 8) & 255)
-				reset_avg_deep:
-					_, avg_end, avg_marg_end = findEndpoints(array, i, 32, dim_end, m_64)
-				reset_c1_deep:
-					c1, c1_end, c1_marg_end = findEndpoints(array, i, 24, avg_end, m_64)
-				reset_c2_deep:
-					c2, c2_end, c2_marg_end = findEndpoints(array, i, 16, c1_end, m_64)
-				reset_c3_deep:
-					c3, c3_end, c3_marg_end = findEndpoints(array, i, 8, c2_end, m_64)
-				reset_c4_deep:
-					c4, c4_end, c4_marg_end = findEndpoints(array, i, 0, c3_end, m_64)
-					if c4_marg_end > arrayLen {
-						c4_marg_end = arrayLen
-					}
-				comparison_deep:
-					if j < c4_marg_end {
-						if tellTime && time.Now().Unix() > startTime {
-							fmt.Printf("%d	%d\n", i, j)
-							startTime = time.Now().Unix()
-						}
-						if array[j].dimCornAvg>>56 != 255 {
-							g2 := array[j]
-							if g2.dimCornAvg-g1.dimCornAvg >= m_64 {
-								mis = gridMismatchCorn(g1.dimCornAvg&0xFFFFFFFF, g2.dimCornAvg&0xFFFFFFFF, m_64)
-								if mis != 0 {
-									/*The general algorithm for a mismatch is to find new endpoints
-									(including margin) for level above the mismatch, then at the level
-									of the mismatch and everthing downstream (excluding margin) before
-									stopping at the fourth corner.*/
-									if mis != 0 {
-										if mis == 1 {
-											goto check_1
-										} else if mis < 3 {
-											goto check_2
-										} else if mis < 4 {
-											goto check_3
-										} else {
-											goto check_4
-										}
-									check_1:
-										new_avg_start, new_avg_end, breakLoop = findNewEndpoints(array, i, j, 32, avg_marg_end)
-										if breakLoop {
-											j = c4_marg_end
-											goto increment_deep
-										}
-										new_c1_start, new_c1_end, c1_marg_end = findNewEndpointsMarg(array, new_avg_start, new_avg_end, 24, c1, m_64)
-										goto skip_2
-									check_2:
-										new_c1_start, new_c1_end, breakLoop = findNewEndpoints(array, i, j, 24, c1_marg_end)
-										if breakLoop {
-											j = c4_marg_end
-											goto increment_deep
-										}
-									skip_2:
-										new_c2_start, new_c2_end, c2_marg_end = findNewEndpointsMarg(array, new_c1_start, new_c1_end, 16, c2, m_64)
-										goto skip_3
-									check_3:
-										new_c2_start, new_c2_end, breakLoop = findNewEndpoints(array, i, j, 16, c2_marg_end)
-										if breakLoop {
-											j = c4_marg_end
-											goto increment_deep
-										}
-									skip_3:
-										new_c3_start, new_c3_end, c3_marg_end = findNewEndpointsMarg(array, new_c2_start, new_c2_end, 8, c3, m_64)
-										goto skip4
-									check_4:
-										new_c3_start, new_c3_end, breakLoop = findNewEndpoints(array, i, j, 8, c3_marg_end)
-										if breakLoop {
-											j = c4_marg_end
-											goto increment_deep
-										}
-									skip4:
-										new_j = binarySearchGridArray(array, new_c3_start, new_c3_end, 0, c4) - 1
-										if new_j >= j {
-											j = new_j
-										}
-										goto increment_deep
-									}
-								}
-							}
-							max1 := g1.maxLuma
-							max2 := g2.maxLuma
-							min1 := g1.minLuma
-							min2 := g2.minLuma
-							if min1 == min2 {
-								if max1 >= max2 {
-									crossRange = max1 - min1
-								} else {
-									crossRange = max2 - min1
-								}
-							} else if max1 == max2 {
-								if max1 < max2 {
-									crossRange = max1 - min1
-								} else {
-									crossRange = max1 - min2
-								}
-							} else {
-								crossRange = max(max2-min1, max1-min2)
-							}
-
-							if crossRange >= margInt {
-								var end_l int
-								var p1, p2, diff uint8
-								end_l = g1_offset + area_signed - remainder_area
-								i_1 := g1_offset
-								i_2 := g2.offset
-								/*This loop is unrolled, checking four pairs of pixels in a cycle.*/
-								for i_1 < end_l {
-									p1 = naphilArray[i_1]
-									p2 = naphilArray[i_2]
-									if p1 != p2 {
-										diff = p1 - p2
-										if p1 < p2 {
-											diff = p2 - p1
-										}
-										if diff >= margInt {
-											goto increment_deep
-										}
-									}
-									i_1++
-									i_2++
-									p1 = naphilArray[i_1]
-									p2 = naphilArray[i_2]
-									if p1 != p2 {
-										diff = p1 - p2
-										if p1 < p2 {
-											diff = p2 - p1
-										}
-										if diff >= margInt {
-											goto increment_deep
-										}
-									}
-									i_1++
-									i_2++
-									p1 = naphilArray[i_1]
-									p2 = naphilArray[i_2]
-									if p1 != p2 {
-										diff = p1 - p2
-										if p1 < p2 {
-											diff = p2 - p1
-										}
-										if diff >= margInt {
-											goto increment_deep
-										}
-									}
-									i_1++
-									i_2++
-									p1 = naphilArray[i_1]
-									p2 = naphilArray[i_2]
-									if p1 != p2 {
-										diff = p1 - p2
-										if p1 < p2 {
-											diff = p2 - p1
-										}
-										if diff >= margInt {
-											goto increment_deep
-										}
-									}
-									i_1++
-									i_2++
-								}
-								if remainder_area != 0 {
-									p1 = naphilArray[i_1]
-									p2 = naphilArray[i_2]
-									if p1 != p2 {
-										diff = p1 - p2
-										if p1 < p2 {
-											diff = p2 - p1
-										}
-										if diff >= margInt {
-											goto increment_deep
-										}
-									}
-									if remainder_area > 1 {
-										i_1++
-										i_2++
-										p1 = naphilArray[i_1]
-										p2 = naphilArray[i_2]
-										if p1 != p2 {
-											diff = p1 - p2
-											if p1 < p2 {
-												diff = p2 - p1
-											}
-											if diff >= margInt {
-												goto increment_deep
-											}
-										}
-										if remainder_area > 2 {
-											i_1++
-											i_2++
-											p1 = naphilArray[i_1]
-											p2 = naphilArray[i_2]
-											if p1 != p2 {
-												diff = p1 - p2
-												if p1 < p2 {
-													diff = p2 - p1
-												}
-												if diff >= margInt {
-													goto increment_deep
-												}
-											}
-										}
-									}
-								}
-							}
-
-							if rBits%2 == 0 {
-								array[i].dimCornAvg |= 0xFF00000000000000
-								j = c4_marg_end
-							} else {
-								array[j].dimCornAvg |= 0xFF00000000000000
-							}
-							rBits >>= 1
-							if rBits == 0 {
-								rBits = rand.Uint64()
-							}
-						}
-					increment_deep:
-						j++
-						goto comparison_deep
-					}
-				}
-				i++
-				goto loopStart_deep
-			}
-		}(start, end)
-	}
-	wg.Wait()
-
-	var max_64 uint64
-	max_64 = math.MaxUint64
-
-	eliminated_shallow_64 := uint64(0)
-	for i := range rangeCutoff {
-		eliminated_shallow_64 += ((array[i].dimCornAvg >> 56) / 255)
-	}
-	remaining_shallow := rangeCutoff - int(eliminated_shallow_64)
-	resettled_shallow := 0
-	var i = 0
-	var j int
-	/*These loops "yanks" all remaining grids towards the front*/
-	for i < rangeCutoff-1 && resettled_shallow < remaining_shallow {
-		if array[i].dimCornAvg>>56 != 255 {
-			i++
-		} else if j < i {
-			j = i + 1
-		} else if array[j].dimCornAvg>>56 == 255 {
-			j++
-		} else {
-			array[i].w__ = array[j].w__
-			array[i].h__ = array[j].h__
-			array[i].offset = array[j].offset
-			array[i].avgLuma = array[j].avgLuma
-			array[i].minLuma = array[j].minLuma
-			array[i].maxLuma = array[j].maxLuma
-			array[i].coord = array[j].coord
-			array[i].dimCornAvg = array[j].dimCornAvg
-			array[j].dimCornAvg = max_64
-			resettled_shallow++
-			i++
-			j++
-		}
-	}
-
-	eliminated_deep_64 := uint64(0)
-	for i := rangeCutoff; i < arrayLen; i++ {
-		eliminated_deep_64 += ((array[i].dimCornAvg >> 56) / 255)
-	}
-	remaining_deep := arrayLen - rangeCutoff - int(eliminated_deep_64)
-	resettled_deep := 0
-	j = rangeCutoff
-	for i < arrayLen-1 && resettled_deep < remaining_deep {
-		if array[i].dimCornAvg>>56 != 255 {
-			i++
-		} else if j < i {
-			j = i + 1
-		} else if array[j].dimCornAvg>>56 == 255 {
-			j++
-		} else {
-			array[i].w__ = array[j].w__
-			array[i].h__ = array[j].h__
-			array[i].offset = array[j].offset
-			array[i].avgLuma = array[j].avgLuma
-			array[i].minLuma = array[j].minLuma
-			array[i].maxLuma = array[j].maxLuma
-			array[i].coord = array[j].coord
-			array[i].dimCornAvg = array[j].dimCornAvg
-			array[j].dimCornAvg = max_64
-			resettled_deep++
-			i++
-			j++
-		}
-	}
-	/*This erases all eliminated grids*/
-	array = array[:resettled_deep+resettled_shallow]
-
-	return array
-}
+}
 
 /*
 Get the xy coordinates from a tree in order to
@@ -1526,37 +1389,45 @@ func coordsFromTree(t *Tree, imageIndex uint64, coordArray [][]uint64, index int
 	}
 }
 
-func encodeCoords(t *Tree, imageIndex uint64, encodedCoords []uint64, index int) {
+/*
+The metadata of a grid about to be taken from an image, sortable by the
+image it comes from, then its dimensions, then its coordinates. The
+dims variable holds the index of the image above the width and height,
+eight bits each, and pos holds the complement of the leftmost
+x-coordinate above that of the top y-coordinate, 32 bits each.
+*/
+type encodedCoord struct {
+	dims uint64
+	pos  uint64
+}
+
+func (a encodedCoord) less(b encodedCoord) bool {
+	return a.dims < b.dims || (a.dims == b.dims && a.pos < b.pos)
+}
+
+func encodeCoords(t *Tree, imageIndex uint64, encodedCoords []encodedCoord, index int) {
 	/*If the tree is in fact a leaf, it place its
 	coordinates into the array*/
 	if t.hasChildren == 0 {
 		if index >= len(encodedCoords) {
 			panic("Out of bounds")
 		}
-		if encodedCoords[index] != 0 {
+		if encodedCoords[index].dims != 0 {
 			panic("Already set\n")
 		}
 		/*Encode the index of the image from the array*/
 		enc := imageIndex
 		/*Encode the width*/
-		enc <<= 8
-		enc += ((t.x2 - t.x1) & 255)
+		enc <<= 16
+		enc += ((t.x2 - t.x1) & 0xFFFF)
 		/*Encode the height*/
-		enc <<= 8
-		enc += ((t.y2 - t.y1) & 255)
-		enc <<= 13
-		/*Encode the leftmost x-coordinate*/
-		if t.x1 > 8191 {
-			panic("Invalid coordinate")
-		}
-		enc += ((^t.x1) & 8191)
-		/*Encode the top y-coordinate*/
-		enc <<= 13
-		if t.y1 > 8191 {
+		enc <<= 16
+		enc += ((t.y2 - t.y1) & 0xFFFF)
+		/*Encode the leftmost x-coordinate and top y-coordinate*/
+		if t.x1 > math.MaxUint32 || t.y1 > math.MaxUint32 {
 			panic("Invalid coordinate")
 		}
-		enc += ((^t.y1) & 8191)
-		encodedCoords[index] = enc
+		encodedCoords[index] = encodedCoord{dims: enc, pos: (((^t.x1) & 0xFFFFFFFF) << 32) | ((^t.y1) & 0xFFFFFFFF)}
 		return
 	}
 	/*Otherwise, find leaves while offsetting the index when
@@ -1569,9 +1440,398 @@ func encodeCoords(t *Tree, imageIndex uint64, encodedCoords []uint64, index int)
 	}
 }
 
-func lumaTrace(imgW int, imgH int, pix_data []uint8, array []Grid, arrayLen int, t *Tree, naphilArrayIn []uint8) []uint8 {
-	tellTime := false
+/*
+Determines how much of a rectangle in an image is covered by a mask. It
+returns 0 if none of it is, 2 if all of it is, and 1 if the rectangle
+straddles the edge of the mask or the mask is partially transparent
+within it.
+*/
+func maskCoverage(mask []uint8, imgW int, x1 int, x2 int, y1 int, y2 int) uint8 {
+	seenIn := false
+	seenOut := false
+	for y := y1; y < y2; y++ {
+		for _, m := range mask[(y*imgW)+x1 : (y*imgW)+x2] {
+			if m == 0 {
+				seenOut = true
+			} else if m == 255 {
+				seenIn = true
+			} else {
+				return 1
+			}
+			if seenIn && seenOut {
+				return 1
+			}
+		}
+	}
+	if seenIn {
+		return 2
+	}
+	return 0
+}
+
+/*
+Blends a row of traced pixels with the same row of the original image,
+weighted by the mask. Fully masked pixels are traced, unmasked pixels
+are copied through.
+*/
+func blendRow(out []uint8, traced []uint8, orig []uint8, mask []uint8) {
+	for i, m := range mask {
+		m_32 := uint32(m)
+		out[i] = uint8(((uint32(traced[i]) * m_32) + (uint32(orig[i]) * (255 - m_32)) + 127) / 255)
+	}
+}
+
+/*
+Reads an image as grayscale pixel data, keeping its alpha channel if it
+has one. The alpha channel is nil for images without one. 16-bit images,
+which renders usually are, are scaled down to 8 bits first. Images of
+other depths are read as plain grayscale, the same way as before alpha
+was supported, unless they have an alpha channel, which cannot be kept.
+*/
+func readGrayAlpha(path string) ([]uint8, []uint8, int, int, error) {
+	img := gocv.IMRead(path, gocv.IMReadUnchanged)
+	if img.Empty() {
+		return nil, nil, 0, 0, fmt.Errorf("error loading image %s", path)
+	}
+	defer img.Close()
+	imgW := img.Cols()
+	imgH := img.Rows()
+	channels := img.Channels()
+	src := img
+	if img.Type()&7 == gocv.MatTypeCV16U && channels >= 1 && channels <= 4 {
+		conv := gocv.NewMat()
+		defer conv.Close()
+		types := []gocv.MatType{gocv.MatTypeCV8UC1, gocv.MatTypeCV8UC2, gocv.MatTypeCV8UC3, gocv.MatTypeCV8UC4}
+		err := img.ConvertToWithParams(&conv, types[channels-1], 1.0/257, 0)
+		if err != nil {
+			return nil, nil, 0, 0, fmt.Errorf("error converting image %s to 8 bits: %w", path, err)
+		}
+		src = conv
+	}
+	data := src.ToBytes()
+	if len(data) != imgW*imgH*channels {
+		if channels == 2 || channels == 4 {
+			return nil, nil, 0, 0, fmt.Errorf("image %s has an alpha channel, but is neither 8-bit nor 16-bit", path)
+		}
+		grayImg := gocv.IMRead(path, gocv.IMReadGrayScale)
+		if grayImg.Empty() {
+			return nil, nil, 0, 0, fmt.Errorf("error loading image %s", path)
+		}
+		defer grayImg.Close()
+		return grayImg.ToBytes(), nil, imgW, imgH, nil
+	}
+	if channels == 1 {
+		return data, nil, imgW, imgH, nil
+	}
+	/*Gray images with alpha are stored as gray and alpha byte pairs, which
+	OpenCV cannot convert, so they are split here.*/
+	if channels == 2 {
+		gray := make([]uint8, imgW*imgH)
+		alpha := make([]uint8, imgW*imgH)
+		for i := range gray {
+			gray[i] = data[i*2]
+			alpha[i] = data[(i*2)+1]
+		}
+		return gray, alpha, imgW, imgH, nil
+	}
+	grayImg := gocv.NewMat()
+	defer grayImg.Close()
+	if channels == 4 {
+		gocv.CvtColor(src, &grayImg, gocv.ColorBGRAToGray)
+	} else {
+		gocv.CvtColor(src, &grayImg, gocv.ColorBGRToGray)
+	}
+	var alpha []uint8
+	if channels == 4 {
+		/*OpenCV stores pixels as BGRA, so every fourth byte is alpha.*/
+		alpha = make([]uint8, imgW*imgH)
+		for i := range alpha {
+			alpha[i] = data[(i*4)+3]
+		}
+	}
+	return grayImg.ToBytes(), alpha, imgW, imgH, nil
+}
+
+/*
+Writes grayscale pixel data to an image. If alpha is not nil, the image
+is written with an alpha channel so that it still composites cleanly.
+*/
+func writeGrayAlpha(path string, imgW int, imgH int, pix_data []uint8, alpha []uint8) error {
+	var matOut gocv.Mat
+	var err error
+	if alpha == nil {
+		matOut, err = gocv.NewMatFromBytes(imgH, imgW, gocv.MatTypeCV8U, pix_data)
+	} else {
+		bgra := make([]uint8, imgW*imgH*4)
+		for i, p := range pix_data {
+			bgra[i*4] = p
+			bgra[(i*4)+1] = p
+			bgra[(i*4)+2] = p
+			bgra[(i*4)+3] = alpha[i]
+		}
+		matOut, err = gocv.NewMatFromBytes(imgH, imgW, gocv.MatTypeCV8UC4, bgra)
+	}
+	if err != nil {
+		return err
+	}
+	defer matOut.Close()
+	if !gocv.IMWrite(path, matOut) {
+		return fmt.Errorf("error writing image %s", path)
+	}
+	return nil
+}
+
+/*
+Reads a mask for a selective trace. If the mask image has an alpha
+channel, the alpha channel is used as the mask. Otherwise, its
+brightness is. White or opaque areas are traced, black or transparent
+areas are copied through untouched, and anything in between is blended.
+*/
+func readMask(path string, imgW int, imgH int) ([]uint8, error) {
+	gray, alpha, maskW, maskH, err := readGrayAlpha(path)
+	if err != nil {
+		return nil, err
+	}
+	if maskW != imgW || maskH != imgH {
+		return nil, fmt.Errorf("mask %s is %dx%d, but the image it masks is %dx%d", path, maskW, maskH, imgW, imgH)
+	}
+	if alpha != nil {
+		return alpha, nil
+	}
+	return gray, nil
+}
+
+/*The kinds of rules which decide which dataset serves a grid in a trace.*/
+const RULE_ALL uint8 = 0
+const RULE_LUMA uint8 = 1
+const RULE_RANGE uint8 = 2
+const RULE_LABEL uint8 = 3
+
+/*
+A rule deciding which grids of a traced image a dataset serves. Grids can
+be chosen by their average luma, by their range (the difference between
+their brightest and darkest pixels, which is high around ink lines and
+other edges), by the value of a label map at their center, or all of
+them. The bounds lo and hi are inclusive, and label rules only use lo.
+*/
+type regionRule struct {
+	kind uint8
+	lo   uint8
+	hi   uint8
+}
+
+/*Parses inclusive bounds written as A-B, each between 0 and 255.*/
+func parseBounds(bounds string) (uint8, uint8, error) {
+	loStr, hiStr, found := strings.Cut(bounds, "-")
+	lo, errLo := strconv.ParseUint(loStr, 10, 8)
+	hi, errHi := strconv.ParseUint(hiStr, 10, 8)
+	if !found || errLo != nil || errHi != nil || lo > hi {
+		return 0, 0, fmt.Errorf("invalid bounds %s", bounds)
+	}
+	return uint8(lo), uint8(hi), nil
+}
+
+/*Parses inclusive bounds on a grid dimension written as A-B, each between 1 and MAX_DIM.*/
+func parseDimBounds(bounds string) (uint16, uint16, error) {
+	loStr, hiStr, found := strings.Cut(bounds, "-")
+	lo, errLo := strconv.ParseUint(loStr, 10, 16)
+	hi, errHi := strconv.ParseUint(hiStr, 10, 16)
+	if !found || errLo != nil || errHi != nil || lo > hi || lo < 1 || hi > MAX_DIM {
+		return 0, 0, fmt.Errorf("invalid dimension bounds %s", bounds)
+	}
+	return uint16(lo), uint16(hi), nil
+}
+
+/*Parses a rule written as all, luma:A-B, range:A-B, or label:N.*/
+func parseRegionRule(rule string) (regionRule, error) {
+	if rule == "all" {
+		return regionRule{kind: RULE_ALL, lo: 0, hi: 255}, nil
+	}
+	kindStr, bounds, found := strings.Cut(rule, ":")
+	if !found {
+		return regionRule{}, fmt.Errorf("invalid region rule %s", rule)
+	}
+	if kindStr == "label" {
+		label, err := strconv.ParseUint(bounds, 10, 8)
+		if err != nil {
+			return regionRule{}, fmt.Errorf("invalid label in region rule %s", rule)
+		}
+		return regionRule{kind: RULE_LABEL, lo: uint8(label), hi: uint8(label)}, nil
+	}
+	r := regionRule{}
+	if kindStr == "luma" {
+		r.kind = RULE_LUMA
+	} else if kindStr == "range" {
+		r.kind = RULE_RANGE
+	} else {
+		return regionRule{}, fmt.Errorf("invalid region rule %s", rule)
+	}
+	lo, hi, err := parseBounds(bounds)
+	if err != nil {
+		return regionRule{}, fmt.Errorf("invalid bounds in region rule %s", rule)
+	}
+	r.lo = lo
+	r.hi = hi
+	return r, nil
+}
+
+/*
+Checks whether a rule chooses a grid whose top-left corner is at x1, y1.
+Label rules always fail without a label map.
+*/
+func (r regionRule) matches(g Grid, x1 int, y1 int, imgW int, labels []uint8) bool {
+	var v uint8
+	switch r.kind {
+	case RULE_ALL:
+		return true
+	case RULE_LUMA:
+		v = g.avgLuma
+	case RULE_RANGE:
+		v = g.maxLuma - g.minLuma
+	case RULE_LABEL:
+		if labels == nil {
+			return false
+		}
+		v = labels[((y1+(int(g.getH())/2))*imgW)+x1+(int(g.getW())/2)]
+	}
+	return v >= r.lo && v <= r.hi
+}
+
+/*
+A dataset that serves the grids of a trace chosen by its rule. The blocks
+of a compressed dataset are decompressed as the trace needs them.
+*/
+type traceSet struct {
+	array  []Grid
+	naphil []uint8
+	blocks *pixelBlocks
+	rule   regionRule
+}
+
+/*
+Resets the metadata of a dataset's grids so that they are sorted by range
+and extremes rather than corners, which is what a trace searches by.
+Datasets written with -k are saved in this order already, so they are
+only sorted if they are not.
+*/
+func prepareForTrace(array []Grid, tNum int) {
+	for i_ := range array {
+		g := array[i_]
+		d := g.dimCornAvg
+		d &= DIM_64 | AVG_64
+		maxL := g.maxLuma
+		minL := g.minLuma
+		d += (uint64(maxL-minL) << 24)
+		d += (uint64(minL) << 16)
+		d += (uint64(maxL) << 8)
+		array[i_].dimCornAvg = d
+	}
+	if !slices.IsSortedFunc(array, func(a, b Grid) int { return cmp.Compare(a.dimCornAvg, b.dimCornAvg) }) {
+		parallelSort(array, tNum)
+	}
+}
+
+/*
+Generates the grid of an image being traced at index i of coordinatedArray,
+from its coordinates and its offset in the naphil array, into which its
+pixels are copied.
+*/
+func populateTraceGrid(coordinatedArray []Grid, i int, ca []uint64, offset int, naphilArrayTrace []uint8, pix_data []uint8, imgW int) {
+	/*Gather the coordinates, calculate dimensions*/
+	x1 := ca[0]
+	x2 := ca[1]
+	y1 := ca[2]
+	y2 := ca[3]
+	gw := int(x2 - x1)
+	gh := int(y2 - y1)
+	area := gw * gh
+
+	/*Place the proper data into the naphil array*/
+	populateNaphil(naphilArrayTrace, pix_data, x1, x2, y1, y2, offset, uint64(imgW))
+
+	/*Get the minimum, maximum, and sum of the pixels in the grid*/
+	sum := uint64(0)
+	j := offset
+	end := offset + area
+	maxLuma := slices.Max(naphilArrayTrace[offset:end])
+	minLuma := slices.Min(naphilArrayTrace[offset:end])
+	for j < end {
+		sum += uint64(naphilArrayTrace[j])
+		j++
+	}
+
+	dimCornAvg := uint64(0)
+	dimCornAvg += uint64(gw)
+	dimCornAvg <<= 11
+	dimCornAvg += uint64(gh)
+	dimCornAvg <<= 8
+	dimCornAvg += (sum / uint64(area))
+	dimCornAvg <<= 8
+	dimCornAvg += uint64(maxLuma - minLuma)
+	dimCornAvg <<= 8
+	dimCornAvg += uint64(maxLuma)
+	dimCornAvg <<= 16
+	coordinatedArray[i] = Grid{
+		w__:        uint16(gw),
+		h__:        uint16(gh),
+		avgLuma:    uint8(sum / uint64(area)),
+		minLuma:    minLuma,
+		maxLuma:    maxLuma,
+		dimCornAvg: dimCornAvg,
+		coord:      packCoord(int(x1), int(y1)),
+		offset:     offset,
+	}
+}
+
+/*
+A span of grids with the same dimensions in an image being traced, and
+the block of grids with those dimensions in the dataset matched against.
+*/
+type traceSpan struct {
+	start, end         int
+	dataStart, dataEnd int
+}
+
+/*What became of a grid of an image being traced.*/
+const (
+	TRACE_COPIED        uint8 = 0
+	TRACE_MATCHED       uint8 = 1
+	TRACE_NO_CANDIDATES uint8 = 2
+	TRACE_CEILING       uint8 = 3
+)
+
+/*
+How closely a trace matched an image. For every grid of the image, in
+the order lumaTrace sorts them, the mean difference per pixel between it
+and the grid it was replaced with, and what became of it: copied through
+untouched, matched, copied through because the dataset serving it had no
+grids of the same dimensions, or replaced with a poor guess because none
+of them came under the ceiling of 255 per pixel. Grids without candidates
+and poor guesses are given the greatest difference of 255.
+*/
+type traceQuality struct {
+	grids  []Grid
+	errors []float64
+	status []uint8
+}
 
+/*
+Traces over an image. Each grid of the image is served by the first
+dataset in sets whose rule chooses it, and grids no dataset chooses are
+copied through untouched. If mask is not nil, only the parts of the image
+covered by the mask are traced. Grids entirely outside of it are copied
+from the original image, and grids straddling its edge are blended. If
+alpha is not nil, grids which are entirely transparent are skipped. The
+label map is only needed by label rules, and may be nil otherwise. If
+quality is not nil, it is filled in with how closely each grid was
+matched. The grids are generated and matched by tNum threads, each taking
+part of a block of grids with the same dimensions at a time. The blocks
+of compressed datasets holding grids of those dimensions are
+decompressed first, and an error is returned if any are corrupt. If
+onProgress is not nil, it is given the share of grids matched so far as
+each span of them is finished, possibly out of order.
+*/
+func lumaTrace(imgW int, imgH int, pix_data []uint8, sets []traceSet, t *Tree, mask []uint8, alpha []uint8, labels []uint8, quality *traceQuality, tNum int, onProgress func(float64)) ([]uint8, error) {
 	/*Initialize array to store the output data*/
 	pix_data_out := make([]uint8, imgW*imgH)
 
@@ -1594,17 +1854,8 @@ func lumaTrace(imgW int, imgH int, pix_data []uint8, array []Grid, arrayLen int,
 
 	i_ := 0
 
-	var startTemp int64
-	if tellTime {
-		startTemp = time.Now().Unix()
-	}
-
 	/*Populate the index array*/
 	for i_ < l {
-		if tellTime && time.Now().Unix() > startTemp {
-			fmt.Printf("Setting index values	%f%%\n", 100.0*float64(i_)/float64(l))
-			startTemp = time.Now().Unix()
-		}
 		area := int(coordArray[i_][1]-coordArray[i_][0]) * int(coordArray[i_][3]-coordArray[i_][2])
 		a := i_ + 1
 		b := l
@@ -1633,78 +1884,24 @@ func lumaTrace(imgW int, imgH int, pix_data []uint8, array []Grid, arrayLen int,
 	/*Array of grids from the iamge*/
 	coordinatedArray := make([]Grid, l)
 
-	if tellTime {
-		startTemp = time.Now().Unix()
-	}
-	/*Populate the grid array*/
-	for i := range l {
-		if tellTime && time.Now().Unix() > startTemp {
-			fmt.Printf("Generating grids in traced image	%f%%\n", 100.0*float64(i_)/float64(l))
-			startTemp = time.Now().Unix()
-		}
-
-		/*Gather the coordinates, calculate dimensions*/
-		ca := coordArray[i]
-		x1 := ca[0]
-		x2 := ca[1]
-		y1 := ca[2]
-		y2 := ca[3]
-		gw := int(x2 - x1)
-		gh := int(y2 - y1)
-		area := gw * gh
-
-		/*Get offset data*/
-		offset := indexArray[i]
-
-		/*Place the proper data into the naphil array*/
-		populateNaphil(naphilArrayTrace, pix_data, x1, x2, y1, y2, offset, uint64(imgW))
-
-		/*Get the minimum, maximum, and sum of the pixels in the grid*/
-		sum := uint64(0)
-		j := offset
-		end := offset + area
-		maxLuma := slices.Max(naphilArrayTrace[offset:end])
-		minLuma := slices.Min(naphilArrayTrace[offset:end])
-		for j < end {
-			sum += uint64(naphilArrayTrace[j])
-			j++
+	/*Populate the grid array, a chunk of grids at a time*/
+	progress := newProgressLog(LOG_VERBOSE, "trace_grid_generation", "Generating grids in traced image", l)
+	chunk, chunks := chunkSize(l, tNum, 1024)
+	workerPool(chunks, tNum, func(c int) {
+		for i := c * chunk; i < min(l, (c+1)*chunk); i++ {
+			populateTraceGrid(coordinatedArray, i, coordArray[i], indexArray[i], naphilArrayTrace, pix_data, imgW)
 		}
-
-		dimCornAvg := uint64(0)
-		dimCornAvg += uint64(gw)
-		dimCornAvg <<= 8
-		dimCornAvg += uint64(gh)
-		dimCornAvg <<= 8
-		dimCornAvg += (sum / uint64(area))
-		dimCornAvg <<= 8
-		dimCornAvg += uint64(maxLuma - minLuma)
-		dimCornAvg <<= 8
-		dimCornAvg += uint64(maxLuma)
-		dimCornAvg <<= 16
-		coordinatedArray[i] = Grid{
-			w__:        uint8(gw),
-			h__:        uint8(gh),
-			avgLuma:    uint8(sum / uint64(area)),
-			minLuma:    minLuma,
-			maxLuma:    maxLuma,
-			dimCornAvg: dimCornAvg,
-			coord:      (uint64(y1) << 13) + uint64(x1),
-			offset:     offset,
-		}
-	}
+		progress.add(min(l, (c+1)*chunk) - c*chunk)
+	})
+	progress.finish(l)
 
 	/*Sort the grids*/
 	i_ = 0
 
-	if tellTime {
-		startTemp = time.Now().Unix()
-	}
+	/*Each block of grids with the same dimensions is sorted on its own*/
+	progress = newProgressLog(LOG_VERBOSE, "trace_sorting", "Sorting grids in traced image", l)
+	var blocks [][2]int
 	for i_ < l {
-		if tellTime && time.Now().Unix() > startTemp {
-			fmt.Printf("Sorting grids	%f%%\n", 100.0*float64(i_)/float64(l))
-			startTemp = time.Now().Unix()
-		}
-
 		a := i_ + 1
 		b := l
 		for a < b {
@@ -1715,329 +1912,902 @@ func lumaTrace(imgW int, imgH int, pix_data []uint8, array []Grid, arrayLen int,
 				b = m
 			}
 		}
-		sort.Slice(coordinatedArray[i_:a], func(i, j int) bool {
-			return coordinatedArray[i_+i].dimCornAvg < coordinatedArray[i_+j].dimCornAvg
-		})
+		blocks = append(blocks, [2]int{i_, a})
 		i_ = a
 	}
+	workerPool(len(blocks), tNum, func(k int) {
+		block := coordinatedArray[blocks[k][0]:blocks[k][1]]
+		sort.Slice(block, func(i, j int) bool {
+			return block[i].dimCornAvg < block[j].dimCornAvg
+		})
+		progress.add(len(block))
+	})
+	progress.finish(l)
 
-	dim_cursor := 0
-	dim_start_data := 0
-
-	var gridLoopTime int64
-	if tellTime {
-		gridLoopTime = time.Now().Unix()
+	if quality != nil {
+		quality.grids = coordinatedArray
+		quality.errors = make([]float64, l)
+		quality.status = make([]uint8, l)
 	}
-	/*Start the trace, grid-by-grids*/
-	for dim_cursor < l {
-		/*Dimensions of the grid at the current cursor*/
-		gw := coordinatedArray[dim_cursor].getW()
-		gh := coordinatedArray[dim_cursor].getH()
-		area := int(gw) * int(gh)
-		area_32 := uint32(area)
 
-		/*The last grid with the same dimensions*/
-		a := dim_cursor
-		b := l
-		if tellTime {
-			startTemp = time.Now().Unix()
-		}
-		for a < b {
-			if tellTime && time.Now().Unix() > startTemp {
-				fmt.Printf("Setting boundaries based on dimensions	%f%%\n", 100.0*float64(l-(a*b))/float64(l))
-				startTemp = time.Now().Unix()
+	/*Decide which dataset serves each grid. Grids no dataset will serve
+	are copied through untouched.*/
+	selection := make([]int, l)
+	for i := range l {
+		g := coordinatedArray[i]
+		x1 := g.getX()
+		y1 := g.getY()
+		selection[i] = -1
+		for d := range sets {
+			if sets[d].rule.matches(g, x1, y1, imgW, labels) {
+				selection[i] = d
+				break
 			}
-			m := a + ((b - a) / 2)
-			if coordinatedArray[m].getW() == gw && coordinatedArray[m].getH() == gh {
-				a = m + 1
-			} else {
-				b = m
+		}
+		if selection[i] == -1 {
+			x2 := x1 + int(g.getW())
+			y2 := y1 + int(g.getH())
+			for y := y1; y < y2; y++ {
+				copy(pix_data_out[(y*imgW)+x1:(y*imgW)+x2], pix_data[(y*imgW)+x1:(y*imgW)+x2])
 			}
 		}
-		dim_end := a
+	}
 
-		/*The last grid with the same dimensions from the dataset*/
-		a = dim_start_data
-		b = arrayLen
-		if tellTime {
-			startTemp = time.Now().Unix()
-		}
-		for a < b {
-			if tellTime && time.Now().Unix() > startTemp {
-				fmt.Printf("Setting boundaries based on dimensions	%f%%\n", 100.0*float64(arrayLen-(a*b))/float64(arrayLen))
-				startTemp = time.Now().Unix()
-			}
-			m := a + ((b - a) / 2)
-			if array[m].getW() == gw && array[m].getH() == gh {
-				a = m + 1
-			} else {
-				b = m
-			}
+	/*Trace against each dataset in turn. The blocks of grids with the same
+	dimensions are split into spans, which are matched grid-by-grid by
+	different threads.*/
+	piece, _ := chunkSize(l, tNum, 256)
+	progress = newProgressLog(LOG_VERBOSE, "trace_matching", "Matching grids", l*len(sets))
+	var matched atomic.Int64
+	for d := range sets {
+		array := sets[d].array
+		arrayLen := len(array)
+		naphilArrayIn := sets[d].naphil
+
+		/*The most and least preferred priorities among the grids*/
+		maxPriority := uint8(0)
+		minPriority := uint8(255)
+		for _, g := range array {
+			maxPriority = max(maxPriority, g.priority)
+			minPriority = min(minPriority, g.priority)
 		}
-		dim_end_data := a
+		dim_cursor := 0
+		var spans []traceSpan
 
-		i := dim_cursor
-		for i < dim_end {
-			if tellTime && time.Now().Unix() > gridLoopTime+10 {
-				fmt.Printf("Matching grids	%f%%\n", 100.0*float64(i)/float64(l))
-				gridLoopTime = time.Now().Unix()
-			}
-			/*Getting the offset of the grid and its pixels*/
-			g := coordinatedArray[i]
-			g_offset := g.offset
-			g_offset_end := g_offset + area
-			g_min := g.minLuma
-			g_max := g.maxLuma
+		for dim_cursor < l {
+			/*Dimensions of the grid at the current cursor*/
+			gw := coordinatedArray[dim_cursor].getW()
+			gh := coordinatedArray[dim_cursor].getH()
 
-			/*The first and last grids in the dataset with
-			identical metadata (if any)*/
-			a := dim_start_data
-			b := dim_end_data
-			var start, end int
+			/*The last grid with the same dimensions*/
+			a := dim_cursor
+			b := l
 			for a < b {
 				m := a + ((b - a) / 2)
-				if array[m].dimCornAvg < g.dimCornAvg {
+				if coordinatedArray[m].getW() == gw && coordinatedArray[m].getH() == gh {
 					a = m + 1
 				} else {
 					b = m
 				}
 			}
-			start = a
-			b = dim_end_data
+			dim_end := a
+
+			/*The first and last grids with the same dimensions from the
+			dataset, searched for over all of it, since the image and the
+			dataset need not have the same dimensions.*/
+			a = 0
+			b = arrayLen
 			for a < b {
 				m := a + ((b - a) / 2)
-				if array[m].dimCornAvg > g.dimCornAvg {
-					b = m
+				if array[m].getW() < gw || (array[m].getW() == gw && array[m].getH() < gh) {
+					a = m + 1
 				} else {
+					b = m
+				}
+			}
+			dim_start_data := a
+			b = arrayLen
+			for a < b {
+				m := a + ((b - a) / 2)
+				if array[m].getW() == gw && array[m].getH() == gh {
 					a = m + 1
+				} else {
+					b = m
 				}
 			}
-			end = a
+			dim_end_data := a
 
-			var minDiff_8, g_avg uint8
-			var minDiffC int
-			var p Grid
-			j := start
+			for i := dim_cursor; i < dim_end; i += piece {
+				spans = append(spans, traceSpan{start: i, end: min(i+piece, dim_end), dataStart: dim_start_data, dataEnd: dim_end_data})
+			}
+			dim_cursor = dim_end
+		}
 
-			/*If there are data grids with identical metadata to the
-			trace grid, compare them.*/
-			minDiff_32 := 255 * area_32
-			if start != end {
-				for j < end {
-					if tellTime && time.Now().Unix() > startTemp {
-						fmt.Printf("Looking for best match among similar grids	%f%%\n", 100.0*float64(j-start)/float64(end-start))
-						startTemp = time.Now().Unix()
+		loadErrs := make([]error, len(spans))
+		workerPool(len(spans), tNum, func(k int) {
+			span := spans[k]
+			dim_start_data, dim_end_data := span.dataStart, span.dataEnd
+			loadErrs[k] = sets[d].blocks.loadGrids(array[dim_start_data:dim_end_data])
+			if loadErrs[k] != nil {
+				return
+			}
+			gw := coordinatedArray[span.start].getW()
+			gh := coordinatedArray[span.start].getH()
+			area := int(gw) * int(gh)
+			area_32 := uint32(area)
+			for i := span.start; i < span.end; i++ {
+				/*Grids served by other datasets are skipped*/
+				if selection[i] != d {
+					continue
+				}
+				/*Getting the offset of the grid and its pixels*/
+				g := coordinatedArray[i]
+				g_offset := g.offset
+				g_offset_end := g_offset + area
+				g_min := g.minLuma
+				g_max := g.maxLuma
+
+				w_signed := int(gw)
+
+				x1 := g.getX()
+				x2 := x1 + w_signed
+				y1 := g.getY()
+				y2 := y1 + int(gh)
+
+				/*Grids outside of the mask are copied as they are, without
+				searching for a match.*/
+				coverage := uint8(2)
+				if mask != nil {
+					coverage = maskCoverage(mask, imgW, x1, x2, y1, y2)
+				}
+				/*Fully transparent grids are not worth texturing.*/
+				if coverage != 0 && alpha != nil && maskCoverage(alpha, imgW, x1, x2, y1, y2) == 0 {
+					coverage = 0
+				}
+				/*Grids the dataset has no grids of the same dimensions for
+				are copied through too, rather than replaced with a grid of
+				another size.*/
+				if coverage != 0 && dim_start_data == dim_end_data {
+					if quality != nil {
+						quality.status[i], quality.errors[i] = TRACE_NO_CANDIDATES, 255
 					}
-					p = array[j]
-					diffTemp := gridDiffNaphil(p, minDiff_32, naphilArrayIn, naphilArrayTrace, area, g_min, g_max, g_offset, g_offset_end)
-					if diffTemp < minDiff_32 {
-						minDiff_32 = diffTemp
-						minDiffC = j
-						if minDiff_32 == 0 {
-							break
-						}
+					coverage = 0
+				}
+				if coverage == 0 {
+					for y := y1; y < y2; y++ {
+						copy(pix_data_out[(y*imgW)+x1:(y*imgW)+x2], pix_data[(y*imgW)+x1:(y*imgW)+x2])
 					}
-					j++
-				}
-			}
-			g_avg = g.avgLuma
-			minDiff_8 = uint8(minDiff_32 / area_32)
-			var avg_end, avg_start int
-			var diffTemp_32 uint32
-			/*If there are data grids with larger ranges but are
-			still potentially similar to the trace grids, compare them.*/
-			if end < dim_end_data {
-				/*Check for the last of these.*/
-				if minDiff_8 != 255 && g_avg < 255-minDiff_8 {
-					a = end
-					b = dim_end_data
-					for a < b {
-						m := a + ((b - a) / 2)
-						if array[m].avgLuma > g_avg+minDiff_8 {
-							b = m
-						} else {
-							a = m + 1
+					continue
+				}
+
+				/*The first and last grids in the dataset with
+				identical metadata (if any)*/
+				a := dim_start_data
+				b := dim_end_data
+				var start, end int
+				for a < b {
+					m := a + ((b - a) / 2)
+					if array[m].dimCornAvg < g.dimCornAvg {
+						a = m + 1
+					} else {
+						b = m
+					}
+				}
+				start = a
+				b = dim_end_data
+				for a < b {
+					m := a + ((b - a) / 2)
+					if array[m].dimCornAvg > g.dimCornAvg {
+						b = m
+					} else {
+						a = m + 1
+					}
+				}
+				end = a
+
+				/*Should no grid come under the ceiling, the first grid
+				with the same dimensions is used.*/
+				var minDiff_8, g_avg uint8
+				minDiffC := dim_start_data
+				var p Grid
+				j := start
+
+				/*If there are data grids with identical metadata to the
+				trace grid, compare them. Grids from less preferred sources
+				have a penalty added to their difference, which can push the
+				total difference past what is possible for a single source.*/
+				var penalty uint32
+				ceiling := (255 + uint32(maxPriority-minPriority)) * area_32
+				minDiff_32 := ceiling
+				if start != end {
+					for j < end {
+						p = array[j]
+						penalty = uint32(maxPriority-p.priority) * area_32
+						if penalty >= minDiff_32 {
+							j++
+							continue
+						}
+						diffTemp := gridDiffNaphil(p, minDiff_32-penalty, naphilArrayIn, naphilArrayTrace, area, g_min, g_max, g_offset, g_offset_end)
+						if diffTemp < minDiff_32-penalty {
+							minDiff_32 = diffTemp + penalty
+							minDiffC = j
+							if minDiff_32 == 0 {
+								break
+							}
 						}
+						j++
 					}
-					avg_end = a
-				} else {
-					avg_end = dim_end_data
 				}
-				j = end
-				for j < avg_end {
-					if tellTime && time.Now().Unix() > startTemp {
-						fmt.Printf("Looking for best match among similar grids with higher chromatic diversity	%f%%\n", 100.0*float64(j-end)/float64(avg_end-end))
-						startTemp = time.Now().Unix()
+				g_avg = g.avgLuma
+				minDiff_8 = uint8(min(minDiff_32/area_32, 255))
+				var avg_end, avg_start int
+				var diffTemp_32 uint32
+				/*If there are data grids with larger ranges but are
+				still potentially similar to the trace grids, compare them.*/
+				if end < dim_end_data {
+					/*Check for the last of these.*/
+					if minDiff_8 != 255 && g_avg < 255-minDiff_8 {
+						a = end
+						b = dim_end_data
+						for a < b {
+							m := a + ((b - a) / 2)
+							if array[m].avgLuma > g_avg+minDiff_8 {
+								b = m
+							} else {
+								a = m + 1
+							}
+						}
+						avg_end = a
+					} else {
+						avg_end = dim_end_data
 					}
-					p = array[j]
-					diffTemp_32 = gridDiffNaphil(p, minDiff_32, naphilArrayIn, naphilArrayTrace, area, g_min, g_max, g_offset, g_offset_end)
-					/*Every time a more similar grid is found, restrict the search.*/
-					if diffTemp_32 < minDiff_32 {
-						minDiff_32 = diffTemp_32
-						minDiffC = j
-						tempDiff := uint8(minDiff_32 / area_32)
-						if tempDiff < minDiff_8 {
-							minDiff_8 = tempDiff
-							if g_avg < 255-minDiff_8 && j+1 < avg_end {
-								a = j + 1
-								b = avg_end
-								for a < b {
-									m := a + ((b - a) / 2)
-									if array[m].avgLuma >= g_avg+minDiff_8 {
-										b = m
-									} else {
-										a = m + 1
+					j = end
+					for j < avg_end {
+						p = array[j]
+						penalty = uint32(maxPriority-p.priority) * area_32
+						diffTemp_32 = math.MaxUint32
+						if penalty < minDiff_32 {
+							diffTemp_32 = gridDiffNaphil(p, minDiff_32-penalty, naphilArrayIn, naphilArrayTrace, area, g_min, g_max, g_offset, g_offset_end)
+						}
+						/*Every time a more similar grid is found, restrict the search.*/
+						if penalty < minDiff_32 && diffTemp_32 < minDiff_32-penalty {
+							minDiff_32 = diffTemp_32 + penalty
+							minDiffC = j
+							tempDiff := uint8(min(minDiff_32/area_32, 255))
+							if tempDiff < minDiff_8 {
+								minDiff_8 = tempDiff
+								if g_avg < 255-minDiff_8 && j+1 < avg_end {
+									a = j + 1
+									b = avg_end
+									for a < b {
+										m := a + ((b - a) / 2)
+										if array[m].avgLuma >= g_avg+minDiff_8 {
+											b = m
+										} else {
+											a = m + 1
+										}
 									}
+									avg_end = a
 								}
-								avg_end = a
 							}
 						}
-					}
-					j++
+						j++
 
-				}
-			}
-			/*Peform similarly for grids with lower ranges*/
-			if start > dim_start_data {
-				if minDiff_8 != 255 && g_avg > minDiff_8 {
-					a = dim_start_data
-					b = start
-					for a < b {
-						m := a + ((b - a) / 2)
-						if array[m].avgLuma >= g_avg-minDiff_8 {
-							b = m
-						} else {
-							a = m + 1
-						}
 					}
-					avg_start = a
-				} else {
-					avg_start = dim_start_data
 				}
-				j = start - 1
-				for j >= avg_start {
-					if tellTime && time.Now().Unix() > startTemp {
-						fmt.Printf("Looking for best match among similar grids with higher chromatic diversity	%f%%\n", 100.0*float64(j-end)/float64(avg_end-end))
-						startTemp = time.Now().Unix()
+				/*Peform similarly for grids with lower ranges*/
+				if start > dim_start_data {
+					if minDiff_8 != 255 && g_avg > minDiff_8 {
+						a = dim_start_data
+						b = start
+						for a < b {
+							m := a + ((b - a) / 2)
+							if array[m].avgLuma >= g_avg-minDiff_8 {
+								b = m
+							} else {
+								a = m + 1
+							}
+						}
+						avg_start = a
+					} else {
+						avg_start = dim_start_data
 					}
-					p = array[j]
-					diffTemp_32 = gridDiffNaphil(p, minDiff_32, naphilArrayIn, naphilArrayTrace, area, g_min, g_max, g_offset, g_offset_end)
-
-					if diffTemp_32 < minDiff_32 {
-						minDiff_32 = diffTemp_32
-						minDiffC = j
-						tempDiff := uint8(minDiff_32 / area_32)
-						if tempDiff < minDiff_8 {
-							minDiff_8 = tempDiff
-							if g_avg > minDiff_8 && j-1 > avg_start {
-								a = avg_start
-								b = j - 1
-								for a < b {
-									m := a + ((b - a) / 2)
-									if array[m].avgLuma >= g_avg-minDiff_8 {
-										b = m
-									} else {
-										a = m + 1
+					j = start - 1
+					for j >= avg_start {
+						p = array[j]
+						penalty = uint32(maxPriority-p.priority) * area_32
+						diffTemp_32 = math.MaxUint32
+						if penalty < minDiff_32 {
+							diffTemp_32 = gridDiffNaphil(p, minDiff_32-penalty, naphilArrayIn, naphilArrayTrace, area, g_min, g_max, g_offset, g_offset_end)
+						}
+
+						if penalty < minDiff_32 && diffTemp_32 < minDiff_32-penalty {
+							minDiff_32 = diffTemp_32 + penalty
+							minDiffC = j
+							tempDiff := uint8(min(minDiff_32/area_32, 255))
+							if tempDiff < minDiff_8 {
+								minDiff_8 = tempDiff
+								if g_avg > minDiff_8 && j-1 > avg_start {
+									a = avg_start
+									b = j - 1
+									for a < b {
+										m := a + ((b - a) / 2)
+										if array[m].avgLuma >= g_avg-minDiff_8 {
+											b = m
+										} else {
+											a = m + 1
+										}
 									}
+									avg_end = a
 								}
-								avg_end = a
 							}
 						}
+						j--
+
+					}
+				}
+
+				/*Record how close the match was, without the penalty for
+				its source.*/
+				if quality != nil {
+					if minDiff_32 == ceiling {
+						quality.status[i], quality.errors[i] = TRACE_CEILING, 255
+					} else {
+						penalty = uint32(maxPriority-array[minDiffC].priority) * area_32
+						quality.status[i], quality.errors[i] = TRACE_MATCHED, float64(minDiff_32-penalty)/float64(area)
 					}
-					j--
+				}
 
+				kOffset := array[minDiffC].offset
+
+				y := y1
+				y_offset := 0
+				/*Trace this grid's segment of the image.*/
+				for y < y2 {
+					offset_n := kOffset + (y_offset * w_signed)
+					offset_p := (y * imgW)
+					end := offset_p + x2
+					offset_p += x1
+					if offset_n >= len(naphilArrayIn) || offset_n+w_signed > len(naphilArrayIn) {
+						panic("Out of bounds")
+					}
+					seq := naphilArrayIn[offset_n : offset_n+w_signed]
+					if offset_p >= len(pix_data_out) || end > len(pix_data_out) {
+						panic("Out of bounds")
+					}
+					if coverage == 2 {
+						copy(pix_data_out[offset_p:end], seq)
+					} else {
+						blendRow(pix_data_out[offset_p:end], seq, pix_data[offset_p:end], mask[offset_p:end])
+					}
+					y++
+					y_offset++
 				}
 			}
+			progress.add(span.end - span.start)
+			if onProgress != nil {
+				onProgress(float64(matched.Add(int64(span.end-span.start))) / float64(l*len(sets)))
+			}
+		})
+		for _, err := range loadErrs {
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	progress.finish(l)
+
+	return pix_data_out, nil
+}
 
-			w_signed := int(gw)
+/*
+How closely the grids of one band of average luma in a traced image were
+matched: how many were traced and how many pixels they cover, the mean
+and 90th percentile of their differences per pixel, and how many were
+poor guesses for want of candidates or under the ceiling.
+*/
+type traceBand struct {
+	AvgMin       int     `json:"avgMin"`
+	AvgMax       int     `json:"avgMax"`
+	Grids        int     `json:"grids"`
+	Pixels       int     `json:"pixels"`
+	Mean         float64 `json:"mean"`
+	P90          float64 `json:"p90"`
+	NoCandidates int     `json:"noCandidates"`
+	Ceiling      int     `json:"ceiling"`
+}
 
-			x1 := int(g.coord & 8191)
-			x2 := x1 + w_signed
-			y1 := int((g.coord >> 13) & 8191)
-			y2 := y1 + int(gh)
+/*
+How closely a traced image was matched, from its traceQuality. The mean
+and percentiles are of the differences per pixel of the grids traced,
+counting each grid by its pixels, so that they describe the image rather
+than its partition.
+*/
+type traceStats struct {
+	Image        string      `json:"image"`
+	Output       string      `json:"output"`
+	Grids        int         `json:"grids"`
+	Traced       int         `json:"traced"`
+	Mean         float64     `json:"mean"`
+	P50          float64     `json:"p50"`
+	P90          float64     `json:"p90"`
+	P99          float64     `json:"p99"`
+	Max          float64     `json:"max"`
+	NoCandidates int         `json:"noCandidates"`
+	Ceiling      int         `json:"ceiling"`
+	Bands        []traceBand `json:"bands"`
+}
 
-			kOffset := array[minDiffC].offset
+/*The difference of a traced grid, and how many pixels it covers.*/
+type errorSample struct {
+	err    float64
+	pixels int
+}
 
-			y := y1
-			y_offset := 0
-			if tellTime {
-				startTemp = math.MaxInt64
-			}
-			/*Trace this grid's segment of the image.*/
-			for y < y2 {
-				if tellTime && time.Now().Unix() > startTemp {
-					fmt.Printf("Populating the output pixel data	%f%%\n", 100.0*float64(y-y1)/float64(y2-y1))
-					startTemp = time.Now().Unix()
-				}
-				offset_n := kOffset + (y_offset * w_signed)
-				offset_p := (y * imgW)
-				end := offset_p + x2
-				offset_p += x1
-				if offset_n >= len(naphilArrayIn) || offset_n+w_signed > len(naphilArrayIn) {
-					panic("Out of bounds")
-				}
-				seq := naphilArrayIn[offset_n : offset_n+w_signed]
-				if offset_p >= len(pix_data_out) || end > len(pix_data_out) {
-					panic("Out of bounds")
-				}
-				copy(pix_data_out[offset_p:end], seq)
-				y++
-				y_offset++
+/*
+Finds the mean of the differences of a set of grids, and the differences
+below which each fraction of their pixels fall. The samples are sorted
+in place.
+*/
+func errorPercentiles(samples []errorSample, fractions ...float64) (float64, []float64) {
+	slices.SortFunc(samples, func(a, b errorSample) int {
+		return cmp.Compare(a.err, b.err)
+	})
+	total := 0
+	sum := 0.0
+	for _, e := range samples {
+		total += e.pixels
+		sum += e.err * float64(e.pixels)
+	}
+	out := make([]float64, len(fractions))
+	if total == 0 {
+		return 0, out
+	}
+	for k, f := range fractions {
+		seen := 0
+		for _, e := range samples {
+			seen += e.pixels
+			if float64(seen) >= f*float64(total) {
+				out[k] = e.err
+				break
 			}
+		}
+	}
+	return sum / float64(total), out
+}
 
-			i++
+/*
+Summarizes how closely a trace matched an image, overall and by bands of
+average luma of the traced grids, which shows the tones the datasets are
+short of.
+*/
+func traceErrorStats(quality *traceQuality) traceStats {
+	stats := traceStats{Grids: len(quality.grids), Bands: make([]traceBand, 0)}
+	var samples []errorSample
+	bandSamples := make([][]errorSample, 256/COMPARE_BAND)
+	bands := make([]traceBand, 256/COMPARE_BAND)
+	for i, g := range quality.grids {
+		status := quality.status[i]
+		if status == TRACE_COPIED {
+			continue
+		}
+		e := errorSample{err: quality.errors[i], pixels: int(g.getW()) * int(g.getH())}
+		k := int(g.avgLuma) / COMPARE_BAND
+		samples = append(samples, e)
+		bandSamples[k] = append(bandSamples[k], e)
+		stats.Traced++
+		bands[k].Grids++
+		bands[k].Pixels += e.pixels
+		if status == TRACE_NO_CANDIDATES {
+			stats.NoCandidates++
+			bands[k].NoCandidates++
+		} else if status == TRACE_CEILING {
+			stats.Ceiling++
+			bands[k].Ceiling++
+		}
+	}
+	var p []float64
+	stats.Mean, p = errorPercentiles(samples, 0.5, 0.9, 0.99, 1)
+	stats.P50, stats.P90, stats.P99, stats.Max = p[0], p[1], p[2], p[3]
+	for k := range bands {
+		if bands[k].Grids == 0 {
+			continue
+		}
+		bands[k].AvgMin = k * COMPARE_BAND
+		bands[k].AvgMax = ((k + 1) * COMPARE_BAND) - 1
+		bands[k].Mean, p = errorPercentiles(bandSamples[k], 0.9)
+		bands[k].P90 = p[0]
+		stats.Bands = append(stats.Bands, bands[k])
+	}
+	return stats
+}
+
+/*
+The difference per pixel shown as the hottest colour of a heatmap. Grids
+at least this far from their matches are all shown as red.
+*/
+const HEATMAP_MAX_ERROR = 64
+
+/*
+Writes a heatmap of how closely each grid of a traced image was matched,
+running from blue for exact matches through green and yellow to red.
+Grids the datasets had no candidates for are magenta, and grids copied
+through untouched are transparent, so the heatmap should be written to a
+format with an alpha channel such as PNG.
+*/
+func writeHeatmap(path string, imgW int, imgH int, quality *traceQuality) error {
+	bgra := make([]uint8, imgW*imgH*4)
+	for i, g := range quality.grids {
+		var b, gr, r uint8
+		switch quality.status[i] {
+		case TRACE_COPIED:
+			continue
+		case TRACE_NO_CANDIDATES:
+			b, gr, r = 255, 0, 255
+		default:
+			/*Four steps, from blue to cyan, green, yellow and red.*/
+			v := min(quality.errors[i]/HEATMAP_MAX_ERROR, 1) * 4
+			step := uint8(min(255, (v-math.Floor(v))*256))
+			switch {
+			case v >= 4:
+				r = 255
+			case v >= 3:
+				gr, r = 255-step, 255
+			case v >= 2:
+				gr, r = 255, step
+			case v >= 1:
+				b, gr = 255-step, 255
+			default:
+				b, gr = 255, step
+			}
+		}
+		x1, y1 := g.getX(), g.getY()
+		for y := y1; y < y1+int(g.getH()); y++ {
+			for x := x1; x < x1+int(g.getW()); x++ {
+				j := ((y * imgW) + x) * 4
+				bgra[j], bgra[j+1], bgra[j+2], bgra[j+3] = b, gr, r, 255
+			}
 		}
-		dim_cursor = dim_end
-		dim_start_data = dim_end_data
 	}
+	matOut, err := gocv.NewMatFromBytes(imgH, imgW, gocv.MatTypeCV8UC4, bgra)
+	if err != nil {
+		return err
+	}
+	defer matOut.Close()
+	if !gocv.IMWrite(path, matOut) {
+		return fmt.Errorf("error writing image %s", path)
+	}
+	return nil
+}
 
-	return pix_data_out
+/*
+How to trace an image with traceFile: the minimum and maximum widths and
+heights of its grids, the paths of its mask and label map, which are
+empty if it has none, and the number of threads tracing it. If heatmap
+is not empty, a heatmap of how closely the image was matched is written
+there, and if stats is not nil, it is filled in with a summary of the
+same.
+*/
+type traceOptions struct {
+	minW, maxW uint64
+	minH, maxH uint64
+	mask       string
+	labels     string
+	threads    int
+	heatmap    string
+	stats      *traceStats
 }
 
-/*Read a grid array from a file.*/
-func readFromFile(fName string) ([]Grid, []uint8, error) {
-	var maxLuma, minLuma uint8
-	f, err := os.Open(fName)
-	if nil != err {
-		fmt.Println(err)
-		return nil, nil, err
+/*
+Traces the image at inPath with the given datasets and writes the result
+to outPath, keeping the alpha channel of the image if it has one. If
+progress is not nil, it is called with the share of grids matched as the
+trace goes, and with 1 once the output is written.
+*/
+func traceFile(inPath string, outPath string, sets []traceSet, opts traceOptions, progress func(float64)) error {
+	if progress == nil {
+		progress = func(float64) {}
 	}
-	defer f.Close()
+	pix_data, alpha, w, h, err := readGrayAlpha(inPath)
+	if err != nil {
+		return err
+	}
+	t := generateTree(0, uint64(w), 0, uint64(h), opts.minW, opts.maxW, opts.minH, opts.maxH, randomUint64(), randomUint64())
 
-	fStat, err := f.Stat()
+	/*Read the mask and label map for this image, if there are any*/
+	var mask, labels []uint8
+	if opts.mask != "" {
+		mask, err = readMask(opts.mask, w, h)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.labels != "" {
+		labels, _, _, _, err = readGrayAlpha(opts.labels)
+		if err == nil && len(labels) != w*h {
+			err = fmt.Errorf("label map %s does not match the dimensions of %s", opts.labels, inPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var quality *traceQuality
+	if opts.heatmap != "" || opts.stats != nil {
+		quality = &traceQuality{}
+	}
+	pix_data_out, err := lumaTrace(w, h, pix_data, sets, t, mask, alpha, labels, quality, max(1, opts.threads), progress)
 	if err != nil {
-		panic("Error getting statistical information of file")
+		return err
 	}
-	fileSize := fStat.Size()
 
-	reader := bufio.NewReader(f)
+	err = writeGrayAlpha(outPath, w, h, pix_data_out, alpha)
+	if err != nil {
+		return err
+	}
+	if opts.heatmap != "" {
+		err = writeHeatmap(opts.heatmap, w, h, quality)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.stats != nil {
+		*opts.stats = traceErrorStats(quality)
+		opts.stats.Image = inPath
+		opts.stats.Output = outPath
+	}
+	progress(1)
+	return nil
+}
+
+/*
+Datasets written by this program begin with these bytes, followed by a
+version number. Files without them are from before datasets recorded how
+they were built, and are read as version 1. Version 2 stores each grid's
+dimensions and source before its pixels. Version 3 stores an index of
+every grid's metadata before all of the pixels, so that a dataset can be
+loaded without reading its pixels. Version 4 is version 3 with the pixels
+compressed in blocks, described by a table after the index. Versions 5
+and 6 are versions 3 and 4 with room for grids wider or taller than 255
+in the index.
+*/
+const DATASET_MAGIC = "LUMA"
+const DATASET_VERSION uint8 = 6
+const INDEXED_VERSION uint8 = 5
+const COMPRESSED_VERSION uint8 = 6
+const NARROW_INDEXED_VERSION uint8 = 3
+const NARROW_COMPRESSED_VERSION uint8 = 4
+
+/*
+The size of a grid's entry in the index of a dataset. In version 5 and
+6, this is the width and height as little-endian uint16s, the average,
+minimum, maximum, the four corners, a reserved byte, and the source as a
+little-endian uint32. In versions 3 and 4, the width and height are a
+byte each and there are three reserved bytes instead of one.
+*/
+const INDEX_ENTRY_LEN = 16
+
+/*
+Reads the dimensions of a grid from its index entry, followed by its
+average, minimum, maximum, and four corners.
+*/
+func indexEntry(entry []uint8, version uint8) (uint16, uint16, []uint8) {
+	if version == NARROW_INDEXED_VERSION || version == NARROW_COMPRESSED_VERSION {
+		return uint16(entry[0]), uint16(entry[1]), entry[2:9]
+	}
+	return binary.LittleEndian.Uint16(entry[0:2]), binary.LittleEndian.Uint16(entry[2:4]), entry[4:11]
+}
+
+/*
+The size of a block's entry in the block table of a compressed dataset:
+the number of grids in the block and the length of their pixels as
+little-endian uint32s, then where the compressed block starts in the file
+and its length as little-endian uint64s.
+*/
+const BLOCK_ENTRY_LEN = 24
+
+/*
+The most that deflate can shrink data by, which bounds how many pixels the
+blocks of a compressed dataset can hold.
+*/
+const MAX_DEFLATE_RATIO = 1032
+
+/*
+The most pixels a compressed block holds, unless a single grid is larger.
+Smaller blocks compress worse but can be read on their own more quickly.
+*/
+const COMPRESSED_BLOCK_LEN = 1 << 20
+
+/*An image or dataset that grids in a dataset came from.*/
+type sourceInfo struct {
+	Name     string `json:"name"`
+	Priority uint8  `json:"priority"`
+}
+
+/*
+Information about how a dataset was built, saved alongside it. The
+dimensions and margin are zero if they were never recorded. MinW and
+MaxW bound the widths of the grids, and their heights too unless MinH
+and MaxH are set. Each grid refers to its source by its index in Sources.
+*/
+type datasetInfo struct {
+	MinW    int          `json:"minW"`
+	MaxW    int          `json:"maxW"`
+	MinH    int          `json:"minH,omitempty"`
+	MaxH    int          `json:"maxH,omitempty"`
+	Margin  float64      `json:"margin"`
+	Sources []sourceInfo `json:"sources"`
+}
+
+/*
+Information about a dataset built with the given dimensions and margin,
+with the heights only recorded apart from the widths if they differ.
+*/
+func newDatasetInfo(minW uint64, maxW uint64, minH uint64, maxH uint64, margin float64) datasetInfo {
+	info := datasetInfo{MinW: int(minW), MaxW: int(maxW), Margin: margin}
+	if minH != minW || maxH != maxW {
+		info.MinH = int(minH)
+		info.MaxH = int(maxH)
+	}
+	return info
+}
+
+/*The minimum and maximum heights of the grids in a dataset.*/
+func (info datasetInfo) heightBounds() (int, int) {
+	if info.MinH == 0 && info.MaxH == 0 {
+		return info.MinW, info.MaxW
+	}
+	return info.MinH, info.MaxH
+}
+
+/*
+Merges the information of two datasets about to be combined. The grids of
+the second dataset have their sources moved past those of the first.
+*/
+func mergeDatasetInfo(info1 datasetInfo, info2 datasetInfo, array2 []Grid, margin float64) datasetInfo {
+	sourceShift := uint32(len(info1.Sources))
+	for i := range array2 {
+		array2[i].source += sourceShift
+	}
+	minH1, maxH1 := info1.heightBounds()
+	minH2, maxH2 := info2.heightBounds()
+	merged := datasetInfo{
+		MinW:    info1.MinW,
+		MaxW:    max(info1.MaxW, info2.MaxW),
+		MinH:    minH1,
+		MaxH:    max(maxH1, maxH2),
+		Margin:  margin,
+		Sources: make([]sourceInfo, 0, len(info1.Sources)+len(info2.Sources)),
+	}
+	if merged.MinW == 0 || (info2.MinW != 0 && info2.MinW < merged.MinW) {
+		merged.MinW = info2.MinW
+	}
+	if merged.MinH == 0 || (minH2 != 0 && minH2 < merged.MinH) {
+		merged.MinH = minH2
+	}
+	if merged.MinH == merged.MinW && merged.MaxH == merged.MaxW {
+		merged.MinH = 0
+		merged.MaxH = 0
+	}
+	merged.Sources = append(merged.Sources, info1.Sources...)
+	merged.Sources = append(merged.Sources, info2.Sources...)
+	return merged
+}
 
-	naphilArray := make([]uint8, fileSize)
+/*
+Read a grid array from a file, along with the information about how it
+was built. Files without that information have their name recorded as
+the only source. The pixels may be in the file mapped into memory, so the
+function returned must only be called once they are no longer used.
+*/
+func readFromFile(fName string) ([]Grid, []uint8, datasetInfo, func() error, error) {
+	data, release, err := loadFile(fName)
+	if nil != err {
+		logError(err.Error())
+		return nil, nil, datasetInfo{}, nil, err
+	}
+	array, naphilArray, info, err := readDataset(fName, data)
+	if err != nil {
+		release()
+		return nil, nil, info, nil, err
+	}
+	return array, naphilArray, info, release, nil
+}
 
-	_, err = io.ReadFull(reader, naphilArray)
+/*
+Reads a dataset to be traced against, like readFromFile, but leaving the
+blocks of a compressed dataset to be decompressed by lumaTrace as it needs
+them. The rule of the set is left for the caller to set.
+*/
+func readFromFileLazily(fName string) (traceSet, datasetInfo, func() error, error) {
+	data, release, err := loadFile(fName)
 	if nil != err {
-		fmt.Println(err)
-		return nil, nil, err
+		logError(err.Error())
+		return traceSet{}, datasetInfo{}, nil, err
+	}
+	array, naphilArray, blocks, info, err := readDatasetLazily(fName, data)
+	if err != nil {
+		release()
+		return traceSet{}, info, nil, err
 	}
+	return traceSet{array: array, naphil: naphilArray, blocks: blocks}, info, release, nil
+}
 
-	var size uint64
+/*
+Reads a grid array from the contents of a dataset, with all of its pixels.
+*/
+func readDataset(fName string, data []uint8) ([]Grid, []uint8, datasetInfo, error) {
+	array, naphilArray, blocks, info, err := readDatasetLazily(fName, data)
+	if err == nil {
+		err = blocks.loadAll()
+	}
+	if err != nil {
+		return nil, nil, info, err
+	}
+	return array, naphilArray, info, nil
+}
 
-	/*Determine the number of grids in the file*/
-	size = 0
-	for i := 5; i != 0; i-- {
-		size = (size << 8) | uint64(naphilArray[i])
+/*
+Reads a grid array from the contents of a dataset, leaving the pixels of
+a compressed dataset to be decompressed by the blocks returned, which are
+nil for any other. Nothing in the file is trusted: the number of grids,
+their dimensions, and the block table of a compressed dataset are all
+checked against the length of the file before they are used, and an
+error gives the byte at which the file went wrong.
+*/
+func readDatasetLazily(fName string, naphilArray []uint8) ([]Grid, []uint8, *pixelBlocks, datasetInfo, error) {
+	var maxLuma, minLuma uint8
+	version, nCursor, size, info, err := readHeader(fName, naphilArray)
+	if err != nil {
+		return nil, nil, nil, info, err
 	}
 
+	/*Every grid takes up at least this many bytes, which bounds how many
+	there can be before any are allocated.*/
+	gridLen := uint64(INDEX_ENTRY_LEN + 1)
+	if version == 1 {
+		gridLen = 3
+	} else if version == 2 {
+		gridLen = 7
+	} else if version == COMPRESSED_VERSION || version == NARROW_COMPRESSED_VERSION {
+		gridLen = INDEX_ENTRY_LEN
+	}
+	if size > uint64(len(naphilArray)-nCursor)/gridLen {
+		return nil, nil, nil, info, fmt.Errorf("%s has a count of %d grids at byte %d, but only %d bytes follow it", fName, size, nCursor-6, len(naphilArray)-nCursor)
+	}
 	array := make([]Grid, int(size))
 
-	nCursor := 6
+	if version >= 3 {
+		indexEnd := nCursor + (INDEX_ENTRY_LEN * len(array))
+		if version == COMPRESSED_VERSION || version == NARROW_COMPRESSED_VERSION {
+			err = readIndex(fName, array, naphilArray[nCursor:indexEnd], nCursor, 0, math.MaxInt, info, version)
+			if err != nil {
+				return nil, nil, nil, info, err
+			}
+			blocks, err := readBlockTable(fName, array, naphilArray, indexEnd)
+			if err != nil {
+				return nil, nil, nil, info, err
+			}
+			return array, blocks.pixels, blocks, info, nil
+		}
+		err = readIndex(fName, array, naphilArray[nCursor:indexEnd], nCursor, indexEnd, len(naphilArray), info, version)
+		if err != nil {
+			return nil, nil, nil, info, err
+		}
+		return array, naphilArray, nil, info, nil
+	}
 
 	var w, h uint8
+	var source uint32
 	var w_signed, h_signed, area int
 	var dimCornAvg, sum, area_64 uint64
 	for i := range size {
 
 		/*Set the dimensions of the grid*/
+		gridStart := nCursor
+		if nCursor+int(gridLen)-1 > len(naphilArray) {
+			return nil, nil, nil, info, fmt.Errorf("%s is truncated at byte %d, in the dimensions of grid %d", fName, gridStart, i)
+		}
 		w = naphilArray[nCursor]
 		nCursor++
 		h = naphilArray[nCursor]
@@ -2047,20 +2817,33 @@ func readFromFile(fName string) ([]Grid, []uint8, error) {
 		area = w_signed * h_signed
 		area_64 = uint64(area)
 		if w == 0 || h == 0 {
-			panic("Empty grid found while reading from file")
+			return nil, nil, nil, info, fmt.Errorf("%s has an empty grid %d at byte %d", fName, i, gridStart)
+		}
+
+		/*Find the source of the grid*/
+		if version >= 2 {
+			source = binary.LittleEndian.Uint32(naphilArray[nCursor : nCursor+4])
+			nCursor += 4
+		}
+		priority := DEFAULT_PRIORITY
+		if int(source) < len(info.Sources) {
+			priority = info.Sources[source].Priority
+		}
+		if area > len(naphilArray)-nCursor {
+			return nil, nil, nil, info, fmt.Errorf("%s is truncated at byte %d: grid %d is %dx%d, but only %d bytes of pixels are left", fName, nCursor, i, w, h, len(naphilArray)-nCursor)
 		}
 
 		/*Find the minimum, maximum, and sum of the pixel values of the grid*/
 		minMaxSum_result := minMaxSum(naphilArray, nCursor, nCursor+area, 255, 0)
-		sum = minMaxSum_result & 0xFFFFFF
-		minMaxSum_result >>= 24
+		sum = minMaxSum_result & 0xFFFFFFFF
+		minMaxSum_result >>= 32
 		minLuma = uint8(minMaxSum_result & 0xFF)
 		minMaxSum_result >>= 8
 		maxLuma = uint8(minMaxSum_result & 0xFF)
 
 		/*Set the metadata for the grid*/
 		dimCornAvg = uint64(w)
-		dimCornAvg <<= 8
+		dimCornAvg <<= 11
 		dimCornAvg += uint64(h)
 		dimCornAvg <<= 8
 		dimCornAvg += (sum / area_64)
@@ -2073,57 +2856,512 @@ func readFromFile(fName string) ([]Grid, []uint8, error) {
 		dimCornAvg <<= 8
 		dimCornAvg += uint64(naphilArray[nCursor+area-1])
 		array[i] = Grid{
-			w__:        w,
-			h__:        h,
+			w__:        uint16(w),
+			h__:        uint16(h),
 			avgLuma:    uint8(sum / area_64),
 			maxLuma:    maxLuma,
 			minLuma:    minLuma,
 			offset:     nCursor,
 			dimCornAvg: dimCornAvg,
+			priority:   priority,
+			source:     source,
 		}
 		nCursor += area
 
 	}
-	return array, naphilArray, nil
+	return array, naphilArray, nil, info, nil
 }
 
-/*Write the grid array to a file.*/
-func writeToFile(array []Grid, arrayLen int, fName string, naphilArray []uint8) error {
-	/*Predefining array size to reduce garbage collection time*/
-	byte_array_len := len(naphilArray) + (2 * arrayLen) + 6
-	byte_array := make([]byte, byte_array_len)
-	naphil_len := len(naphilArray)
+/*
+Loads a whole file into memory. The pixels of the grids in a dataset are
+used where they are in the file, so the file is mapped into memory if
+possible, and read into it otherwise. Returns the contents of the file
+and a function which unmaps it, if it was mapped.
+*/
+func loadFile(fName string) ([]uint8, func() error, error) {
+	f, err := os.Open(fName)
+	if nil != err {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	fStat, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	fileSize := fStat.Size()
+
+	data, release := mapFile(f, fileSize)
+	if data == nil {
+		reader := bufio.NewReader(f)
+		data = make([]uint8, fileSize)
+		_, err = io.ReadFull(reader, data)
+		if nil != err {
+			return nil, nil, err
+		}
+		release = func() error { return nil }
+	}
+	return data, release, nil
+}
+
+/*
+Reads the header of a dataset, if there is one, and the number of grids
+after it. Returns the version of the dataset, where the grids start, the
+number of grids, and the information about how it was built.
+*/
+func readHeader(fName string, data []uint8) (uint8, int, uint64, datasetInfo, error) {
+	info := datasetInfo{}
+	cursor := 0
+	version := uint8(1)
+	if len(data) >= 9 && string(data[:4]) == DATASET_MAGIC {
+		version = data[4]
+		if version > DATASET_VERSION {
+			return version, 0, 0, info, fmt.Errorf("%s is a version %d dataset, newer than this program can read", fName, version)
+		}
+		if version < 2 {
+			return version, 0, 0, info, fmt.Errorf("%s has an invalid version %d at byte 4", fName, version)
+		}
+		infoLen := uint64(binary.LittleEndian.Uint32(data[5:9]))
+		if infoLen > uint64(len(data)-9) {
+			return version, 0, 0, info, fmt.Errorf("%s has a header of %d bytes at byte 9, but only %d bytes follow", fName, infoLen, len(data)-9)
+		}
+		cursor = 9 + int(infoLen)
+		err := json.Unmarshal(data[9:cursor], &info)
+		if err != nil {
+			return version, 0, 0, info, fmt.Errorf("%s has an invalid header at byte 9: %w", fName, err)
+		}
+		if min(info.MinW, info.MaxW, info.MinH, info.MaxH) < 0 || max(info.MinW, info.MaxW, info.MinH, info.MaxH) > MAX_DIM {
+			return version, 0, 0, info, fmt.Errorf("%s has dimensions outside 0 to %d in its header", fName, MAX_DIM)
+		}
+	} else {
+		info.Sources = []sourceInfo{{Name: fName, Priority: DEFAULT_PRIORITY}}
+	}
+
+	/*Determine the number of grids in the file*/
+	if cursor+6 > len(data) {
+		return version, 0, 0, info, fmt.Errorf("%s has no grid count at byte %d", fName, cursor)
+	}
+	size := uint64(0)
+	for i := 5; i >= 0; i-- {
+		size = (size << 8) | uint64(data[cursor+i])
+	}
+	return version, cursor + 6, size, info, nil
+}
+
+/*
+Writes the header of a dataset with an index, followed by the number of
+grids in it.
+*/
+func datasetHeader(info datasetInfo, arrayLen int) ([]byte, error) {
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	header_len := len(DATASET_MAGIC) + 5 + len(infoJSON)
+	header := make([]byte, header_len+6)
+	copy(header, DATASET_MAGIC)
+	header[4] = INDEXED_VERSION
+	binary.LittleEndian.PutUint32(header[5:9], uint32(len(infoJSON)))
+	copy(header[9:header_len], infoJSON)
 	/*Write the size of the array as a little-endian byte array.*/
 	for i := range 6 {
 		c := uint8((arrayLen >> (8 * i)) % 256)
-		byte_array[i] = byte(c)
+		header[header_len+i] = byte(c)
+	}
+	return header, nil
+}
+
+/*Writes the index entry of a grid with the given pixels.*/
+func putIndexEntry(entry []byte, g Grid, pixels []uint8) {
+	w_signed := int(g.getW())
+	area := len(pixels)
+	minMaxSum_result := minMaxSum(pixels, 0, area, 255, 0)
+	binary.LittleEndian.PutUint16(entry[0:2], g.getW())
+	binary.LittleEndian.PutUint16(entry[2:4], g.getH())
+	entry[4] = uint8((minMaxSum_result & 0xFFFFFFFF) / uint64(area))
+	entry[5] = uint8((minMaxSum_result >> 32) & 0xFF)
+	entry[6] = uint8((minMaxSum_result >> 40) & 0xFF)
+	entry[7] = pixels[0]
+	entry[8] = pixels[w_signed-1]
+	entry[9] = pixels[area-w_signed]
+	entry[10] = pixels[area-1]
+	binary.LittleEndian.PutUint32(entry[12:16], g.source)
+}
+
+/*
+Fills a grid array from the index of a dataset, which starts at byte
+indexStart of the file. The pixels of the grids are in the same order as
+the index, starting at pixelStart and ending no later than pixelEnd. The
+version is that of the dataset the index is from.
+*/
+func readIndex(fName string, array []Grid, index []uint8, indexStart int, pixelStart int, pixelEnd int, info datasetInfo, version uint8) error {
+	pixelCursor := pixelStart
+	for i := range array {
+		entry := index[INDEX_ENTRY_LEN*i : INDEX_ENTRY_LEN*(i+1)]
+		entryStart := indexStart + (INDEX_ENTRY_LEN * i)
+		w, h, lumas := indexEntry(entry, version)
+		area := int(w) * int(h)
+		if area == 0 {
+			return fmt.Errorf("%s has an empty grid at index entry %d, byte %d", fName, i, entryStart)
+		}
+		if w > MAX_DIM || h > MAX_DIM {
+			return fmt.Errorf("%s has a grid of %dx%d, larger than %d, at index entry %d, byte %d", fName, w, h, MAX_DIM, i, entryStart)
+		}
+		if pixelCursor+area > pixelEnd {
+			return fmt.Errorf("%s is truncated at byte %d: grid %d is %dx%d, but only %d bytes of pixels are left", fName, pixelCursor, i, w, h, pixelEnd-pixelCursor)
+		}
+		source := binary.LittleEndian.Uint32(entry[12:16])
+		priority := DEFAULT_PRIORITY
+		if int(source) < len(info.Sources) {
+			priority = info.Sources[source].Priority
+		}
+		dimCornAvg := (uint64(w) << 51) | (uint64(h) << 40) | (uint64(lumas[0]) << 32) | uint64(binary.BigEndian.Uint32(lumas[3:7]))
+		array[i] = Grid{
+			w__:        w,
+			h__:        h,
+			avgLuma:    lumas[0],
+			minLuma:    lumas[1],
+			maxLuma:    lumas[2],
+			offset:     pixelCursor,
+			dimCornAvg: dimCornAvg,
+			priority:   priority,
+			source:     source,
+		}
+		pixelCursor += area
+	}
+	return nil
+}
+
+/*
+Splits the grids of a dataset into blocks for compression. A block holds
+consecutive grids of the same dimensions, up to COMPRESSED_BLOCK_LEN
+pixels. Returns the number of grids in each block.
+*/
+func compressedBlocks(array []Grid) []int {
+	blocks := make([]int, 0)
+	i := 0
+	for i < len(array) {
+		w := array[i].getW()
+		h := array[i].getH()
+		area := int(w) * int(h)
+		j := i + 1
+		for j < len(array) && array[j].getW() == w && array[j].getH() == h && (j-i+1)*area <= COMPRESSED_BLOCK_LEN {
+			j++
+		}
+		blocks = append(blocks, j-i)
+		i = j
+	}
+	return blocks
+}
+
+/*
+Compresses one block of pixels. Every grid after the first is stored as
+its difference from the grid before it, which is small for the similar
+grids sorted next to each other, and the result is deflated.
+*/
+func compressBlock(pixels []uint8, area int) ([]byte, error) {
+	delta := make([]uint8, len(pixels))
+	copy(delta, pixels[:area])
+	for i := area; i < len(pixels); i++ {
+		delta[i] = pixels[i] - pixels[i-area]
+	}
+	var buf bytes.Buffer
+	zw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = zw.Write(delta)
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	return buf.Bytes(), err
+}
+
+/*Decompresses one block of pixels into out, which must be its exact length.*/
+func decompressBlock(block []byte, out []uint8, area int) error {
+	zr := flate.NewReader(bytes.NewReader(block))
+	defer zr.Close()
+	_, err := io.ReadFull(zr, out)
+	if err != nil {
+		return err
+	}
+	for i := area; i < len(out); i++ {
+		out[i] += out[i-area]
+	}
+	return nil
+}
+
+/*
+Replaces the pixels of a dataset being written, which start at pixelStart,
+with a block table and compressed blocks. Blocks are compressed in
+parallel.
+*/
+func compressPixels(array []Grid, data []byte, pixelStart int) ([]byte, error) {
+	blocks := compressedBlocks(array)
+	compressed := make([][]byte, len(blocks))
+	errs := make([]error, len(blocks))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	first := 0
+	for b, count := range blocks {
+		start := array[first].offset
+		area := int(array[first].getW()) * int(array[first].getH())
+		first += count
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(b int, start int, area int, count int) {
+			defer wg.Done()
+			compressed[b], errs[b] = compressBlock(data[pixelStart+start:pixelStart+start+(area*count)], area)
+			<-sem
+		}(b, start, area, count)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	tableStart := pixelStart + 4
+	cursor := tableStart + (BLOCK_ENTRY_LEN * len(blocks))
+	out := make([]byte, cursor, cursor+len(data)/2)
+	copy(out, data[:pixelStart])
+	out[4] = COMPRESSED_VERSION
+	binary.LittleEndian.PutUint32(out[pixelStart:tableStart], uint32(len(blocks)))
+	first = 0
+	for b, count := range blocks {
+		area := int(array[first].getW()) * int(array[first].getH())
+		first += count
+		entry := out[tableStart+(BLOCK_ENTRY_LEN*b) : tableStart+(BLOCK_ENTRY_LEN*(b+1))]
+		binary.LittleEndian.PutUint32(entry[0:4], uint32(count))
+		binary.LittleEndian.PutUint32(entry[4:8], uint32(area*count))
+		binary.LittleEndian.PutUint64(entry[8:16], uint64(len(out)))
+		binary.LittleEndian.PutUint64(entry[16:24], uint64(len(compressed[b])))
+		out = append(out, compressed[b]...)
+	}
+	return out, nil
+}
+
+/*
+The pixels of a compressed dataset, which are decompressed a block at a
+time the first time any grid in a block is needed, so that a trace only
+decompresses the dimensions it uses. Pixels are zero until their block is
+loaded.
+*/
+type pixelBlocks struct {
+	fName  string
+	pixels []uint8
+	blocks []pixelBlock
+	loaded atomic.Int64
+}
+
+/*A compressed block of a dataset and where its pixels go.*/
+type pixelBlock struct {
+	pixelStart int
+	pixelLen   int
+	area       int
+	fileStart  uint64
+	data       []byte
+	once       sync.Once
+	err        error
+}
+
+/*
+Reads the block table of a compressed dataset, which starts at the
+cursor, checking every block against the index without decompressing
+any. The grids must have been read from the index already.
+*/
+func readBlockTable(fName string, array []Grid, data []uint8, cursor int) (*pixelBlocks, error) {
+	pixelsLen := 0
+	if len(array) > 0 {
+		last := array[len(array)-1]
+		pixelsLen = last.offset + (int(last.getW()) * int(last.getH()))
+	}
+	if pixelsLen/MAX_DEFLATE_RATIO > len(data)-cursor {
+		return nil, fmt.Errorf("%s has an index of %d bytes of pixels, more than the %d bytes after byte %d could hold", fName, pixelsLen, len(data)-cursor, cursor)
+	}
+	if cursor+4 > len(data) {
+		return nil, fmt.Errorf("%s has no block table at byte %d", fName, cursor)
+	}
+	blockNum := int(binary.LittleEndian.Uint32(data[cursor : cursor+4]))
+	cursor += 4
+	if blockNum > (len(data)-cursor)/BLOCK_ENTRY_LEN {
+		return nil, fmt.Errorf("%s has a block table of %d blocks at byte %d, but only %d bytes follow", fName, blockNum, cursor-4, len(data)-cursor)
+	}
+	p := &pixelBlocks{fName: fName, pixels: make([]uint8, pixelsLen), blocks: make([]pixelBlock, blockNum)}
+	first := 0
+	for b := range blockNum {
+		entryStart := cursor + (BLOCK_ENTRY_LEN * b)
+		entry := data[entryStart : entryStart+BLOCK_ENTRY_LEN]
+		count := int(binary.LittleEndian.Uint32(entry[0:4]))
+		rawLen := int(binary.LittleEndian.Uint32(entry[4:8]))
+		blockStart := binary.LittleEndian.Uint64(entry[8:16])
+		blockLen := binary.LittleEndian.Uint64(entry[16:24])
+		if count < 1 || count > len(array)-first {
+			return nil, fmt.Errorf("%s has %d grids in block %d at byte %d, but %d grids are left", fName, count, b, entryStart, len(array)-first)
+		}
+		g := array[first]
+		area := int(g.getW()) * int(g.getH())
+		last := array[first+count-1]
+		if rawLen != area*count || last.offset+(int(last.getW())*int(last.getH())) != g.offset+rawLen {
+			return nil, fmt.Errorf("%s has a block %d at byte %d that does not match its index", fName, b, entryStart)
+		}
+		if blockStart > uint64(len(data)) || blockLen > uint64(len(data))-blockStart {
+			return nil, fmt.Errorf("%s has a block %d at byte %d of %d bytes, past its end", fName, b, blockStart, blockLen)
+		}
+		first += count
+		block := &p.blocks[b]
+		block.pixelStart, block.pixelLen, block.area = g.offset, rawLen, area
+		block.fileStart, block.data = blockStart, data[blockStart:blockStart+blockLen]
+	}
+	if first != len(array) {
+		return nil, fmt.Errorf("%s has blocks for %d of %d grids", fName, first, len(array))
+	}
+	return p, nil
+}
+
+/*Decompresses block b, unless it has been already.*/
+func (p *pixelBlocks) loadBlock(b int) error {
+	block := &p.blocks[b]
+	block.once.Do(func() {
+		block.err = decompressBlock(block.data, p.pixels[block.pixelStart:block.pixelStart+block.pixelLen], block.area)
+		if block.err != nil {
+			block.err = fmt.Errorf("%s has a corrupt block %d at byte %d: %w", p.fName, b, block.fileStart, block.err)
+			return
+		}
+		p.loaded.Add(1)
+	})
+	return block.err
+}
+
+/*
+Decompresses every block holding the pixels of the given grids. Grids are
+usually stored with others of their dimensions, so only the range of
+pixels from the first to the last of them is loaded. Does nothing for a
+dataset which is not compressed, or once every block is loaded.
+*/
+func (p *pixelBlocks) loadGrids(array []Grid) error {
+	if p == nil || len(array) == 0 || int(p.loaded.Load()) == len(p.blocks) {
+		return nil
+	}
+	start, end := array[0].offset, 0
+	for _, g := range array {
+		start = min(start, g.offset)
+		end = max(end, g.offset+(int(g.getW())*int(g.getH())))
+	}
+	b := sort.Search(len(p.blocks), func(i int) bool {
+		return p.blocks[i].pixelStart+p.blocks[i].pixelLen > start
+	})
+	for ; b < len(p.blocks) && p.blocks[b].pixelStart < end; b++ {
+		err := p.loadBlock(b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Decompresses every block not yet loaded in parallel, for everything that
+needs all of the pixels of a dataset at once. Does nothing for a dataset
+which is not compressed.
+*/
+func (p *pixelBlocks) loadAll() error {
+	if p == nil {
+		return nil
+	}
+	errs := make([]error, len(p.blocks))
+	workerPool(len(p.blocks), runtime.GOMAXPROCS(0), func(b int) {
+		errs[b] = p.loadBlock(b)
+	})
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Write the grid array to a file, along with information about how it was
+built and an index of the grids, compressing the pixels if asked. The file
+is written under a temporary name first and then renamed, so a dataset can
+be rewritten while it is mapped into memory.
+*/
+func writeToFile(array []Grid, arrayLen int, fName string, naphilArray []uint8, info datasetInfo, compress bool) error {
+	return writeSplitToFile(array, arrayLen, fName, naphilArray, nil, info, compress)
+}
+
+/*
+Writes a grid array to a file like writeToFile, with the pixels split
+between two arrays. Grids with offsets past the end of naphilArray1 have
+their pixels in naphilArray2, at their offset less the length of
+naphilArray1.
+*/
+func writeSplitToFile(array []Grid, arrayLen int, fName string, naphilArray1 []uint8, naphilArray2 []uint8, info datasetInfo, compress bool) error {
+	if arrayLen < 0 || arrayLen > len(array) {
+		return fmt.Errorf("cannot write %d grids of %d to %s", arrayLen, len(array), fName)
 	}
-	cursor := 6
-	/*Write the dimensions of each grid, followed by its pixels*/
-	for i := 0; i < arrayLen && cursor < byte_array_len; i++ {
-		if array[i].getW() == 0 || array[i].getH() == 0 {
-			panic("Empty grid found while writing to file")
+	header, err := datasetHeader(info, arrayLen)
+	if err != nil {
+		return err
+	}
+	/*Predefining array size to reduce garbage collection time*/
+	index_start := len(header)
+	pixel_start := index_start + (INDEX_ENTRY_LEN * arrayLen)
+	byte_array_len := pixel_start
+	naphil_len_1 := len(naphilArray1)
+	naphil_len := naphil_len_1 + len(naphilArray2)
+	for i := range arrayLen {
+		w, h := array[i].getW(), array[i].getH()
+		if w == 0 || h == 0 || w > MAX_DIM || h > MAX_DIM {
+			return fmt.Errorf("cannot write grid %d of %dx%d to %s", i, w, h, fName)
+		}
+		area := int(w) * int(h)
+		a_offset := array[i].offset
+		if a_offset < 0 || a_offset > naphil_len-area || (a_offset < naphil_len_1 && a_offset > naphil_len_1-area) {
+			return fmt.Errorf("cannot write grid %d to %s, as its pixels at %d are outside the %d given", i, fName, a_offset, naphil_len)
 		}
+		byte_array_len += area
+	}
+	byte_array := make([]byte, byte_array_len)
+	copy(byte_array, header)
+	/*Write the index entry of each grid, and its pixels after the index*/
+	cursor := pixel_start
+	for i := range arrayLen {
 		a_offset := array[i].offset
-		w_ := array[i].getW()
-		h_ := array[i].getH()
-		byte_array[cursor] = w_
-		cursor++
-		byte_array[cursor] = byte(array[i].getH())
-		cursor++
-		h_signed := int(h_)
-		w_signed := int(w_)
-		area := h_signed * w_signed
-		if cursor >= byte_array_len || cursor+area > byte_array_len {
-			panic("Out of bounds: byte_array")
+		area := int(array[i].getW()) * int(array[i].getH())
+		var pixels []uint8
+		if a_offset < naphil_len_1 {
+			pixels = naphilArray1[a_offset : a_offset+area]
+		} else {
+			pixels = naphilArray2[a_offset-naphil_len_1 : a_offset-naphil_len_1+area]
 		}
-		if a_offset >= naphil_len || a_offset+area > naphil_len {
-			panic("Out of bonuds: naphilArray")
+		putIndexEntry(byte_array[index_start+(INDEX_ENTRY_LEN*i):index_start+(INDEX_ENTRY_LEN*(i+1))], array[i], pixels)
+		copy(byte_array[cursor:cursor+area], pixels)
+		cursor += area
+	}
+	if compress {
+		/*The grids are given offsets from the start of the pixels, as they
+		were written, to find their blocks.*/
+		written := make([]Grid, arrayLen)
+		offset := 0
+		for i := range arrayLen {
+			written[i] = array[i]
+			written[i].offset = offset
+			offset += int(array[i].getW()) * int(array[i].getH())
+		}
+		byte_array, err = compressPixels(written, byte_array, pixel_start)
+		if err != nil {
+			return err
 		}
-		copy(byte_array[cursor:cursor+area], naphilArray[a_offset:a_offset+area])
-		cursor = min(cursor+area, byte_array_len)
 	}
-	return os.WriteFile(fName, byte_array[:cursor], 0777)
+	tempName := fName + ".tmp"
+	err = os.WriteFile(tempName, byte_array, 0777)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempName, fName)
 }
 
 /*Sort a grid array by its metadata, in parallel*/
@@ -2153,6 +3391,40 @@ func parallelSort(array []Grid, tNum int) {
 	})
 }
 
+/*
+Runs job for every index from 0 to n-1 with a pool of workers. Each worker
+takes the next index from a queue as soon as it finishes the last, so one
+slow job does not hold up the others. Returns once every job has finished.
+*/
+func workerPool(n int, workers int, job func(int)) {
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for range max(1, min(workers, n)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				job(i)
+			}
+		}()
+	}
+	for i := range n {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+}
+
+/*
+Splits n items into chunks to be shared between workers, returning the
+size of each chunk and the number of chunks. Chunks are small enough to
+balance the work between workers, but no smaller than minChunk.
+*/
+func chunkSize(n int, workers int, minChunk int) (int, int) {
+	size := max(minChunk, n/(max(1, workers)*8), 1)
+	return size, (n + size - 1) / size
+}
+
 /*Combine two arrays*/
 func combineArrays(array1 []Grid, array2 []Grid, margin float64, tNum int, naphilArray1 []uint8, naphilArray2 []uint8) ([]Grid, []uint8, int) {
 	arrayLen_1 := len(array1)
@@ -2165,12 +3437,12 @@ func combineArrays(array1 []Grid, array2 []Grid, margin float64, tNum int, naphi
 	bound_1 := arrayLen_1
 	/*The size is calculate differently if either array is sorted by range.
 	Both methods use binary searches to determine the total size.*/
-	if array1[arrayLen_1-1].dimCornAvg>>56 != 0 {
+	if array1[arrayLen_1-1].dimCornAvg>>62 != 0 {
 		a_ := 0
 		b_ := len(array1)
 		for a_ < b_ {
 			m := a_ + ((b_ - a_) / 2)
-			if array1[m].dimCornAvg>>56 == 0 {
+			if array1[m].dimCornAvg>>62 == 0 {
 				a_ = m + 1
 			} else {
 				b_ = m
@@ -2213,12 +3485,12 @@ func combineArrays(array1 []Grid, array2 []Grid, margin float64, tNum int, naphi
 		i_ = a
 	}
 	bound_2 := arrayLen_2
-	if array2[arrayLen_2-1].dimCornAvg>>56 != 0 {
+	if array2[arrayLen_2-1].dimCornAvg>>62 != 0 {
 		a_ := 0
 		b_ := len(array2)
 		for a_ < b_ {
 			m := a_ + ((b_ - a_) / 2)
-			if array2[m].dimCornAvg>>56 == 0 {
+			if array2[m].dimCornAvg>>62 == 0 {
 				a_ = m + 1
 			} else {
 				b_ = m
@@ -2320,38 +3592,14 @@ doubleLoopEnd:
 		j_++
 		k_++
 	}
-	arrayMerged = removeRedundantGrids(arrayMerged, margin, tNum, naphilMerged)
+	arrayMerged = removeRedundantGrids(arrayMerged, margin, tNum, naphilMerged, LOG_NORMAL)
 	return arrayMerged, naphilMerged, len(arrayMerged)
 }
 
-/*Generate an image object from an image file.*/
-func openImage(path string) (image.Image, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		fmt.Println(err)
-		return nil, err
-	}
-	defer f.Close()
-	/*Handle PNG files specially, for reasons I cannot ascertain.*/
-	if strings.HasSuffix(strings.ToLower(path), ".png") {
-		pngImg, err := fastpng.Decode(f)
-		if err != nil {
-			log.Fatal(err)
-			return nil, err
-		}
-		return pngImg, err
-	}
-	img, _, err := image.Decode(f)
-	if err != nil {
-		fmt.Println("Decoding error: ", err.Error())
-		return nil, err
-	}
-	return img, nil
-}
-
-/*Print a time span in human-readable format.*/
-func printTime(t int64) {
+/*Write a time span in human-readable format.*/
+func timeText(t int64) string {
 	if t > 1000000000 {
+		text := ""
 		sc := int(t / 1000000000)
 		if 60 <= sc {
 			mn := int(sc / 60)
@@ -2359,80 +3607,384 @@ func printTime(t int64) {
 			if 60 <= mn {
 				hr := int(mn / 60)
 				mn %= 60
-				fmt.Printf("%d hours ", hr)
+				text += fmt.Sprintf("%d hours ", hr)
 			}
-			fmt.Printf("%d minutes ", mn)
+			text += fmt.Sprintf("%d minutes ", mn)
 		}
-		fmt.Printf("%d seconds\n", sc)
+		return text + fmt.Sprintf("%d seconds", sc)
 	} else if 1000000 <= t {
-		fmt.Printf("%d milliseconds\n", t/1000000)
+		return fmt.Sprintf("%d milliseconds", t/1000000)
 	} else if 1000 <= t {
-		fmt.Printf("%d microseconds\n", t/1000)
-	} else {
-		fmt.Printf("%d nanoseconds\n", t)
+		return fmt.Sprintf("%d microseconds", t/1000)
 	}
+	return fmt.Sprintf("%d nanoseconds", t)
 }
 
-/*Populate a naphil array*/
-func populateNaphil(naphilArray []uint8, pix_data []uint8, x1 uint64, x2 uint64, y1 uint64, y2 uint64, offset int, imgW uint64) {
-	w64 := x2 - x1
-	w_signed := int(w64)
-	y_16 := y1
-	y_64 := uint64(0)
-	y_signed := 0
-	y_offset := y1
-	for y_16 < y2 {
-		offset_n := offset + (y_signed * w_signed)
-		offset_p := y_offset * imgW
-		end := offset_p + x2
-		offset_p += x1
-		copy(naphilArray[offset_n:offset_n+w_signed], pix_data[offset_p:end])
-		y_16++
-		y_64++
-		y_offset++
-		y_signed++
-	}
-}
+/*
+How much is logged. Quiet runs only log errors, and verbose runs also log
+the steps inside each trace and other details.
+*/
+const (
+	LOG_QUIET = iota
+	LOG_NORMAL
+	LOG_VERBOSE
+)
 
-/*Determines the sum of a subset of a naphil, and nothing else*/
-func sumNaphil(naphilArray []uint8, a int, b int) uint64 {
-	i := a
-	sum := uint64(0)
-	for i < b {
-		sum += uint64(naphilArray[i])
-		i++
-		if i >= b {
-			break
-		}
-		sum += uint64(naphilArray[i])
-		i++
-		if i >= b {
-			break
-		}
-		sum += uint64(naphilArray[i])
-		i++
-		if i >= b {
-			break
-		}
-		sum += uint64(naphilArray[i])
-		i++
-	}
-	return sum
+/*
+Logging options, set with --quiet, --verbose and --log-format at the
+start of main. Logs are written to stderr, so that stdout only carries
+results, such as the report of inspect.
+*/
+var logLevel = LOG_NORMAL
+var logJSON = false
+var logMu sync.Mutex
+
+/*
+An entry of the log as written with --log-format json, one to a line.
+Progress is given as the percent done and the number of items done out
+of the total, and finished phases give how long they took and how many
+items they produced.
+*/
+type logEvent struct {
+	Time    string   `json:"time"`
+	Level   string   `json:"level"`
+	Event   string   `json:"event"`
+	Phase   string   `json:"phase,omitempty"`
+	Percent *float64 `json:"percent,omitempty"`
+	Done    int      `json:"done,omitempty"`
+	Total   int      `json:"total,omitempty"`
+	Count   int      `json:"count,omitempty"`
+	Seconds *float64 `json:"seconds,omitempty"`
+	File    string   `json:"file,omitempty"`
+	Message string   `json:"message,omitempty"`
 }
 
 /*
-Determines the highest and lowest values in a subset of a naphil, but
-stops checking for highest if it finds 255 and lowest if 0. It calculates
-the sum all the while.
+Logs an event if the log level is at least level, either as a line of
+JSON or as the given text.
 */
-func minMaxSum(naphilArray []uint8, a int, b int, minLuma uint8, maxLuma uint8) uint64 {
-	i := a
-	sum := uint64(0)
-	var p uint8
-	if minLuma != 0 && maxLuma != 255 {
-		for i < b {
-			p = naphilArray[i]
-			sum += uint64(p)
+func writeLog(level int, e logEvent, text string) {
+	if level > logLevel {
+		return
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	if !logJSON {
+		fmt.Fprintln(os.Stderr, text)
+		return
+	}
+	e.Time = time.Now().Format(time.RFC3339Nano)
+	e.Level = []string{"error", "info", "debug"}[level]
+	if e.Message == "" {
+		e.Message = text
+	}
+	out, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	os.Stderr.Write(append(out, '\n'))
+}
+
+/*Logs a message at the normal level.*/
+func logMessage(text string) {
+	writeLog(LOG_NORMAL, logEvent{Event: "message"}, text)
+}
+
+/*Logs a message only seen in verbose runs.*/
+func logVerbose(text string) {
+	writeLog(LOG_VERBOSE, logEvent{Event: "message"}, text)
+}
+
+/*Logs an error, which is seen even in quiet runs.*/
+func logError(text string) {
+	writeLog(LOG_QUIET, logEvent{Event: "error"}, text)
+}
+
+/*Logs that something was done to a file, such as tracing or writing it.*/
+func logFile(event string, file string, text string) {
+	writeLog(LOG_NORMAL, logEvent{Event: event, File: file}, text)
+}
+
+/*
+Lines written by the log package, such as by log.Fatal, become error
+events in JSON logs.
+*/
+type logWriter struct{}
+
+func (logWriter) Write(b []byte) (int, error) {
+	logError(strings.TrimSuffix(string(b), "\n"))
+	return len(b), nil
+}
+
+/*
+Removes the logging options from the arguments of the program and sets
+the log level and format accordingly.
+*/
+func parseLogOptions(args []string) ([]string, error) {
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--quiet":
+			logLevel = LOG_QUIET
+		case "--verbose":
+			logLevel = LOG_VERBOSE
+		case "--log-format":
+			if i+1 >= len(args) || (args[i+1] != "text" && args[i+1] != "json") {
+				return nil, fmt.Errorf("--log-format must be followed by text or json")
+			}
+			logJSON = args[i+1] == "json"
+			i++
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	if logJSON {
+		log.SetFlags(0)
+		log.SetOutput(logWriter{})
+	}
+	return rest, nil
+}
+
+/*
+Files to write profiles of a run to, none of which are written unless
+given.
+*/
+type profileOptions struct {
+	cpu  string
+	mem  string
+	exec string
+}
+
+/*
+Removes the profiling options from the arguments of the program, in the
+same way as the logging options.
+*/
+func parseProfileOptions(args []string) ([]string, profileOptions, error) {
+	var opts profileOptions
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		var dest *string
+		switch args[i] {
+		case "--cpuprofile":
+			dest = &opts.cpu
+		case "--memprofile":
+			dest = &opts.mem
+		case "--exectrace":
+			dest = &opts.exec
+		default:
+			rest = append(rest, args[i])
+			continue
+		}
+		if i+1 >= len(args) || strings.HasPrefix(args[i+1], "-") {
+			return nil, opts, fmt.Errorf("%s must be followed by a file name", args[i])
+		}
+		*dest = args[i+1]
+		i++
+	}
+	return rest, opts, nil
+}
+
+/*
+Starts the CPU profile and execution trace asked for, and returns a
+function which stops them and writes the heap profile. The function is
+also called if the program is interrupted, so that serve and watch, which
+run until they are stopped, still leave complete profiles.
+*/
+func startProfiling(opts profileOptions) (func(), error) {
+	var files []*os.File
+	create := func(name string) (*os.File, error) {
+		f, err := os.Create(name)
+		if err == nil {
+			files = append(files, f)
+		}
+		return f, err
+	}
+	if opts.cpu != "" {
+		f, err := create(opts.cpu)
+		if err == nil {
+			err = pprof.StartCPUProfile(f)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.exec != "" {
+		f, err := create(opts.exec)
+		if err == nil {
+			err = trace.Start(f)
+		}
+		if err != nil {
+			if opts.cpu != "" {
+				pprof.StopCPUProfile()
+			}
+			return nil, err
+		}
+	}
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			if opts.cpu != "" {
+				pprof.StopCPUProfile()
+			}
+			if opts.exec != "" {
+				trace.Stop()
+			}
+			if opts.mem != "" {
+				f, err := os.Create(opts.mem)
+				if err == nil {
+					runtime.GC()
+					err = pprof.WriteHeapProfile(f)
+					f.Close()
+				}
+				if err != nil {
+					logError("Error writing the heap profile: " + err.Error())
+				}
+			}
+			for _, f := range files {
+				f.Close()
+			}
+		})
+	}
+	if opts != (profileOptions{}) {
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-interrupt
+			stop()
+			os.Exit(1)
+		}()
+	}
+	return stop, nil
+}
+
+/*
+Serves the pprof endpoints under /debug/pprof/ on addr, for looking into
+serve and watch while they run. They are kept off the mux of serve, so
+that they are only reachable on the address given.
+*/
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", httppprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+	logMessage("Serving pprof on " + addr)
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		logError("Error serving pprof: " + err.Error())
+	}()
+}
+
+/*
+The progress of a phase of work, such as generating grids or tracing a
+batch of frames, which is logged at most once a second as items are
+done, then with how long it took once it is finished.
+*/
+type progressLog struct {
+	mu    sync.Mutex
+	level int
+	phase string
+	label string
+	total int
+	done  int
+	start int64
+	last  int64
+}
+
+/*Starts logging a phase of total items at the given level.*/
+func newProgressLog(level int, phase string, label string, total int) *progressLog {
+	p := &progressLog{level: level, phase: phase, label: label, total: total, start: time.Now().UnixNano()}
+	p.last = p.start
+	writeLog(level, logEvent{Event: "start", Phase: phase, Total: total}, label+":")
+	return p
+}
+
+/*Records that n more items are done.*/
+func (p *progressLog) add(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+	now := time.Now().UnixNano()
+	if now-p.last < 1000000000 {
+		return
+	}
+	p.last = now
+	percent := 100.0 * float64(p.done) / float64(max(1, p.total))
+	writeLog(p.level, logEvent{Event: "progress", Phase: p.phase, Percent: &percent, Done: p.done, Total: p.total}, fmt.Sprintf("%s	%f%%	%d of %d", p.label, percent, p.done, p.total))
+}
+
+/*Logs the end of the phase, and the number of items it produced, if any.*/
+func (p *progressLog) finish(count int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := time.Now().UnixNano() - p.start
+	seconds := float64(t) / 1000000000
+	writeLog(p.level, logEvent{Event: "done", Phase: p.phase, Done: p.done, Total: p.total, Count: count, Seconds: &seconds}, timeText(t))
+}
+
+/*Populate a naphil array*/
+func populateNaphil(naphilArray []uint8, pix_data []uint8, x1 uint64, x2 uint64, y1 uint64, y2 uint64, offset int, imgW uint64) {
+	w64 := x2 - x1
+	w_signed := int(w64)
+	y_16 := y1
+	y_64 := uint64(0)
+	y_signed := 0
+	y_offset := y1
+	for y_16 < y2 {
+		offset_n := offset + (y_signed * w_signed)
+		offset_p := y_offset * imgW
+		end := offset_p + x2
+		offset_p += x1
+		copy(naphilArray[offset_n:offset_n+w_signed], pix_data[offset_p:end])
+		y_16++
+		y_64++
+		y_offset++
+		y_signed++
+	}
+}
+
+/*Determines the sum of a subset of a naphil, and nothing else*/
+func sumNaphil(naphilArray []uint8, a int, b int) uint64 {
+	i := a
+	sum := uint64(0)
+	for i < b {
+		sum += uint64(naphilArray[i])
+		i++
+		if i >= b {
+			break
+		}
+		sum += uint64(naphilArray[i])
+		i++
+		if i >= b {
+			break
+		}
+		sum += uint64(naphilArray[i])
+		i++
+		if i >= b {
+			break
+		}
+		sum += uint64(naphilArray[i])
+		i++
+	}
+	return sum
+}
+
+/*
+Determines the highest and lowest values in a subset of a naphil, but
+stops checking for highest if it finds 255 and lowest if 0. It calculates
+the sum all the while. The sum is returned in the bottom 32 bits, the
+lowest value in the 8 above them, and the highest in the 8 above those.
+*/
+func minMaxSum(naphilArray []uint8, a int, b int, minLuma uint8, maxLuma uint8) uint64 {
+	i := a
+	sum := uint64(0)
+	var p uint8
+	if minLuma != 0 && maxLuma != 255 {
+		for i < b {
+			p = naphilArray[i]
+			sum += uint64(p)
 			if p > maxLuma {
 				maxLuma = p
 			}
@@ -2562,61 +4114,3217 @@ func minMaxSum(naphilArray []uint8, a int, b int, minLuma uint8, maxLuma uint8)
 			}
 		}
 	}
-	if i < b {
-		return (0xFF00 << 24) + sumNaphil(naphilArray, i, b)
+	if i < b {
+		return (0xFF << 40) + sumNaphil(naphilArray, i, b)
+	}
+	return sum + (uint64(minLuma) << 32) + (uint64(maxLuma) << 40)
+}
+
+/*
+A recursive function involved in combining arrays. If priorities is not
+nil, the grids from each file are given the priority at the same index,
+otherwise they keep the priorities saved with them. The function returned
+unmaps any file the pixels are still in once they are no longer used.
+*/
+func combineArraysRec(fileNames []string, priorities []uint8, a int, b int, margin float64, tNum int) ([]Grid, []uint8, int, datasetInfo, func() error) {
+	if a < b {
+		array1, naphil1, size1, info1, release1 := combineArraysRec(fileNames, priorities, a, a+((b-a)/2), margin, tNum)
+		array2, naphil2, size2, info2, release2 := combineArraysRec(fileNames, priorities, a+((b-a)/2)+1, b, margin, tNum)
+		if array1 == nil || size1 == 0 {
+			release1()
+			return array2, naphil2, size2, info2, release2
+		}
+		if array2 == nil || size2 == 0 {
+			release2()
+			return array1, naphil1, size1, info1, release1
+		}
+		info := mergeDatasetInfo(info1, info2, array2, margin)
+		/*The combined pixels are a copy, so neither file is needed anymore*/
+		array, naphil, size := combineArrays(array1, array2, margin, tNum, naphil1, naphil2)
+		release1()
+		release2()
+		return array, naphil, size, info, func() error { return nil }
+	}
+	var array []Grid
+	var naphil []uint8
+	var info datasetInfo
+	var err error
+	var i_, arrayLen int
+	var margInt uint8
+	var release func() error
+	array, naphil, info, release, err = readFromFile(fileNames[a])
+	if err != nil {
+		panic("Invalid file")
+	}
+	if priorities != nil {
+		for i := range info.Sources {
+			info.Sources[i].Priority = priorities[a]
+		}
+	}
+	i_ = 0
+	arrayLen = len(array)
+	margInt = uint8(256.0 * margin)
+	/*Marks grids with a substantial difference between maximum
+	and minimum value, then sorts.*/
+	for i_ < arrayLen {
+		if array[i_].maxLuma-array[i_].minLuma > margInt {
+			array[i_].dimCornAvg |= DEEP_64
+		}
+		if priorities != nil {
+			array[i_].priority = priorities[a]
+		}
+		i_++
+	}
+	parallelSort(array, tNum)
+	return array, naphil, len(array), info, release
+}
+
+/*
+Creates a dataset from images, split into grids between the minimum and
+maximum widths and heights. Grids are sorted, and redundant grids are
+removed if the margin is above zero.
+*/
+func buildFromImages(imagePaths []string, minW uint64, maxW uint64, minH uint64, maxH uint64, margin float64, tNum int) ([]Grid, []uint8, datasetInfo) {
+	trees := make([]*Tree, len(imagePaths))
+
+	/*Every input image is a source of the dataset*/
+	imageInfo := newDatasetInfo(minW, maxW, minH, maxH, margin)
+	for _, imgName := range imagePaths {
+		imageInfo.Sources = append(imageInfo.Sources, sourceInfo{Name: imgName, Priority: DEFAULT_PRIORITY})
+	}
+
+	progress := newProgressLog(LOG_NORMAL, "tree_generation", "Generating trees", len(trees))
+	widthArray := make([]int, len(trees))
+	heightArray := make([]int, len(trees))
+	/*Go image by image, each worker writing only to the entries of its own
+	image, and total the leaves once every tree is generated.*/
+	workerPool(len(trees), tNum, func(i int) {
+		f, err := os.Open(imagePaths[i])
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		config, _, err := image.DecodeConfig(f)
+		if err != nil {
+			panic(err)
+		}
+		w := config.Width
+		h := config.Height
+		widthArray[i] = w
+		heightArray[i] = h
+		/*Generate tree*/
+		trees[i] = generateTree(0, uint64(w), 0, uint64(h), minW, maxW, minH, maxH, randomUint64(), randomUint64())
+		progress.add(1)
+	})
+	totalLeafNum := 0
+	for i := range trees {
+		totalLeafNum += trees[i].leafNum
+	}
+	progress.finish(totalLeafNum)
+
+	coordArray := make([][]uint64, totalLeafNum)
+	indexArray := make([]int, totalLeafNum)
+	encodedCoordArray := make([]encodedCoord, totalLeafNum)
+	tempLeafNum := 0
+
+	progress = newProgressLog(LOG_NORMAL, "coordinate_gathering", "Gathering coordinates from trees", len(trees))
+	tempIndex := 0
+	/*The changeArray finds where the metadata array changes in terms of the dimensions
+	or source image referred to, ending with the total number of grids. An image need
+	not have grids of every dimension, so imageRuns records where in the changeArray
+	the grids of each image start.*/
+	changeArray := make([]int, 1, (len(trees)*int(maxW-minW+1)*int(maxH-minH+1))+1)
+	imageRuns := make([]int, len(trees)+1)
+	/*Get the total number of leaves which will be the same as the total number of grids.*/
+	for i := range trees {
+		progress.add(1)
+		reuse := make([]uint64, 5)
+		coordsFromTree(trees[i], uint64(i), coordArray, tempLeafNum, reuse)
+		/*Encode grid metadata into uint64 array*/
+		encodeCoords(trees[i], uint64(i), encodedCoordArray, tempLeafNum)
+		l := trees[i].leafNum
+		tEnd := tempLeafNum + l
+		/*Sort these grids based on width and height*/
+		sort.Slice(encodedCoordArray[tempLeafNum:tEnd], func(i, j int) bool {
+			return encodedCoordArray[tempLeafNum+i].less(encodedCoordArray[tempLeafNum+j])
+		})
+		wh := uint64(0)
+		w_ := 0
+		h_ := 0
+		/*Calculate the offsets for each grid in the naphil array*/
+		for j := tempLeafNum; j < tEnd; j++ {
+			indexArray[j] = tempIndex
+			enc := encodedCoordArray[j].dims
+			/*If a grid which will not have the same dimensions as
+			the one previous is found, re-extract dimensions.*/
+			if enc&0xFFFFFFFF != wh {
+				wh = enc & 0xFFFFFFFF
+				h_ = int(enc & 0xFFFF)
+				enc >>= 16
+				w_ = int(enc & 0xFFFF)
+			}
+			tempIndex += (w_ * h_)
+		}
+		tempLeafNum = tEnd
+	}
+	x1_ := 0
+	var m int
+	enc := encodedCoordArray[0].dims
+	encOld := uint64(0xFFFFFFFFFFFFFFFF)
+	imageEnd := trees[0].leafNum
+	x2_ := imageEnd
+	for x1_ < x2_ {
+		m = x1_ + ((x2_ - x1_) / 2)
+		if encodedCoordArray[m].dims != enc {
+			x2_ = m
+		} else {
+			x1_ = m + 1
+		}
+	}
+	for x1_ < totalLeafNum {
+		/*Put the result of the bin search into changeArray*/
+		changeArray = append(changeArray, x1_)
+		/*Check if the next section of the grids metadata referss to a different
+		source image*/
+		encOld = enc >> 32
+		if x1_ >= totalLeafNum {
+			panic("Out of bounds")
+		}
+		enc = encodedCoordArray[x1_].dims
+		if enc>>32 != encOld {
+			imageEnd += trees[enc>>32].leafNum
+			imageRuns[enc>>32] = len(changeArray) - 1
+		}
+		/*Set the end of the next bin search to the last grid to be taken from the
+		same source image*/
+		x2_ = imageEnd
+		/*Peform a binary search for the last grid with equal dimensions
+		and from the same source image as the one at x1_*/
+		for x1_ < x2_ {
+			m = x1_ + ((x2_ - x1_) / 2)
+			if encodedCoordArray[m].dims != enc {
+				x2_ = m
+			} else {
+				x1_ = m + 1
+			}
+		}
+	}
+	changeArray = append(changeArray, totalLeafNum)
+	imageRuns[len(trees)] = len(changeArray) - 1
+	/*Named after a race of mysterious beings mentioned in Genesis 6, later described of being
+	great stature in Numbers 32 and usually translated as "giants" in other languages. This will
+	indeed be a giant array.*/
+	imageDataNaphil := make([]uint8, indexArray[totalLeafNum-1]+(int(maxW)*int(maxH)))
+	progress.finish(totalLeafNum)
+
+	arrayFromImg := make([]Grid, totalLeafNum)
+	tempLeafNum = 0
+	progress = newProgressLog(LOG_NORMAL, "grid_generation", "Generating grids", len(trees))
+
+	margInt := uint8(margin * 256.0)
+
+	workerPool(len(trees), tNum, func(i int) {
+		i_64 := uint64(i)
+		/*Retrive the width of the image, store it as a signed value*/
+		imgW_64 := uint64(widthArray[i])
+		imgH_64 := uint64(heightArray[i])
+		imgW_signed := int(imgW_64)
+		/*Get a grayscale representation of the same image*/
+		pix_data := func(imagePaths []string, i int) []uint8 {
+			grayImg := gocv.IMRead(imagePaths[i], gocv.IMReadGrayScale)
+
+			if grayImg.Empty() {
+				panic("Error loading image")
+			}
+			defer grayImg.Close()
+
+			return grayImg.ToBytes()
+		}(imagePaths, i)
+		/*Find the part of the change array which refer to this image, set a loop to
+		these endpoints*/
+		cng_start := imageRuns[i]
+		cng_end := imageRuns[i+1]
+		for c_outer := cng_start; c_outer < cng_end; c_outer++ {
+			/*Get the encoded metadata for the first grid in the segment, and ignore
+			all bits besides those containing grid dimensions. Extract these dimensions
+			and save the 32 bits containing all of them for when the dimCornAvg of
+			individual grids is set.*/
+			enc_start := encodedCoordArray[changeArray[c_outer]].dims & 0xFFFFFFFF
+			h_64 := enc_start & 0xFFFF
+			h_signed := int(h_64)
+			h_16 := uint16(h_64)
+			w_64 := enc_start >> 16
+			w_signed := int(w_64)
+			w_16 := uint16(w_64)
+			/*Get the end of the loop for the current segment*/
+			loop_end := changeArray[c_outer+1]
+			area := w_64 * h_64
+			area_signed := h_signed * w_signed
+			var enc encodedCoord
+			var x1, y1, y2, sum, avg, dimCornAvg, crnr_64, corners uint64
+			var x1_signed, offset, offset_n, end_n, start_p, end_p /*, j, end*/ int
+			var y_offset, y2_signed int
+			var maxLuma, minLuma, crnr uint8
+			for c_sub := changeArray[c_outer]; c_sub < loop_end; c_sub++ {
+				/*Get the metadata for an individual grid*/
+				enc = encodedCoordArray[c_sub]
+				if (enc.dims >> 32) != i_64 {
+					panic("Wrong image")
+				}
+				if enc.dims&0xFFFFFFFF != enc_start {
+					panic("Wrong dimensions")
+				}
+				/*Extract the coordinates from the metadata*/
+				y1 = (^enc.pos) & 0xFFFFFFFF
+				x1 = (^enc.pos) >> 32
+				y2 = y1 + h_64
+				if y1 > imgH_64 || y2 > imgH_64 || x1 > imgW_64 || x1+w_64 > imgW_64 {
+					panic("Wrong coordinates")
+				}
+				y2_signed = int(y2)
+				x1_signed = int(x1)
+				offset = indexArray[c_sub]
+				/*The variables offset_n and end_n are endpoints of the naphil array. They increment by the grid's
+				width.*/
+				end_n = offset + w_signed
+				offset_n = offset
+				offset_end := offset + area_signed
+				y_offset = int(y1)
+				/*The variables start_p and end_p are endpoints of the array containing image data. They increment
+				by the image's width.*/
+				start_p = (int(y1) * imgW_signed) + x1_signed
+				end_p = start_p + w_signed
+				/*Copy data from the image into the naphil array*/
+				for y_offset < y2_signed {
+					copy(imageDataNaphil[offset_n:end_n], pix_data[start_p:end_p])
+					offset_n += w_signed
+					end_n += w_signed
+					start_p += imgW_signed
+					end_p += imgW_signed
+					y_offset++
+					if y_offset >= y2_signed {
+						break
+					}
+					copy(imageDataNaphil[offset_n:end_n], pix_data[start_p:end_p])
+					offset_n += w_signed
+					end_n += w_signed
+					start_p += imgW_signed
+					end_p += imgW_signed
+					y_offset++
+					if y_offset >= y2_signed {
+						break
+					}
+					copy(imageDataNaphil[offset_n:end_n], pix_data[start_p:end_p])
+					offset_n += w_signed
+					end_n += w_signed
+					start_p += imgW_signed
+					end_p += imgW_signed
+					y_offset++
+					if y_offset >= y2_signed {
+						break
+					}
+					copy(imageDataNaphil[offset_n:end_n], pix_data[start_p:end_p])
+					offset_n += w_signed
+					end_n += w_signed
+					start_p += imgW_signed
+					end_p += imgW_signed
+					y_offset++
+				}
+
+				/*Add the corners to the total sum, which will be used to calculate
+				the average later*/
+			minMaxLoopStart:
+				crnr = imageDataNaphil[offset]
+				maxLuma = crnr
+				minLuma = crnr
+				crnr_64 = uint64(crnr)
+				corners = crnr_64
+				sum = crnr_64
+				corners <<= 8
+
+				crnr = imageDataNaphil[offset+w_signed-1]
+				if crnr > maxLuma {
+					maxLuma = crnr
+				} else if crnr < minLuma {
+					minLuma = crnr
+				}
+				crnr_64 = uint64(crnr)
+				corners += crnr_64
+				sum += crnr_64
+				corners <<= 8
+
+				crnr = imageDataNaphil[offset_end-w_signed]
+				if crnr > maxLuma {
+					maxLuma = crnr
+				} else if crnr < minLuma {
+					minLuma = crnr
+				}
+				crnr_64 = uint64(crnr)
+				corners += crnr_64
+				sum += crnr_64
+				corners <<= 8
+
+				crnr = imageDataNaphil[offset_end-1]
+				if crnr > maxLuma {
+					maxLuma = crnr
+				} else if crnr < minLuma {
+					minLuma = crnr
+				}
+				crnr_64 = uint64(crnr)
+				corners += crnr_64
+				sum += crnr_64
+				/*Check for the minimum and maximum values of all pixels except the corners,
+				while adding them to the sum. A sweep is done for the top and bottom rows,
+				and another for everything else.*/
+				if minLuma != 0 || maxLuma != 255 {
+					minMaxSum_result := minMaxSum(imageDataNaphil, offset+1, offset+w_signed-1, minLuma, maxLuma)
+					sum += (minMaxSum_result & 0xFFFFFFFF)
+					minMaxSum_result >>= 32
+					minLuma = uint8(minMaxSum_result & 0xFF)
+					minMaxSum_result >>= 8
+					maxLuma = uint8(minMaxSum_result & 0xFF)
+				} else {
+					sum += sumNaphil(imageDataNaphil, offset+1, offset+w_signed-1)
+				}
+				if minLuma != 0 || maxLuma != 255 {
+					minMaxSum_result := minMaxSum(imageDataNaphil, offset_end-w_signed+1, offset_end-1, minLuma, maxLuma)
+					sum += (minMaxSum_result & 0xFFFFFFFF)
+					minMaxSum_result >>= 32
+					minLuma = uint8(minMaxSum_result & 0xFF)
+					minMaxSum_result >>= 8
+					maxLuma = uint8(minMaxSum_result & 0xFF)
+				} else {
+					sum += sumNaphil(imageDataNaphil, offset_end-w_signed+1, offset_end-1)
+				}
+				if minLuma != 0 || maxLuma != 255 {
+					minMaxSum_result := minMaxSum(imageDataNaphil, offset+w_signed, offset_end-w_signed, minLuma, maxLuma)
+					sum += (minMaxSum_result & 0xFFFFFFFF)
+					minMaxSum_result >>= 32
+					minLuma = uint8(minMaxSum_result & 0xFF)
+					minMaxSum_result >>= 8
+					maxLuma = uint8(minMaxSum_result & 0xFF)
+				} else {
+					sum += sumNaphil(imageDataNaphil, offset+w_signed, offset_end-w_signed)
+				}
+
+				/*Calculate the average*/
+				avg = sum / area
+				if avg > 255 {
+					panic("Invalid average.")
+				}
+				if uint8(avg) < minLuma || uint8(avg) > maxLuma {
+					goto minMaxLoopStart
+				}
+
+				/*The main purpose of dimCornAvg is for sorting. The intended algorithm is to sort all
+				"shallow" grids (those with relatively low differences between min and max values) at
+				the beginning, before all "deep" grids (those with relatively high differences). Then,
+				the grids are to be sorted by width, height, average luma, and finally their corners.
+				Since the actual difference between min and max is less important than the binary
+				"deep-shallow" distinction, "deep" grids have the lower of the top two bits set.*/
+				dimCornAvg = uint64(0)
+				if maxLuma-minLuma > margInt {
+					dimCornAvg = 1
+				}
+				dimCornAvg <<= 11
+				dimCornAvg += w_64
+				dimCornAvg <<= 11
+				dimCornAvg += h_64
+				dimCornAvg <<= 8
+				dimCornAvg += avg
+				dimCornAvg <<= 32
+				dimCornAvg += corners
+				func() {
+					arrayFromImg[c_sub] = Grid{
+						w__:        w_16,
+						h__:        h_16,
+						minLuma:    minLuma,
+						maxLuma:    maxLuma,
+						avgLuma:    uint8(avg),
+						dimCornAvg: dimCornAvg,
+						offset:     offset,
+						priority:   DEFAULT_PRIORITY,
+						source:     uint32(i),
+					}
+				}()
+			}
+		}
+		progress.add(1)
+	})
+	progress.finish(totalLeafNum)
+
+	progress = newProgressLog(LOG_NORMAL, "sorting", "Sorting grids", totalLeafNum)
+	parallelSort(arrayFromImg, tNum)
+	progress.finish(totalLeafNum)
+
+	if margin > 0 {
+		arrayFromImg = removeRedundantGrids(arrayFromImg, margin, tNum, imageDataNaphil, LOG_NORMAL)
+	}
+	return arrayFromImg, imageDataNaphil, imageInfo
+}
+
+/*
+Estimates the memory needed to build a dataset from an image with the
+given dimensions: the image itself, its pixels in the naphil array, and
+the metadata of as many grids as could fit in it.
+*/
+func estimateBuildMemory(w int, h int, minW uint64, minH uint64) int64 {
+	area := int64(w) * int64(h)
+	leafNum := area / int64(minW*minH)
+	leafSize := int64(unsafe.Sizeof(Grid{})) + 104
+	return (2 * area) + (leafNum * leafSize)
+}
+
+/*
+Parses an amount of memory in bytes, optionally followed by K, M, or G
+for kibibytes, mebibytes, or gibibytes.
+*/
+func parseMemory(amount string) (int64, error) {
+	multiplier := int64(1)
+	switch strings.ToUpper(amount[len(amount)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		amount = amount[:len(amount)-1]
+	}
+	n, err := strconv.ParseInt(amount, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 {
+		return 0, fmt.Errorf("memory %s is not positive", amount)
+	}
+	return n * multiplier, nil
+}
+
+/*
+Parses a grid dimension given either as one number for both the width
+and height, or as a width and height separated by an x, such as 4x12.
+Returns the width and then the height.
+*/
+func parseDims(dims string) (uint64, uint64, error) {
+	wStr, hStr, found := strings.Cut(strings.ToLower(dims), "x")
+	if !found {
+		hStr = wStr
+	}
+	w, err := strconv.ParseUint(wStr, 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	h, err := strconv.ParseUint(hStr, 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	if w < 1 || h < 1 || w > MAX_DIM || h > MAX_DIM {
+		return 0, 0, fmt.Errorf("dimensions %s are not between 1 and %d", dims, MAX_DIM)
+	}
+	return w, h, nil
+}
+
+/*
+A sorted run of grids spilled to disk by a streaming build. Its grids are
+read from the index a block at a time, starting with the grid at next,
+whose pixels start at pixel.
+*/
+type datasetRun struct {
+	name       string
+	data       []uint8
+	index      []uint8
+	indexStart int
+	count      int
+	next       int
+	pixel      int
+	info       datasetInfo
+	release    func() error
+}
+
+/*Opens a run written by writeToFile without compression.*/
+func openRun(fName string) (*datasetRun, error) {
+	data, release, err := loadFile(fName)
+	if err != nil {
+		return nil, err
+	}
+	version, cursor, size, info, err := readHeader(fName, data)
+	if err == nil && (version != INDEXED_VERSION || size > uint64(len(data)-cursor)/INDEX_ENTRY_LEN) {
+		err = fmt.Errorf("%s is not a run of a streaming build", fName)
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+	indexEnd := cursor + (INDEX_ENTRY_LEN * int(size))
+	return &datasetRun{name: fName, data: data, index: data[cursor:indexEnd], indexStart: cursor, count: int(size), pixel: indexEnd, info: info, release: release}, nil
+}
+
+/*
+The block of a grid in a run: whether the grid is deep, then its width and
+height. Runs are sorted by block, as they are by dimCornAvg.
+*/
+func (r *datasetRun) block(i int, margInt uint8) uint32 {
+	w, h, lumas := indexEntry(r.index[INDEX_ENTRY_LEN*i:], INDEXED_VERSION)
+	deep := uint32(0)
+	if lumas[2]-lumas[1] > margInt {
+		deep = 1
+	}
+	return (deep << 22) | (uint32(w) << 11) | uint32(h)
+}
+
+/*
+Merges sorted runs into one dataset, a block of grids with the same
+dimensions and depth at a time, removing grids from different runs that
+are redundant with each other. Only one block is held in memory at once,
+and the pixels of the merged grids are written to a file beside the
+dataset before being copied after its index.
+*/
+func mergeRuns(runNames []string, fName string, info datasetInfo, margin float64, tNum int) error {
+	margInt := uint8(margin * 256.0)
+	runs := make([]*datasetRun, 0, len(runNames))
+	defer func() {
+		for _, run := range runs {
+			run.release()
+		}
+	}()
+	totalNum := 0
+	for _, runName := range runNames {
+		run, err := openRun(runName)
+		if err != nil {
+			return err
+		}
+		runs = append(runs, run)
+		totalNum += run.count
+	}
+	pixelName := fName + ".pixels"
+	pixelFile, err := os.Create(pixelName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(pixelName)
+	defer pixelFile.Close()
+	pixelWriter := bufio.NewWriter(pixelFile)
+	index := make([]byte, 0)
+	mergedNum := 0
+	progress := newProgressLog(LOG_NORMAL, "merging", "Merging chunks", totalNum)
+	for {
+		/*Find the lowest block that any run has left*/
+		found := false
+		block := uint32(0)
+		for _, run := range runs {
+			if run.next < run.count && (!found || run.block(run.next, margInt) < block) {
+				block = run.block(run.next, margInt)
+				found = true
+			}
+		}
+		if !found {
+			break
+		}
+
+		/*Gather the block from every run*/
+		blockArray := make([]Grid, 0)
+		blockNaphil := make([]uint8, 0)
+		for _, run := range runs {
+			n := 0
+			for run.next+n < run.count && run.block(run.next+n, margInt) == block {
+				n++
+			}
+			if n == 0 {
+				continue
+			}
+			grids := make([]Grid, n)
+			err = readIndex(run.name, grids, run.index[INDEX_ENTRY_LEN*run.next:INDEX_ENTRY_LEN*(run.next+n)], run.indexStart+(INDEX_ENTRY_LEN*run.next), run.pixel, len(run.data), run.info, INDEXED_VERSION)
+			if err != nil {
+				return err
+			}
+			for _, g := range grids {
+				area := int(g.getW()) * int(g.getH())
+				blockNaphil = append(blockNaphil, run.data[g.offset:g.offset+area]...)
+				g.offset = len(blockNaphil) - area
+				if block>>22 != 0 {
+					g.dimCornAvg |= DEEP_64
+				}
+				blockArray = append(blockArray, g)
+				run.pixel += area
+			}
+			run.next += n
+		}
+		progress.add(len(blockArray))
+
+		/*Remove redundant grids from the block*/
+		sort.Slice(blockArray, func(i, j int) bool {
+			return blockArray[i].dimCornAvg < blockArray[j].dimCornAvg
+		})
+		if margin > 0 && len(runs) > 1 && len(blockArray) > 1 {
+			blockArray = removeRedundantGrids(blockArray, margin, tNum, blockNaphil, LOG_VERBOSE)
+		}
+		for _, g := range blockArray {
+			area := int(g.getW()) * int(g.getH())
+			pixels := blockNaphil[g.offset : g.offset+area]
+			entry := make([]byte, INDEX_ENTRY_LEN)
+			putIndexEntry(entry, g, pixels)
+			index = append(index, entry...)
+			_, err = pixelWriter.Write(pixels)
+			if err != nil {
+				return err
+			}
+		}
+		mergedNum += len(blockArray)
+	}
+	progress.finish(mergedNum)
+	err = pixelWriter.Flush()
+	if err != nil {
+		return err
+	}
+
+	/*Write the header and index, then the pixels after them*/
+	header, err := datasetHeader(info, mergedNum)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(fName)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = out.Write(header)
+	if err == nil {
+		_, err = out.Write(index)
+	}
+	if err == nil {
+		_, err = pixelFile.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		_, err = io.Copy(out, pixelFile)
+	}
+	return err
+}
+
+/*
+Creates a dataset from images like buildFromImages, but without holding
+every image in memory at once. Images are split into chunks needing at
+most maxMemory bytes by estimate, and each chunk is built and has its
+redundant grids removed before being spilled to disk as a sorted run.
+The runs are then merged block by block. The pixels of the finished
+dataset are mapped from a temporary file rather than held in memory, so
+the function returned, which unmaps and deletes it, must only be called
+once they are no longer used.
+*/
+func buildFromImagesStreaming(imagePaths []string, minW uint64, maxW uint64, minH uint64, maxH uint64, margin float64, tNum int, maxMemory int64) ([]Grid, []uint8, datasetInfo, func() error, error) {
+	imageInfo := newDatasetInfo(minW, maxW, minH, maxH, margin)
+	for _, imgName := range imagePaths {
+		imageInfo.Sources = append(imageInfo.Sources, sourceInfo{Name: imgName, Priority: DEFAULT_PRIORITY})
+	}
+	tempDir, err := os.MkdirTemp("", "luma")
+	if err != nil {
+		return nil, nil, imageInfo, nil, err
+	}
+	/*The temporary files are kept if the dataset is returned, until it is released*/
+	kept := false
+	defer func() {
+		if !kept {
+			os.RemoveAll(tempDir)
+		}
+	}()
+
+	/*Split the images into chunks which fit in memory, with at least one
+	image in each*/
+	chunkStarts := []int{0}
+	chunkMemory := int64(0)
+	for i, imgName := range imagePaths {
+		f, err := os.Open(imgName)
+		if err != nil {
+			return nil, nil, imageInfo, nil, err
+		}
+		config, _, err := image.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, imageInfo, nil, fmt.Errorf("error reading %s: %w", imgName, err)
+		}
+		imageMemory := estimateBuildMemory(config.Width, config.Height, minW, minH)
+		if i > chunkStarts[len(chunkStarts)-1] && chunkMemory+imageMemory > maxMemory {
+			chunkStarts = append(chunkStarts, i)
+			chunkMemory = 0
+		}
+		chunkMemory += imageMemory
+	}
+	chunkStarts = append(chunkStarts, len(imagePaths))
+
+	/*Build each chunk and spill it to disk*/
+	runNames := make([]string, 0, len(chunkStarts)-1)
+	for c := 0; c < len(chunkStarts)-1; c++ {
+		logMessage(fmt.Sprintf("Building chunk %d of %d", c+1, len(chunkStarts)-1))
+		chunkArray, chunkNaphil, _ := buildFromImages(imagePaths[chunkStarts[c]:chunkStarts[c+1]], minW, maxW, minH, maxH, margin, tNum)
+		for i := range chunkArray {
+			chunkArray[i].source += uint32(chunkStarts[c])
+		}
+		runName := filepath.Join(tempDir, fmt.Sprintf("run_%04d.dat", c))
+		err = writeToFile(chunkArray, len(chunkArray), runName, chunkNaphil, imageInfo, false)
+		if err != nil {
+			return nil, nil, imageInfo, nil, err
+		}
+		runNames = append(runNames, runName)
+	}
+
+	mergedName := filepath.Join(tempDir, "merged.dat")
+	err = mergeRuns(runNames, mergedName, imageInfo, margin, tNum)
+	if err != nil {
+		return nil, nil, imageInfo, nil, err
+	}
+	/*The runs are merged, so only the merged dataset needs to stay*/
+	for _, runName := range runNames {
+		os.Remove(runName)
+	}
+
+	/*Mark deep grids and sort, as buildFromImages leaves them*/
+	array, naphilArray, _, unmap, err := readFromFile(mergedName)
+	if err != nil {
+		return nil, nil, imageInfo, nil, err
+	}
+	kept = true
+	release := func() error {
+		err := unmap()
+		os.RemoveAll(tempDir)
+		return err
+	}
+	margInt := uint8(margin * 256.0)
+	for i := range array {
+		if array[i].maxLuma-array[i].minLuma > margInt {
+			array[i].dimCornAvg |= DEEP_64
+		}
+	}
+	parallelSort(array, tNum)
+	return array, naphilArray, imageInfo, release, nil
+}
+
+/*
+The dimensions and average luma of a grid, packed so that comparing them
+orders grids the same way a dataset written by this program is ordered.
+*/
+func dimAvgKey(g Grid) uint32 {
+	return (uint32(g.getW()) << 19) | (uint32(g.getH()) << 8) | uint32(g.avgLuma)
+}
+
+/*
+Sorts the grids of a dataset by dimensions and average luma, which
+datasets written by older versions of this program may not be sorted by.
+Grids already sorted are left as they are.
+*/
+func sortByDimAvg(array []Grid) {
+	if !slices.IsSortedFunc(array, func(a, b Grid) int { return cmp.Compare(dimAvgKey(a), dimAvgKey(b)) }) {
+		sort.SliceStable(array, func(i, j int) bool {
+			return dimAvgKey(array[i]) < dimAvgKey(array[j])
+		})
+	}
+}
+
+/*
+Checks whether two grids of equal dimensions are redundant with each
+other by the same standard removeRedundantGrids uses. Their corners must
+be within the margin of each other, and then shallow grids must differ by
+no more than the margin on average, while deep grids must differ by less
+than the margin at every pixel. Shallow and deep grids are never
+redundant with each other.
+*/
+func gridsRedundant(g1 Grid, g2 Grid, naphilArray1 []uint8, naphilArray2 []uint8, margInt uint8) bool {
+	w := int(g1.getW())
+	area := w * int(g1.getH())
+	deep1 := g1.maxLuma-g1.minLuma > margInt
+	deep2 := g2.maxLuma-g2.minLuma > margInt
+	if deep1 != deep2 {
+		return false
+	}
+	pixels1 := naphilArray1[g1.offset : g1.offset+area]
+	pixels2 := naphilArray2[g2.offset : g2.offset+area]
+	for _, c := range [4]int{0, w - 1, area - w, area - 1} {
+		if byteAbsDiff(pixels1[c], pixels2[c]) > margInt {
+			return false
+		}
+	}
+	if deep1 {
+		for i := range pixels1 {
+			if byteAbsDiff(pixels1[i], pixels2[i]) >= margInt {
+				return false
+			}
+		}
+		return true
+	}
+	sum := 0
+	maxSum := area * int(margInt)
+	for i := range pixels1 {
+		sum += int(byteAbsDiff(pixels1[i], pixels2[i]))
+		if sum > maxSum {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Adds new grids to a dataset sorted by dimensions and average luma, as
+every dataset written by this program is. Each new grid is only compared
+with existing grids of the same dimensions and an average within the
+margin, which are found with binary searches, so the time taken depends
+on the number of new grids rather than the size of the dataset. When a
+new grid is redundant with an existing one, the existing one stays unless
+the new one has a higher priority. The pixels of the new grids are in
+newNaphil rather than naphilArray, so that a dataset which is mapped into
+memory is never copied, and the new grids that are added are given
+offsets past the end of naphilArray, as writeSplitToFile expects. The
+result is sorted the same way. Returns the combined grids and the number
+of new grids that were added.
+*/
+func appendGrids(array []Grid, newArray []Grid, naphilArray []uint8, newNaphil []uint8, margin float64) ([]Grid, int) {
+	margInt := uint8(margin * 256.0)
+	m_32 := uint32(margInt)
+	replaced := make([]bool, len(array))
+	added := make([]Grid, 0, len(newArray))
+	for _, g := range newArray {
+		key := dimAvgKey(g)
+		lo := key - min(m_32, key&255)
+		hi := key + min(m_32, 255-(key&255))
+		j, _ := slices.BinarySearchFunc(array, lo, func(e Grid, k uint32) int {
+			return cmp.Compare(dimAvgKey(e), k)
+		})
+		/*The new grid only replaces the grids it is redundant with if it
+		has a higher priority than all of them, and otherwise leaves them
+		all be.*/
+		redundant := false
+		var matches []int
+		for ; j < len(array) && dimAvgKey(array[j]) <= hi; j++ {
+			if replaced[j] || !gridsRedundant(g, array[j], newNaphil, naphilArray, margInt) {
+				continue
+			}
+			if g.priority <= array[j].priority {
+				redundant = true
+				break
+			}
+			matches = append(matches, j)
+		}
+		if !redundant {
+			for _, k := range matches {
+				replaced[k] = true
+			}
+			g.offset += len(naphilArray)
+			added = append(added, g)
+		}
+	}
+	sort.SliceStable(added, func(i, j int) bool {
+		return dimAvgKey(added[i]) < dimAvgKey(added[j])
+	})
+
+	/*Merge the new grids into the existing ones, leaving out those replaced*/
+	merged := make([]Grid, 0, len(array)+len(added))
+	i, j := 0, 0
+	for i < len(array) || j < len(added) {
+		if i < len(array) && replaced[i] {
+			i++
+		} else if j >= len(added) || (i < len(array) && dimAvgKey(array[i]) <= dimAvgKey(added[j])) {
+			merged = append(merged, array[i])
+			i++
+		} else {
+			merged = append(merged, added[j])
+			j++
+		}
+	}
+	return merged, len(added)
+}
+
+/*
+The append command, which adds grids from new images to an existing
+dataset without rebuilding it. The grids are made with the dimensions and
+margin the dataset was built with, unless given others.
+*/
+func appendMain(args []string) {
+	paths := make([]string, 0)
+	var minW, maxW, minH, maxH uint64
+	margin := float64(-1)
+	priority := DEFAULT_PRIORITY
+	tNum := 1
+	compress := false
+	var err error
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--compress" {
+			compress = true
+			continue
+		}
+		if !strings.HasPrefix(arg, "-") {
+			paths = append(paths, arg)
+			continue
+		}
+		if i+1 >= len(args) {
+			logError("Please specify a value for " + arg)
+			return
+		}
+		value := args[i+1]
+		i++
+		switch arg {
+		case "--min":
+			minW, minH, err = parseDims(value)
+		case "--max":
+			maxW, maxH, err = parseDims(value)
+		case "--margin":
+			margin, err = strconv.ParseFloat(value, 64)
+		case "--priority":
+			var p uint64
+			p, err = strconv.ParseUint(value, 10, 8)
+			priority = uint8(p)
+		case "-t":
+			tNum, err = strconv.Atoi(value)
+			if err == nil && tNum < 1 {
+				err = fmt.Errorf("thread number %s is not positive", value)
+			}
+		default:
+			err = fmt.Errorf("unknown option %s", arg)
+		}
+		if err != nil {
+			logError("Please specify valid options for append.")
+			log.Fatal(err)
+			return
+		}
+	}
+	if len(paths) < 3 {
+		logError("Please specify an existing dataset, an output dataset, and at least one new image.")
+		return
+	}
+	logFile("load", paths[0], "Adding data from "+paths[0])
+	array, naphilArray, info, release, err := readFromFile(paths[0])
+	if err != nil {
+		logError("Please specify a valid existing dataset.")
+		log.Fatal(err)
+		return
+	}
+	defer release()
+	infoMinH, infoMaxH := info.heightBounds()
+	if minW == 0 && info.MinW > 0 && infoMinH > 0 {
+		minW, minH = uint64(info.MinW), uint64(infoMinH)
+	}
+	if maxW == 0 && info.MaxW > 0 && infoMaxH > 0 {
+		maxW, maxH = uint64(info.MaxW), uint64(infoMaxH)
+	}
+	if margin < 0 {
+		margin = info.Margin
+	}
+	if minW < 1 || minH < 1 || maxW > MAX_DIM || maxH > MAX_DIM || maxW < minW*2 || maxH < minH*2 || margin < 0 {
+		logError(fmt.Sprintf("Please specify minimum and maximum grid dimensions and margin with --min, --max and --margin, since the dataset did not record valid ones. The maximum must be at least twice the minimum in both width and height, and no more than %d.", MAX_DIM))
+		return
+	}
+
+	sortByDimAvg(array)
+
+	newArray, newNaphil, newInfo := buildFromImages(paths[2:], minW, maxW, minH, maxH, margin, tNum)
+	for i := range newInfo.Sources {
+		newInfo.Sources[i].Priority = priority
+	}
+	for i := range newArray {
+		newArray[i].priority = priority
+	}
+	info = mergeDatasetInfo(info, newInfo, newArray, info.Margin)
+
+	progress := newProgressLog(LOG_NORMAL, "dedup", "Removing grids redundant with the existing dataset", len(newArray))
+	merged, addedNum := appendGrids(array, newArray, naphilArray, newNaphil, margin)
+	progress.add(len(newArray))
+	progress.finish(addedNum)
+
+	progress = newProgressLog(LOG_NORMAL, "writing", "Writing to file", len(merged))
+	err = writeSplitToFile(merged, len(merged), paths[1], naphilArray, newNaphil, info, compress)
+	progress.finish(len(merged))
+	if err != nil {
+		logError("Error writing dataset")
+		log.Fatal(err)
+		return
+	}
+	fmt.Printf("Added %d of %d new fragments, %d fragments in total\n", addedNum, len(newArray), len(merged))
+}
+
+/*The number of grids of one size in a dataset.*/
+type dimensionCount struct {
+	W     uint16 `json:"w"`
+	H     uint16 `json:"h"`
+	Count int    `json:"count"`
+}
+
+/*The number of grids in a dataset from one of its sources.*/
+type sourceCount struct {
+	sourceInfo
+	Count int `json:"count"`
+}
+
+/*Everything the inspect command reports about a dataset.*/
+type inspectReport struct {
+	File             string           `json:"file"`
+	Fragments        int              `json:"fragments"`
+	Dimensions       []dimensionCount `json:"dimensions"`
+	AvgLumaHistogram [256]int         `json:"avgLumaHistogram"`
+	RangeHistogram   [256]int         `json:"rangeHistogram"`
+	Margin           float64          `json:"margin"`
+	Shallow          int              `json:"shallow"`
+	Deep             int              `json:"deep"`
+	FileBytes        int64            `json:"fileBytes"`
+	PixelBytes       int64            `json:"pixelBytes"`
+	MetadataBytes    int64            `json:"metadataBytes"`
+	MemoryBytes      int64            `json:"memoryBytes"`
+	BuildRecorded    bool             `json:"buildRecorded"`
+	MinW             int              `json:"minW,omitempty"`
+	MaxW             int              `json:"maxW,omitempty"`
+	MinH             int              `json:"minH,omitempty"`
+	MaxH             int              `json:"maxH,omitempty"`
+	Sources          []sourceCount    `json:"sources"`
+}
+
+/*
+Gathers statistics about a dataset. Grids with a difference between their
+maximum and minimum luma above the margin count as deep, the same way
+they are marked in dimCornAvg before redundant grids are removed.
+*/
+func inspectDataset(fName string, array []Grid, info datasetInfo, margin float64) inspectReport {
+	report := inspectReport{
+		File:          fName,
+		Fragments:     len(array),
+		Margin:        margin,
+		BuildRecorded: info.MinW != 0,
+		MinW:          info.MinW,
+		MaxW:          info.MaxW,
+	}
+	report.MinH, report.MaxH = info.heightBounds()
+	if fStat, err := os.Stat(fName); err == nil {
+		report.FileBytes = fStat.Size()
+	}
+	report.Sources = make([]sourceCount, len(info.Sources))
+	for i := range info.Sources {
+		report.Sources[i].sourceInfo = info.Sources[i]
+	}
+	margInt := uint8(256.0 * margin)
+	dimCounts := make(map[uint32]int)
+	for _, g := range array {
+		dimCounts[(uint32(g.getW())<<16)|uint32(g.getH())]++
+		report.AvgLumaHistogram[g.avgLuma]++
+		report.RangeHistogram[g.maxLuma-g.minLuma]++
+		if g.maxLuma-g.minLuma > margInt {
+			report.Deep++
+		} else {
+			report.Shallow++
+		}
+		report.PixelBytes += int64(g.getW()) * int64(g.getH())
+		if int(g.source) < len(report.Sources) {
+			report.Sources[g.source].Count++
+		}
+	}
+	dims := make([]uint32, 0, len(dimCounts))
+	for d := range dimCounts {
+		dims = append(dims, d)
+	}
+	slices.Sort(dims)
+	for _, d := range dims {
+		report.Dimensions = append(report.Dimensions, dimensionCount{W: uint16(d >> 16), H: uint16(d), Count: dimCounts[d]})
+	}
+	report.MetadataBytes = int64(len(array)) * int64(unsafe.Sizeof(Grid{}))
+	report.MemoryBytes = report.PixelBytes + report.MetadataBytes
+	return report
+}
+
+/*Prints an inspection report in human-readable format.*/
+func printInspectReport(report inspectReport) {
+	fmt.Printf("Dataset:	%s\n", report.File)
+	fmt.Printf("Fragments:	%d\n", report.Fragments)
+	if report.BuildRecorded {
+		fmt.Printf("Built with:	dimensions %dx%d to %dx%d, margin %g\n", report.MinW, report.MinH, report.MaxW, report.MaxH, report.Margin)
+	} else {
+		fmt.Println("Built with:	not recorded")
+	}
+	fmt.Printf("Memory:	%d bytes on disk, %d bytes in memory (%d of pixels, %d of metadata)\n", report.FileBytes, report.MemoryBytes, report.PixelBytes, report.MetadataBytes)
+	fmt.Printf("Shallow/deep split at margin %g:	%d shallow, %d deep\n", report.Margin, report.Shallow, report.Deep)
+	fmt.Println("Sources:")
+	for _, src := range report.Sources {
+		fmt.Printf("	%s	priority %d	%d fragments\n", src.Name, src.Priority, src.Count)
+	}
+	fmt.Println("Fragments per dimension:")
+	for _, d := range report.Dimensions {
+		fmt.Printf("	%dx%d	%d\n", d.W, d.H, d.Count)
+	}
+	fmt.Println("Average luma histogram:")
+	for i := 0; i < 256; i += 16 {
+		count := 0
+		for _, c := range report.AvgLumaHistogram[i : i+16] {
+			count += c
+		}
+		fmt.Printf("	%d-%d	%d\n", i, i+15, count)
+	}
+	fmt.Println("Range histogram:")
+	for i := 0; i < 256; i += 16 {
+		count := 0
+		for _, c := range report.RangeHistogram[i : i+16] {
+			count += c
+		}
+		fmt.Printf("	%d-%d	%d\n", i, i+15, count)
+	}
+}
+
+/*
+The inspect command, which reports what is inside one or more datasets.
+The margin used to split shallow and deep grids is the one the dataset
+was built with, unless given by --margin or never recorded.
+*/
+func inspectMain(args []string) {
+	fileNames := make([]string, 0)
+	asJSON := false
+	margin := float64(-1)
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--json" {
+			asJSON = true
+		} else if args[i] == "--margin" && i+1 < len(args) {
+			m, err := strconv.ParseFloat(args[i+1], 64)
+			if err != nil {
+				logError("Please specify a number for the margin.")
+				log.Fatal(err)
+				return
+			}
+			margin = m
+			i++
+		} else {
+			fileNames = append(fileNames, args[i])
+		}
+	}
+	if len(fileNames) == 0 {
+		logError("Please specify one or more datasets to inspect.")
+		return
+	}
+	reports := make([]inspectReport, 0, len(fileNames))
+	for _, fName := range fileNames {
+		array, _, info, release, err := readFromFile(fName)
+		if err != nil {
+			logError("Please specify valid filenames for all datasets.")
+			log.Fatal(err)
+			return
+		}
+		release()
+		m := margin
+		if m < 0 {
+			m = info.Margin
+			if m <= 0 {
+				m = 0.05
+			}
+		}
+		reports = append(reports, inspectDataset(fName, array, info, m))
+	}
+	if asJSON {
+		out, err := json.MarshalIndent(reports, "", "	")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(out))
+		return
+	}
+	for i, report := range reports {
+		if i > 0 {
+			fmt.Println()
+		}
+		printInspectReport(report)
+	}
+}
+
+/*How a grid of one dataset compares with the grids of another.*/
+const (
+	MATCH_NONE  uint8 = 0
+	MATCH_NEAR  uint8 = 1
+	MATCH_EXACT uint8 = 2
+)
+
+/*The width of the bands of average luma the compare command reports by.*/
+const COMPARE_BAND = 16
+
+/*
+How the grids of one dimension and band of average luma in one dataset
+compare with another dataset: how many have an exact copy there, and how
+many more are redundant with one of its grids at the margin.
+*/
+type compareBand struct {
+	W         uint16 `json:"w"`
+	H         uint16 `json:"h"`
+	AvgMin    int    `json:"avgMin"`
+	AvgMax    int    `json:"avgMax"`
+	Fragments int    `json:"fragments"`
+	Exact     int    `json:"exact"`
+	Near      int    `json:"near"`
+}
+
+/*Everything the compare command reports about two datasets.*/
+type compareReport struct {
+	A          string        `json:"a"`
+	B          string        `json:"b"`
+	Margin     float64       `json:"margin"`
+	FragmentsA int           `json:"fragmentsA"`
+	FragmentsB int           `json:"fragmentsB"`
+	Exact      int           `json:"exact"`
+	Near       int           `json:"near"`
+	Unique     int           `json:"unique"`
+	Bands      []compareBand `json:"bands"`
+}
+
+/*
+Finds which grids of array1 have an exact copy in array2, and which are
+redundant with one of its grids by the same standard removeRedundantGrids
+and combineArrays use. array2 must be sorted by dimensions and average
+luma, so that each grid is only compared with grids of the same
+dimensions and an average within the margin, found with binary searches.
+Returns MATCH_NONE, MATCH_NEAR or MATCH_EXACT for every grid of array1.
+*/
+func matchGrids(array1 []Grid, naphilArray1 []uint8, array2 []Grid, naphilArray2 []uint8, margin float64, tNum int, progress *progressLog) []uint8 {
+	margInt := uint8(margin * 256.0)
+	m_32 := uint32(margInt)
+	matches := make([]uint8, len(array1))
+	size, count := chunkSize(len(array1), tNum, 1024)
+	workerPool(count, tNum, func(c int) {
+		end := min((c+1)*size, len(array1))
+		for i := c * size; i < end; i++ {
+			g := array1[i]
+			area := int(g.getW()) * int(g.getH())
+			pixels := naphilArray1[g.offset : g.offset+area]
+			key := dimAvgKey(g)
+			lo := key - min(m_32, key&255)
+			hi := key + min(m_32, 255-(key&255))
+			j, _ := slices.BinarySearchFunc(array2, lo, func(e Grid, k uint32) int {
+				return cmp.Compare(dimAvgKey(e), k)
+			})
+			for ; j < len(array2) && dimAvgKey(array2[j]) <= hi; j++ {
+				g2 := array2[j]
+				if g2.avgLuma == g.avgLuma && bytes.Equal(pixels, naphilArray2[g2.offset:g2.offset+area]) {
+					matches[i] = MATCH_EXACT
+					break
+				}
+				if matches[i] == MATCH_NONE && gridsRedundant(g, g2, naphilArray1, naphilArray2, margInt) {
+					matches[i] = MATCH_NEAR
+				}
+			}
+		}
+		progress.add(end - c*size)
+	})
+	return matches
+}
+
+/*
+Totals how the grids of a dataset matched another, overall and by
+dimensions and band of average luma.
+*/
+func compareDatasets(nameA string, nameB string, arrayA []Grid, fragmentsB int, matches []uint8, margin float64) compareReport {
+	report := compareReport{A: nameA, B: nameB, Margin: margin, FragmentsA: len(arrayA), FragmentsB: fragmentsB}
+	bands := make(map[uint32]*compareBand)
+	for i, g := range arrayA {
+		key := (uint32(g.getW()) << 19) | (uint32(g.getH()) << 8) | uint32(g.avgLuma/COMPARE_BAND)
+		band := bands[key]
+		if band == nil {
+			lo := int(g.avgLuma/COMPARE_BAND) * COMPARE_BAND
+			band = &compareBand{W: g.getW(), H: g.getH(), AvgMin: lo, AvgMax: lo + COMPARE_BAND - 1}
+			bands[key] = band
+		}
+		band.Fragments++
+		switch matches[i] {
+		case MATCH_EXACT:
+			band.Exact++
+			report.Exact++
+		case MATCH_NEAR:
+			band.Near++
+			report.Near++
+		default:
+			report.Unique++
+		}
+	}
+	keys := make([]uint32, 0, len(bands))
+	for k := range bands {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		report.Bands = append(report.Bands, *bands[k])
+	}
+	return report
+}
+
+/*Prints a comparison report in human-readable format.*/
+func printCompareReport(report compareReport) {
+	percent := func(n int) float64 {
+		return 100.0 * float64(n) / float64(max(1, report.FragmentsA))
+	}
+	fmt.Printf("Compared:	%s with %s\n", report.A, report.B)
+	fmt.Printf("Fragments:	%d in %s, %d in %s\n", report.FragmentsA, report.A, report.FragmentsB, report.B)
+	fmt.Printf("Margin:	%g\n", report.Margin)
+	fmt.Printf("Exact copies:	%d (%.1f%%)\n", report.Exact, percent(report.Exact))
+	fmt.Printf("Redundant at the margin:	%d (%.1f%%)\n", report.Near, percent(report.Near))
+	fmt.Printf("Only in %s:	%d (%.1f%%)\n", report.A, report.Unique, percent(report.Unique))
+	fmt.Println("By dimension and average luma:	fragments	exact	redundant	only in " + report.A)
+	for _, b := range report.Bands {
+		fmt.Printf("	%dx%d	%d-%d	%d	%d	%d	%d\n", b.W, b.H, b.AvgMin, b.AvgMax, b.Fragments, b.Exact, b.Near, b.Fragments-b.Exact-b.Near)
+	}
+}
+
+/*
+The compare command, which reports how many grids of one dataset are
+redundant with another before they are merged, and can write the grids
+of the first which are not, and those which are. The margin is the one
+the first dataset was built with, unless given by --margin.
+*/
+func compareMain(args []string) {
+	paths := make([]string, 0)
+	margin := float64(-1)
+	asJSON := false
+	compress := false
+	minusName, intersectName := "", ""
+	tNum := 1
+	var err error
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--json" {
+			asJSON = true
+			continue
+		}
+		if arg == "--compress" {
+			compress = true
+			continue
+		}
+		if !strings.HasPrefix(arg, "-") {
+			paths = append(paths, arg)
+			continue
+		}
+		if i+1 >= len(args) {
+			logError("Please specify a value for " + arg)
+			return
+		}
+		value := args[i+1]
+		i++
+		switch arg {
+		case "--margin":
+			margin, err = strconv.ParseFloat(value, 64)
+			if err == nil && (margin < 0 || margin >= 1) {
+				err = fmt.Errorf("margin %s is not between 0 and 1", value)
+			}
+		case "--minus":
+			minusName = value
+		case "--intersect":
+			intersectName = value
+		case "-t":
+			tNum, err = strconv.Atoi(value)
+			if err == nil && tNum < 1 {
+				err = fmt.Errorf("thread number %s is not positive", value)
+			}
+		default:
+			err = fmt.Errorf("unknown option %s", arg)
+		}
+		if err != nil {
+			logError("Please specify valid options for compare.")
+			log.Fatal(err)
+			return
+		}
+	}
+	if len(paths) != 2 {
+		logError("Please specify the two datasets to compare.")
+		return
+	}
+	arrays := make([][]Grid, 2)
+	naphilArrays := make([][]uint8, 2)
+	infos := make([]datasetInfo, 2)
+	for k, fName := range paths {
+		logFile("load", fName, "Adding data from "+fName)
+		var release func() error
+		arrays[k], naphilArrays[k], infos[k], release, err = readFromFile(fName)
+		if err != nil {
+			logError("Please specify valid filenames for both datasets.")
+			log.Fatal(err)
+			return
+		}
+		defer release()
+	}
+	if margin < 0 {
+		margin = infos[0].Margin
+	}
+	if margin <= 0 {
+		logError("Please specify a margin with --margin, since " + paths[0] + " did not record one.")
+		return
+	}
+
+	/*The second dataset is searched by dimensions and average luma.*/
+	arrayB := arrays[1]
+	sortByDimAvg(arrayB)
+	progress := newProgressLog(LOG_NORMAL, "comparing", "Comparing datasets", len(arrays[0]))
+	matches := matchGrids(arrays[0], naphilArrays[0], arrayB, naphilArrays[1], margin, tNum, progress)
+	report := compareDatasets(paths[0], paths[1], arrays[0], len(arrayB), matches, margin)
+	progress.finish(report.Exact + report.Near)
+
+	/*The grids of the first dataset only it has, and those it shares with
+	the second, are written with its own information.*/
+	for _, out := range []struct {
+		name string
+		keep func(uint8) bool
+	}{
+		{minusName, func(m uint8) bool { return m == MATCH_NONE }},
+		{intersectName, func(m uint8) bool { return m != MATCH_NONE }},
+	} {
+		if out.name == "" {
+			continue
+		}
+		kept := make([]Grid, 0)
+		for i, g := range arrays[0] {
+			if out.keep(matches[i]) {
+				kept = append(kept, g)
+			}
+		}
+		progress = newProgressLog(LOG_NORMAL, "writing", "Writing to file", len(kept))
+		err = writeToFile(kept, len(kept), out.name, naphilArrays[0], infos[0], compress)
+		progress.finish(len(kept))
+		if err != nil {
+			logError("Error writing dataset")
+			log.Fatal(err)
+			return
+		}
+		logFile("output", out.name, fmt.Sprintf("Wrote %d fragments to %s", len(kept), out.name))
+	}
+
+	if asJSON {
+		out, err := json.MarshalIndent(report, "", "	")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(out))
+		return
+	}
+	printCompareReport(report)
+}
+
+/*
+The bands of range the coverage command reports by: flat grids, textured
+grids, and grids of high contrast such as ink lines.
+*/
+var COVERAGE_RANGES = []struct {
+	name   string
+	lo, hi uint8
+}{{"low", 0, 31}, {"medium", 32, 95}, {"high", 96, 255}}
+
+/*The band of COVERAGE_RANGES a range falls in.*/
+func coverageRange(r uint8) int {
+	for k, b := range COVERAGE_RANGES {
+		if r >= b.lo && r <= b.hi {
+			return k
+		}
+	}
+	return len(COVERAGE_RANGES) - 1
+}
+
+/*
+How the grids of one dimension, band of average luma and band of range in
+a set of frames are covered by a set of datasets: how many there are and
+how many pixels they cover, how many have a grid of the same dimensions in
+the datasets within the tolerance, the mean distance from those which do
+not to their closest grids, which is 256 for grids with none, and how
+many grids in the datasets share the dimensions and bands.
+*/
+type coverageBand struct {
+	W          uint16  `json:"w"`
+	H          uint16  `json:"h"`
+	AvgMin     int     `json:"avgMin"`
+	AvgMax     int     `json:"avgMax"`
+	Range      string  `json:"range"`
+	Grids      int     `json:"grids"`
+	Pixels     int     `json:"pixels"`
+	Covered    int     `json:"covered"`
+	Uncovered  int     `json:"uncoveredPixels"`
+	Distance   float64 `json:"uncoveredDistance"`
+	Candidates int     `json:"candidates"`
+}
+
+/*
+Everything the coverage command reports. Gaps are the bands with grids
+not covered, from the most pixels uncovered to the least.
+*/
+type coverageReport struct {
+	Datasets      []string       `json:"datasets"`
+	Frames        []string       `json:"frames"`
+	Tolerance     int            `json:"tolerance"`
+	Grids         int            `json:"grids"`
+	Pixels        int            `json:"pixels"`
+	Covered       int            `json:"covered"`
+	CoveredPixels int            `json:"coveredPixels"`
+	NoCandidates  int            `json:"noCandidates"`
+	Gaps          []coverageBand `json:"gaps"`
+	Bands         []coverageBand `json:"bands"`
+}
+
+/*
+Partitions an image the way a trace does with the tree t, returning its
+grids and their pixels. Grids which are entirely transparent are left
+out, since a trace leaves them untextured.
+*/
+func traceGrids(imgW int, imgH int, pix_data []uint8, alpha []uint8, t *Tree) ([]Grid, []uint8) {
+	coordArray := make([][]uint64, t.leafNum)
+	coordsFromTree(t, 0, coordArray, 0, make([]uint64, 5))
+	naphilArray := make([]uint8, imgW*imgH)
+	array := make([]Grid, t.leafNum)
+	offset := 0
+	for i, ca := range coordArray {
+		populateTraceGrid(array, i, ca, offset, naphilArray, pix_data, imgW)
+		offset += int(ca[1]-ca[0]) * int(ca[3]-ca[2])
+	}
+	if alpha != nil {
+		array = slices.DeleteFunc(array, func(g Grid) bool {
+			return maskCoverage(alpha, imgW, g.getX(), g.getX()+int(g.getW()), g.getY(), g.getY()+int(g.getH())) == 0
+		})
+	}
+	return array, naphilArray
+}
+
+/*
+Finds how closely the signature of a grid is covered by a dataset sorted
+by dimensions and average luma. The distance between two grids of the
+same dimensions is the largest of the differences between their average
+lumas, their ranges, and the mean difference between their corners.
+Returns the distance to the closest grid of the same dimensions in array,
+or 256 if there are none. Grids are searched outwards from the average of
+g, stopping once their averages alone are further than the closest.
+*/
+func signatureDistance(g Grid, naphilArray []uint8, array []Grid, naphilData []uint8) int {
+	w := int(g.getW())
+	area := w * int(g.getH())
+	corners := [4]int{0, w - 1, area - w, area - 1}
+	distance := func(p Grid) int {
+		d := max(int(byteAbsDiff(g.avgLuma, p.avgLuma)), int(byteAbsDiff(g.maxLuma-g.minLuma, p.maxLuma-p.minLuma)))
+		sum := 0
+		for _, c := range corners {
+			sum += int(byteAbsDiff(naphilArray[g.offset+c], naphilData[p.offset+c]))
+		}
+		return max(d, (sum+3)/4)
+	}
+	dims := dimAvgKey(g) &^ 255
+	start, _ := slices.BinarySearchFunc(array, dimAvgKey(g), func(e Grid, k uint32) int {
+		return cmp.Compare(dimAvgKey(e), k)
+	})
+	best := 256
+	for j := start; j < len(array) && dimAvgKey(array[j])&^255 == dims && int(array[j].avgLuma)-int(g.avgLuma) < best; j++ {
+		best = min(best, distance(array[j]))
+	}
+	for j := start - 1; j >= 0 && dimAvgKey(array[j])&^255 == dims && int(g.avgLuma)-int(array[j].avgLuma) < best; j-- {
+		best = min(best, distance(array[j]))
+	}
+	return best
+}
+
+/*
+Measures how well the grids of a set of frames are covered by a set of
+datasets, each sorted by dimensions and average luma. Each grid counts as
+covered when one of the datasets has a grid within tolerance of its
+signature. The grids are grouped by dimensions, bands of average luma
+COMPARE_BAND wide, and bands of range.
+*/
+func measureCoverage(datasets []string, frames []string, arrays [][]Grid, naphilArrays [][]uint8, frameArrays [][]Grid, frameNaphils [][]uint8, tolerance int, tNum int, progress *progressLog) coverageReport {
+	report := coverageReport{Datasets: datasets, Frames: frames, Tolerance: tolerance, Gaps: make([]coverageBand, 0), Bands: make([]coverageBand, 0)}
+	key := func(g Grid) uint32 {
+		return (uint32(g.getW()) << 19) | (uint32(g.getH()) << 8) | (uint32(g.avgLuma/COMPARE_BAND) << 2) | uint32(coverageRange(g.maxLuma-g.minLuma))
+	}
+	bands := make(map[uint32]*coverageBand)
+	band := func(g Grid) *coverageBand {
+		k := key(g)
+		if b, ok := bands[k]; ok {
+			return b
+		}
+		avgMin := int(g.avgLuma/COMPARE_BAND) * COMPARE_BAND
+		b := &coverageBand{W: g.getW(), H: g.getH(), AvgMin: avgMin, AvgMax: avgMin + COMPARE_BAND - 1, Range: COVERAGE_RANGES[coverageRange(g.maxLuma-g.minLuma)].name}
+		bands[k] = b
+		return b
+	}
+	for f, frameArray := range frameArrays {
+		distances := make([]int, len(frameArray))
+		size, count := chunkSize(len(frameArray), tNum, 1024)
+		workerPool(count, tNum, func(c int) {
+			end := min((c+1)*size, len(frameArray))
+			for i := c * size; i < end; i++ {
+				distances[i] = 256
+				for d := range arrays {
+					distances[i] = min(distances[i], signatureDistance(frameArray[i], frameNaphils[f], arrays[d], naphilArrays[d]))
+				}
+			}
+			progress.add(end - c*size)
+		})
+		for i, g := range frameArray {
+			b := band(g)
+			pixels := int(g.getW()) * int(g.getH())
+			b.Grids++
+			b.Pixels += pixels
+			report.Grids++
+			report.Pixels += pixels
+			if distances[i] == 256 {
+				report.NoCandidates++
+			}
+			if distances[i] <= tolerance {
+				b.Covered++
+				report.Covered++
+				report.CoveredPixels += pixels
+			} else {
+				b.Uncovered += pixels
+				b.Distance += float64(distances[i])
+			}
+		}
+	}
+
+	/*Only the grids of the datasets in the bands the frames have are
+	counted, since those are the only ones reported.*/
+	for _, array := range arrays {
+		for _, g := range array {
+			if b, ok := bands[key(g)]; ok {
+				b.Candidates++
+			}
+		}
+	}
+	keys := slices.Sorted(maps.Keys(bands))
+	for _, k := range keys {
+		b := bands[k]
+		if b.Covered < b.Grids {
+			b.Distance /= float64(b.Grids - b.Covered)
+		}
+		report.Bands = append(report.Bands, *b)
+		if b.Covered < b.Grids {
+			report.Gaps = append(report.Gaps, *b)
+		}
+	}
+	slices.SortStableFunc(report.Gaps, func(a, b coverageBand) int {
+		return cmp.Compare(b.Uncovered, a.Uncovered)
+	})
+	return report
+}
+
+/*Prints a coverage report as text.*/
+func printCoverageReport(report coverageReport) {
+	percent := func(n int, total int) float64 {
+		return 100.0 * float64(n) / float64(max(1, total))
+	}
+	fmt.Printf("Datasets:	%s\n", strings.Join(report.Datasets, ", "))
+	fmt.Printf("Frames:	%d, partitioned into %d fragments\n", len(report.Frames), report.Grids)
+	fmt.Printf("Tolerance:	%d\n", report.Tolerance)
+	fmt.Printf("Covered:	%d fragments (%.1f%%), %d pixels (%.1f%%)\n", report.Covered, percent(report.Covered, report.Grids), report.CoveredPixels, percent(report.CoveredPixels, report.Pixels))
+	fmt.Printf("Without candidates of the same size:	%d (%.1f%%)\n", report.NoCandidates, percent(report.NoCandidates, report.Grids))
+	if len(report.Gaps) == 0 {
+		fmt.Println("Gaps:	none")
+		return
+	}
+	fmt.Println("Gaps, by pixels uncovered:")
+	for _, b := range report.Gaps {
+		if b.Candidates == 0 {
+			fmt.Printf("	no %dx%d fragments with avg %d-%d and %s range (%d of %d uncovered, %d pixels)\n", b.W, b.H, b.AvgMin, b.AvgMax, b.Range, b.Grids-b.Covered, b.Grids, b.Uncovered)
+		} else {
+			fmt.Printf("	%dx%d fragments with avg %d-%d and %s range: %d of %d not within %d of the %d in the datasets (%d pixels, mean distance of those %.1f)\n", b.W, b.H, b.AvgMin, b.AvgMax, b.Range, b.Grids-b.Covered, b.Grids, report.Tolerance, b.Candidates, b.Uncovered, b.Distance)
+		}
+	}
+}
+
+/*
+The coverage command, which partitions sample frames the way a trace
+would and reports how well the datasets cover the signatures of their
+grids, so that the gaps can be filled before tracing a whole shot. The
+partitions are random like a trace's, unless given a seed.
+*/
+func coverageMain(args []string) {
+	paths := make([]string, 0)
+	frames := make([]string, 0)
+	var minW, minH, maxW, maxH uint64
+	tolerance := 16
+	asJSON := false
+	seeded := false
+	var seed int64
+	tNum := 1
+	var err error
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--json" {
+			asJSON = true
+			continue
+		}
+		if arg == "--frames" {
+			for i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				frames = append(frames, args[i+1])
+				i++
+			}
+			continue
+		}
+		if !strings.HasPrefix(arg, "-") {
+			paths = append(paths, arg)
+			continue
+		}
+		if i+1 >= len(args) {
+			logError("Please specify a value for " + arg)
+			return
+		}
+		value := args[i+1]
+		i++
+		switch arg {
+		case "--min":
+			minW, minH, err = parseDims(value)
+		case "--max":
+			maxW, maxH, err = parseDims(value)
+		case "--tolerance":
+			tolerance, err = strconv.Atoi(value)
+			if err == nil && (tolerance < 0 || tolerance > 255) {
+				err = fmt.Errorf("tolerance %s is not between 0 and 255", value)
+			}
+		case "--seed":
+			seed, err = strconv.ParseInt(value, 10, 64)
+			seeded = true
+		case "-t":
+			tNum, err = strconv.Atoi(value)
+			if err == nil && tNum < 1 {
+				err = fmt.Errorf("thread number %s is not positive", value)
+			}
+		default:
+			err = fmt.Errorf("unknown option %s", arg)
+		}
+		if err != nil {
+			logError("Please specify valid options for coverage.")
+			log.Fatal(err)
+			return
+		}
+	}
+	if len(paths) == 0 || len(frames) == 0 {
+		logError("Please specify at least one dataset, and sample frames after --frames.")
+		return
+	}
+	if minW == 0 || maxW == 0 {
+		logError("Please specify minimum and maximum grid dimensions with --min and --max.")
+		return
+	}
+	if maxW < minW*2 || maxH < minH*2 {
+		logError("Please specify a maximum size at least twice that of the minimum size, in both width and height.")
+		return
+	}
+	next := randomUint64
+	if seeded {
+		next = rand.New(rand.NewSource(seed)).Uint64
+	}
+
+	/*Each dataset is searched by dimensions and average luma.*/
+	arrays := make([][]Grid, len(paths))
+	naphilArrays := make([][]uint8, len(paths))
+	for k, fName := range paths {
+		logFile("load", fName, "Adding data from "+fName)
+		var release func() error
+		arrays[k], naphilArrays[k], _, release, err = readFromFile(fName)
+		if err != nil {
+			logError("Please specify valid filenames for the datasets.")
+			log.Fatal(err)
+			return
+		}
+		defer release()
+		sortByDimAvg(arrays[k])
+	}
+
+	frameArrays := make([][]Grid, len(frames))
+	frameNaphils := make([][]uint8, len(frames))
+	total := 0
+	for k, fName := range frames {
+		logFile("partition", fName, "Partitioning "+fName)
+		pix_data, alpha, w, h, err := readGrayAlpha(fName)
+		if err != nil {
+			logError("Please specify valid sample frames.")
+			log.Fatal(err)
+			return
+		}
+		t := generateTree(0, uint64(w), 0, uint64(h), minW, maxW, minH, maxH, next(), next())
+		frameArrays[k], frameNaphils[k] = traceGrids(w, h, pix_data, alpha, t)
+		total += len(frameArrays[k])
+	}
+
+	progress := newProgressLog(LOG_NORMAL, "measuring", "Measuring coverage", total)
+	report := measureCoverage(paths, frames, arrays, naphilArrays, frameArrays, frameNaphils, tolerance, tNum, progress)
+	progress.finish(total)
+
+	if asJSON {
+		out, err := json.MarshalIndent(report, "", "	")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(out))
+		return
+	}
+	printCoverageReport(report)
+}
+
+/*The position of a grid in an atlas page, and where it came from.*/
+type atlasTile struct {
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	W      uint16 `json:"w"`
+	H      uint16 `json:"h"`
+	Source uint32 `json:"source"`
+}
+
+/*A page of an atlas and the tiles on it.*/
+type atlasPage struct {
+	File  string      `json:"file"`
+	Tiles []atlasTile `json:"tiles"`
+}
+
+/*The index of an atlas, which is needed to import it again.*/
+type atlasIndex struct {
+	Info  datasetInfo `json:"info"`
+	Pages []atlasPage `json:"pages"`
+}
+
+/*The name of the index file written alongside atlas pages.*/
+const ATLAS_INDEX = "index.json"
+
+/*
+Renders the grids of a dataset into atlas pages, so that they can be
+examined and curated by hand. Grids are grouped by dimensions, each
+group starting on a new row, and sorted by average luma within them.
+Tiles are separated by a transparent gutter, and the background is
+transparent as well.
+*/
+func exportAtlas(array []Grid, naphilArray []uint8, info datasetInfo, dir string, pageW int, pageH int) (atlasIndex, error) {
+	index := atlasIndex{Info: info}
+	order := make([]int, len(array))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		g1 := array[order[i]]
+		g2 := array[order[j]]
+		if g1.getW() != g2.getW() {
+			return g1.getW() < g2.getW()
+		}
+		if g1.getH() != g2.getH() {
+			return g1.getH() < g2.getH()
+		}
+		return g1.avgLuma < g2.avgLuma
+	})
+
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return index, err
+	}
+
+	gray := make([]uint8, pageW*pageH)
+	alpha := make([]uint8, pageW*pageH)
+	page := atlasPage{}
+	x, y, rowH := 0, 0, 0
+	var lastW, lastH uint16
+
+	/*Writes the current page, cropped to the rows used.*/
+	flush := func(usedH int) error {
+		page.File = fmt.Sprintf("page_%04d.png", len(index.Pages))
+		err := writeGrayAlpha(filepath.Join(dir, page.File), pageW, usedH, gray[:pageW*usedH], alpha[:pageW*usedH])
+		if err != nil {
+			return err
+		}
+		index.Pages = append(index.Pages, page)
+		page = atlasPage{}
+		clear(gray)
+		clear(alpha)
+		x, y, rowH = 0, 0, 0
+		return nil
+	}
+
+	for n, i := range order {
+		g := array[i]
+		w := int(g.getW())
+		h := int(g.getH())
+		if w > pageW || h > pageH {
+			return index, fmt.Errorf("a %dx%d fragment does not fit on a %dx%d page", w, h, pageW, pageH)
+		}
+		/*A new group of dimensions or a full row starts a new row.*/
+		if n > 0 && (g.getW() != lastW || g.getH() != lastH || x+w > pageW) {
+			x = 0
+			y += rowH + 1
+			rowH = 0
+		}
+		if y+h > pageH {
+			/*The gutter above the new row is not part of the page.*/
+			err = flush(y - 1)
+			if err != nil {
+				return index, err
+			}
+		}
+		for row := range h {
+			copy(gray[((y+row)*pageW)+x:((y+row)*pageW)+x+w], naphilArray[g.offset+(row*w):g.offset+((row+1)*w)])
+			for col := range w {
+				alpha[((y+row)*pageW)+x+col] = 255
+			}
+		}
+		page.Tiles = append(page.Tiles, atlasTile{X: x, Y: y, W: g.getW(), H: g.getH(), Source: g.source})
+		x += w + 1
+		rowH = max(rowH, h)
+		lastW = g.getW()
+		lastH = g.getH()
+	}
+	if len(page.Tiles) > 0 {
+		err = flush(y + rowH)
+		if err != nil {
+			return index, err
+		}
+	}
+
+	indexJSON, err := json.MarshalIndent(index, "", "	")
+	if err != nil {
+		return index, err
+	}
+	return index, os.WriteFile(filepath.Join(dir, ATLAS_INDEX), indexJSON, 0666)
+}
+
+/*
+Rebuilds a dataset from an atlas written by exportAtlas, which may have
+been edited since. Tiles made fully transparent are taken to have been
+deleted, and tiles which have been painted over keep their new pixels,
+whatever their alpha. Returns the grids, their pixels, the dataset information, and
+the number of tiles deleted.
+*/
+func importAtlas(dir string) ([]Grid, []uint8, datasetInfo, int, error) {
+	var index atlasIndex
+	indexJSON, err := os.ReadFile(filepath.Join(dir, ATLAS_INDEX))
+	if err != nil {
+		return nil, nil, index.Info, 0, err
+	}
+	err = json.Unmarshal(indexJSON, &index)
+	if err != nil {
+		return nil, nil, index.Info, 0, fmt.Errorf("invalid atlas index: %w", err)
+	}
+	array := make([]Grid, 0)
+	naphilArray := make([]uint8, 0)
+	deleted := 0
+	for _, page := range index.Pages {
+		gray, alpha, pageW, pageH, err := readGrayAlpha(filepath.Join(dir, page.File))
+		if err != nil {
+			return nil, nil, index.Info, 0, err
+		}
+		for _, tile := range page.Tiles {
+			w := int(tile.W)
+			h := int(tile.H)
+			if w == 0 || h == 0 || w > MAX_DIM || h > MAX_DIM || tile.X < 0 || tile.Y < 0 || tile.X+w > pageW || tile.Y+h > pageH {
+				return nil, nil, index.Info, 0, fmt.Errorf("tile at %d, %d does not fit on %s", tile.X, tile.Y, page.File)
+			}
+			/*Datasets which never recorded their sources give every grid source 0*/
+			if int(tile.Source) >= len(index.Info.Sources) && (tile.Source != 0 || len(index.Info.Sources) != 0) {
+				return nil, nil, index.Info, 0, fmt.Errorf("tile at %d, %d on %s has source %d, but the atlas has %d sources", tile.X, tile.Y, page.File, tile.Source, len(index.Info.Sources))
+			}
+			if alpha != nil {
+				transparent := true
+				for row := 0; row < h && transparent; row++ {
+					transparent = !slices.ContainsFunc(alpha[((tile.Y+row)*pageW)+tile.X:((tile.Y+row)*pageW)+tile.X+w], func(a uint8) bool { return a != 0 })
+				}
+				if transparent {
+					deleted++
+					continue
+				}
+			}
+			offset := len(naphilArray)
+			for row := range h {
+				naphilArray = append(naphilArray, gray[((tile.Y+row)*pageW)+tile.X:((tile.Y+row)*pageW)+tile.X+w]...)
+			}
+			/*The average luma is measured again, as the tile may have been painted over*/
+			minMaxSum_result := minMaxSum(naphilArray, offset, offset+(w*h), 255, 0)
+			array = append(array, Grid{
+				w__:     tile.W,
+				h__:     tile.H,
+				avgLuma: uint8((minMaxSum_result & 0xFFFFFFFF) / uint64(w*h)),
+				minLuma: uint8((minMaxSum_result >> 32) & 0xFF),
+				maxLuma: uint8((minMaxSum_result >> 40) & 0xFF),
+				offset:  offset,
+				source:  tile.Source,
+			})
+		}
+	}
+	return array, naphilArray, index.Info, deleted, nil
+}
+
+/*
+The export command, which renders a dataset into atlas pages in a
+directory, and the import command, which rebuilds a dataset from them.
+*/
+func atlasMain(command string, args []string) {
+	paths := make([]string, 0)
+	pageW, pageH := 1024, 1024
+	compress := false
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--compress" {
+			compress = true
+		} else if args[i] == "--page" && i+1 < len(args) {
+			wStr, hStr, found := strings.Cut(args[i+1], "x")
+			w, errW := strconv.Atoi(wStr)
+			h, errH := strconv.Atoi(hStr)
+			if !found || errW != nil || errH != nil || w < 1 || h < 1 {
+				logError("Please specify the page size as WIDTHxHEIGHT, e.g. 1024x1024.")
+				return
+			}
+			pageW, pageH = w, h
+			i++
+		} else {
+			paths = append(paths, args[i])
+		}
+	}
+	if len(paths) != 2 {
+		if command == "export" {
+			logError("Please specify exactly one dataset and one directory for the atlas.")
+		} else {
+			logError("Please specify exactly one atlas directory and one output dataset.")
+		}
+		return
+	}
+	if command == "export" {
+		array, naphilArray, info, release, err := readFromFile(paths[0])
+		if err != nil {
+			logError("Please specify a valid dataset.")
+			log.Fatal(err)
+			return
+		}
+		defer release()
+		index, err := exportAtlas(array, naphilArray, info, paths[1], pageW, pageH)
+		if err != nil {
+			logError("Error writing atlas")
+			log.Fatal(err)
+			return
+		}
+		fmt.Printf("Exported %d fragments to %d pages in %s\n", len(array), len(index.Pages), paths[1])
+		return
+	}
+	array, naphilArray, info, deleted, err := importAtlas(paths[0])
+	if err != nil {
+		logError("Please specify a valid atlas directory.")
+		log.Fatal(err)
+		return
+	}
+	/*Tiles painted over may have a new average luma, so the grids are sorted again*/
+	sortByDimAvg(array)
+	err = writeToFile(array, len(array), paths[1], naphilArray, info, compress)
+	if err != nil {
+		logError("Error writing dataset")
+		log.Fatal(err)
+		return
+	}
+	fmt.Printf("Imported %d fragments, %d deleted, to %s\n", len(array), deleted, paths[1])
+}
+
+/*
+Criteria for the grids kept by the filter command. Each pair of bounds is
+inclusive, and sources are matched by name, with wildcards as in
+filepath.Match. Depth is 0 for any grid, 1 for shallow grids only, and 2
+for deep grids only, split at the margin. A sample fraction below 1 keeps
+that share of the grids which meet every other criterion, at random.
+*/
+type gridFilter struct {
+	wLo, wHi     uint16
+	hLo, hHi     uint16
+	avgLo, avgHi uint8
+	minLo, minHi uint8
+	maxLo, maxHi uint8
+	ranLo, ranHi uint8
+	sources      []string
+	depth        uint8
+	margin       float64
+	sample       float64
+}
+
+/*A filter which keeps every grid.*/
+func newGridFilter() gridFilter {
+	return gridFilter{
+		wHi:    MAX_DIM,
+		hHi:    MAX_DIM,
+		avgHi:  255,
+		minHi:  255,
+		maxHi:  255,
+		ranHi:  255,
+		sample: 1,
+	}
+}
+
+/*Checks whether a grid meets every criterion of a filter besides sampling.*/
+func (f gridFilter) keeps(g Grid, info datasetInfo) bool {
+	ran := g.maxLuma - g.minLuma
+	if g.getW() < f.wLo || g.getW() > f.wHi || g.getH() < f.hLo || g.getH() > f.hHi ||
+		g.avgLuma < f.avgLo || g.avgLuma > f.avgHi ||
+		g.minLuma < f.minLo || g.minLuma > f.minHi ||
+		g.maxLuma < f.maxLo || g.maxLuma > f.maxHi ||
+		ran < f.ranLo || ran > f.ranHi {
+		return false
+	}
+	if f.depth != 0 {
+		deep := ran > uint8(256.0*f.margin)
+		if deep != (f.depth == 2) {
+			return false
+		}
+	}
+	if len(f.sources) > 0 {
+		if int(g.source) >= len(info.Sources) {
+			return false
+		}
+		name := info.Sources[g.source].Name
+		for _, pattern := range f.sources {
+			if matched, _ := filepath.Match(pattern, name); matched || pattern == name {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+/*
+Selects the grids of a dataset meeting the criteria of a filter. The
+grids stay in the order they were in, so a sorted dataset stays sorted.
+*/
+func filterGrids(array []Grid, info datasetInfo, f gridFilter, rng *rand.Rand) []Grid {
+	filtered := make([]Grid, 0)
+	for _, g := range array {
+		if f.keeps(g, info) && (f.sample >= 1 || rng.Float64() < f.sample) {
+			filtered = append(filtered, g)
+		}
+	}
+	return filtered
+}
+
+/*
+The filter command, which writes the subset of a dataset meeting some
+criteria to a new dataset.
+*/
+func filterMain(args []string) {
+	paths := make([]string, 0)
+	f := newGridFilter()
+	margin := float64(-1)
+	seed := time.Now().UnixNano()
+	compress := false
+	var err error
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--compress" {
+			compress = true
+			continue
+		}
+		if arg == "--deep" || arg == "--shallow" {
+			f.depth = 1
+			if arg == "--deep" {
+				f.depth = 2
+			}
+			continue
+		}
+		if !strings.HasPrefix(arg, "--") {
+			paths = append(paths, arg)
+			continue
+		}
+		if i+1 >= len(args) {
+			logError("Please specify a value for " + arg)
+			return
+		}
+		value := args[i+1]
+		i++
+		switch arg {
+		case "--width":
+			f.wLo, f.wHi, err = parseDimBounds(value)
+		case "--height":
+			f.hLo, f.hHi, err = parseDimBounds(value)
+		case "--avg":
+			f.avgLo, f.avgHi, err = parseBounds(value)
+		case "--min":
+			f.minLo, f.minHi, err = parseBounds(value)
+		case "--max":
+			f.maxLo, f.maxHi, err = parseBounds(value)
+		case "--range":
+			f.ranLo, f.ranHi, err = parseBounds(value)
+		case "--source":
+			f.sources = append(f.sources, value)
+		case "--margin":
+			margin, err = strconv.ParseFloat(value, 64)
+		case "--sample":
+			f.sample, err = strconv.ParseFloat(value, 64)
+			if err == nil && (f.sample <= 0 || f.sample > 1) {
+				err = fmt.Errorf("sample fraction %s is not above 0 and at most 1", value)
+			}
+		case "--seed":
+			seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			err = fmt.Errorf("unknown option %s", arg)
+		}
+		if err != nil {
+			logError("Please specify valid criteria for the filter.")
+			log.Fatal(err)
+			return
+		}
+	}
+	if len(paths) != 2 {
+		logError("Please specify exactly one input dataset and one output dataset.")
+		return
+	}
+	array, naphilArray, info, release, err := readFromFile(paths[0])
+	if err != nil {
+		logError("Please specify a valid input dataset.")
+		log.Fatal(err)
+		return
+	}
+	defer release()
+	/*Deep and shallow grids are split at the margin the dataset was built
+	with, unless given another.*/
+	f.margin = margin
+	if f.margin < 0 {
+		f.margin = info.Margin
+		if f.margin <= 0 {
+			f.margin = 0.05
+		}
+	}
+	filtered := filterGrids(array, info, f, rand.New(rand.NewSource(seed)))
+	err = writeToFile(filtered, len(filtered), paths[1], naphilArray, info, compress)
+	if err != nil {
+		logError("Error writing dataset")
+		log.Fatal(err)
+		return
+	}
+	fmt.Printf("Kept %d of %d fragments\n", len(filtered), len(array))
+}
+
+/*The states of a trace job submitted to the server.*/
+const (
+	JOB_QUEUED  = "queued"
+	JOB_RUNNING = "running"
+	JOB_DONE    = "done"
+	JOB_FAILED  = "failed"
+)
+
+/*
+A trace job submitted to the server. The image is either a path on the
+server or an upload saved in the server's directory, and the result is
+written to output.
+*/
+type traceJob struct {
+	ID        int        `json:"id"`
+	Status    string     `json:"status"`
+	Progress  float64    `json:"progress"`
+	Image     string     `json:"image"`
+	Dataset   string     `json:"dataset"`
+	Output    string     `json:"output"`
+	Error     string     `json:"error,omitempty"`
+	Submitted time.Time  `json:"submitted"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	opts      traceOptions
+	upload    bool
+}
+
+/*
+A server which keeps datasets loaded and traces images with them, taking
+jobs from a queue with a pool of workers. Only the last keep finished
+jobs are remembered, and uploads are limited to maxUpload bytes.
+*/
+type traceServer struct {
+	mu        sync.Mutex
+	jobs      map[int]*traceJob
+	nextID    int
+	queue     chan *traceJob
+	datasets  map[string][]traceSet
+	names     []string
+	sizes     map[string]int
+	dir       string
+	root      string
+	opts      traceOptions
+	keep      int
+	maxUpload int64
+}
+
+/*How long a client may take to send the headers of a request, and all of it.*/
+const SERVE_HEADER_TIMEOUT = 10 * time.Second
+const SERVE_READ_TIMEOUT = 5 * time.Minute
+
+/*Runs jobs from the queue until it is closed.*/
+func (s *traceServer) work() {
+	for job := range s.queue {
+		s.mu.Lock()
+		job.Status = JOB_RUNNING
+		s.mu.Unlock()
+		err := traceFile(job.Image, job.Output, s.datasets[job.Dataset], job.opts, func(p float64) {
+			s.mu.Lock()
+			job.Progress = max(job.Progress, p)
+			s.mu.Unlock()
+		})
+		if job.upload {
+			os.Remove(job.Image)
+		}
+		s.mu.Lock()
+		finished := time.Now()
+		job.Finished = &finished
+		if err != nil {
+			job.Status = JOB_FAILED
+			job.Error = err.Error()
+		} else {
+			job.Status = JOB_DONE
+		}
+		s.evictJobs()
+		s.mu.Unlock()
+		logFile("job", job.Image, fmt.Sprintf("Job %d %s", job.ID, job.Status))
+	}
+}
+
+/*
+Forgets the oldest finished jobs beyond the number kept, deleting their
+outputs. The server must be locked.
+*/
+func (s *traceServer) evictJobs() {
+	finished := make([]*traceJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		if job.Finished != nil {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= s.keep {
+		return
+	}
+	slices.SortFunc(finished, func(a, b *traceJob) int { return cmp.Compare(a.ID, b.ID) })
+	for _, job := range finished[:len(finished)-s.keep] {
+		delete(s.jobs, job.ID)
+		os.Remove(job.Output)
+	}
+}
+
+/*Writes a value as JSON in response to a request.*/
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+/*Writes an error as JSON in response to a request.*/
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+/*
+Resolves the symbolic links in an absolute path, as far as it exists. The
+parts of the path which do not exist yet, such as an output to be
+written, are kept as they are. A link which leads nowhere is an error,
+since writing to it would create whatever it leads to.
+*/
+func resolveLinks(path string) (string, error) {
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if _, statErr := os.Lstat(path); !os.IsNotExist(statErr) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+/*
+Resolves a path given by a job against a folder, relative to it unless
+it is absolute. Symbolic links are followed, and paths leading outside of
+the folder are rejected, so that clients cannot read or write anything
+else on the server.
+*/
+func confinePath(root string, name string) (string, error) {
+	absRoot, err := filepath.Abs(root)
+	if err == nil {
+		absRoot, err = resolveLinks(absRoot)
+	}
+	if err != nil {
+		return "", err
+	}
+	full := name
+	if !filepath.IsAbs(name) {
+		full = filepath.Join(absRoot, name)
+	}
+	full, err = resolveLinks(full)
+	if err != nil {
+		return "", fmt.Errorf("%s cannot be resolved: %w", name, err)
+	}
+	rel, err := filepath.Rel(absRoot, full)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%s is outside of %s", name, root)
+	}
+	return full, nil
+}
+
+/*
+Accepts a trace job. The image is given either as a path on the server
+or as an uploaded file named image, along with optional minimum and
+maximum dimensions, a dataset, a mask and a label map on the server, and
+an output path on the server. Paths to read from must be inside the root
+folder, and outputs inside the job folder.
+*/
+func (s *traceServer) submit(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxUpload)
+	err := r.ParseForm()
+	if err == nil {
+		err = r.ParseMultipartForm(32 << 20)
+	}
+	if err == http.ErrNotMultipart {
+		err = nil
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("uploads are limited to %d bytes", tooLarge.Limit))
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	job := &traceJob{Status: JOB_QUEUED, Submitted: time.Now(), opts: s.opts, Dataset: s.names[0]}
+	if mask := r.FormValue("mask"); mask != "" {
+		job.opts.mask, err = confinePath(s.root, mask)
+	}
+	if labels := r.FormValue("labels"); err == nil && labels != "" {
+		job.opts.labels, err = confinePath(s.root, labels)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusForbidden, err)
+		return
+	}
+	if minDims := r.FormValue("min"); minDims != "" {
+		job.opts.minW, job.opts.minH, err = parseDims(minDims)
+	}
+	if maxDims := r.FormValue("max"); err == nil && maxDims != "" {
+		job.opts.maxW, job.opts.maxH, err = parseDims(maxDims)
+	}
+	if err == nil && (job.opts.maxW < job.opts.minW*2 || job.opts.maxH < job.opts.minH*2) {
+		err = fmt.Errorf("the maximum dimensions must be at least twice the minimum")
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if name := r.FormValue("dataset"); name != "" {
+		if _, found := s.datasets[name]; !found {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("dataset %s is not loaded", name))
+			return
+		}
+		job.Dataset = name
+	}
+
+	s.mu.Lock()
+	s.nextID++
+	job.ID = s.nextID
+	s.mu.Unlock()
+
+	if path := r.FormValue("path"); path != "" {
+		job.Image, err = confinePath(s.root, path)
+		if err != nil {
+			writeJSONError(w, http.StatusForbidden, err)
+			return
+		}
+	} else {
+		file, header, err := r.FormFile("image")
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("please give either a path or an uploaded image"))
+			return
+		}
+		defer file.Close()
+		job.Image = filepath.Join(s.dir, fmt.Sprintf("job_%d_input%s", job.ID, filepath.Ext(header.Filename)))
+		f, err := os.Create(job.Image)
+		if err == nil {
+			_, err = io.Copy(f, file)
+			f.Close()
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		job.upload = true
+	}
+	job.Output = filepath.Join(s.dir, fmt.Sprintf("job_%d.png", job.ID))
+	if output := r.FormValue("output"); output != "" {
+		job.Output, err = confinePath(s.dir, output)
+		if err != nil {
+			if job.upload {
+				os.Remove(job.Image)
+			}
+			writeJSONError(w, http.StatusForbidden, err)
+			return
+		}
+	}
+
+	/*The job is copied while it is locked, since a worker may start on it
+	as soon as it is queued.*/
+	var accepted traceJob
+	s.mu.Lock()
+	select {
+	case s.queue <- job:
+		s.jobs[job.ID] = job
+		accepted = *job
+	default:
+		err = fmt.Errorf("the job queue is full")
+	}
+	s.mu.Unlock()
+	if err != nil {
+		if job.upload {
+			os.Remove(job.Image)
+		}
+		writeJSONError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, accepted)
+}
+
+/*
+Forgets a finished job and deletes its output. Jobs still queued or
+running cannot be deleted.
+*/
+func (s *traceServer) deleteJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, found := s.jobs[id]
+	if err != nil || !found {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no job %s", r.PathValue("id")))
+		return
+	}
+	if job.Finished == nil {
+		writeJSONError(w, http.StatusConflict, fmt.Errorf("job %d is %s", job.ID, job.Status))
+		return
+	}
+	delete(s.jobs, job.ID)
+	os.Remove(job.Output)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*Finds the job named in a request, or responds that there is none.*/
+func (s *traceServer) findJob(w http.ResponseWriter, r *http.Request) (traceJob, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, found := s.jobs[id]
+	if err != nil || !found {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no job %s", r.PathValue("id")))
+		return traceJob{}, false
+	}
+	return *job, true
+}
+
+/*Lists every job in the order it was submitted.*/
+func (s *traceServer) listJobs(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	jobs := make([]traceJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, *job)
+	}
+	s.mu.Unlock()
+	slices.SortFunc(jobs, func(a, b traceJob) int { return cmp.Compare(a.ID, b.ID) })
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+/*Reports the status and progress of a job.*/
+func (s *traceServer) jobStatus(w http.ResponseWriter, r *http.Request) {
+	job, found := s.findJob(w, r)
+	if found {
+		writeJSON(w, http.StatusOK, job)
+	}
+}
+
+/*Sends the traced image of a finished job.*/
+func (s *traceServer) jobResult(w http.ResponseWriter, r *http.Request) {
+	job, found := s.findJob(w, r)
+	if !found {
+		return
+	}
+	if job.Status != JOB_DONE {
+		writeJSONError(w, http.StatusConflict, fmt.Errorf("job %d is %s", job.ID, job.Status))
+		return
+	}
+	http.ServeFile(w, r, job.Output)
+}
+
+/*Lists the loaded datasets and the number of grids in each.*/
+func (s *traceServer) listDatasets(w http.ResponseWriter, r *http.Request) {
+	type datasetSummary struct {
+		Name      string `json:"name"`
+		Fragments int    `json:"fragments"`
+	}
+	summaries := make([]datasetSummary, len(s.names))
+	for i, name := range s.names {
+		summaries[i] = datasetSummary{Name: name, Fragments: s.sizes[name]}
+	}
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+/*
+The serve command, which loads datasets once and traces images with them
+for jobs submitted over HTTP, as many at a time as there are threads.
+*/
+func serveMain(args []string) {
+	s := &traceServer{
+		jobs:      make(map[int]*traceJob),
+		datasets:  make(map[string][]traceSet),
+		sizes:     make(map[string]int),
+		keep:      1000,
+		maxUpload: 256 << 20,
+	}
+	addr := "localhost:8080"
+	pprofAddr := ""
+	tNum := 1
+	queueLen := 1024
+	var err error
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			s.names = append(s.names, arg)
+			continue
+		}
+		if i+1 >= len(args) {
+			logError("Please specify a value for " + arg)
+			return
+		}
+		value := args[i+1]
+		i++
+		switch arg {
+		case "--addr":
+			addr = value
+		case "--pprof":
+			pprofAddr = value
+		case "--min":
+			s.opts.minW, s.opts.minH, err = parseDims(value)
+		case "--max":
+			s.opts.maxW, s.opts.maxH, err = parseDims(value)
+		case "--dir":
+			s.dir = value
+		case "--root":
+			s.root = value
+		case "--queue":
+			queueLen, err = strconv.Atoi(value)
+			if err == nil && queueLen < 1 {
+				err = fmt.Errorf("queue length %s is not positive", value)
+			}
+		case "--keep":
+			s.keep, err = strconv.Atoi(value)
+			if err == nil && s.keep < 1 {
+				err = fmt.Errorf("number of jobs to keep %s is not positive", value)
+			}
+		case "--max-upload":
+			s.maxUpload, err = parseMemory(value)
+		case "-t":
+			tNum, err = strconv.Atoi(value)
+			if err == nil && tNum < 1 {
+				err = fmt.Errorf("thread number %s is not positive", value)
+			}
+		default:
+			err = fmt.Errorf("unknown option %s", arg)
+		}
+		if err != nil {
+			logError("Please specify valid options for serve.")
+			log.Fatal(err)
+			return
+		}
+	}
+	if len(s.names) == 0 {
+		logError("Please specify at least one dataset to serve.")
+		return
+	}
+	if s.opts.minW == 0 || s.opts.maxW == 0 {
+		logError("Please specify default minimum and maximum grid dimensions with --min and --max.")
+		return
+	}
+	if s.opts.maxW < s.opts.minW*2 || s.opts.maxH < s.opts.minH*2 {
+		logError("Please specify a maximum size at least twice that of the minimum size, in both width and height.")
+		return
+	}
+	if s.dir == "" {
+		s.dir, err = os.MkdirTemp("", "luma-serve")
+	} else {
+		err = os.MkdirAll(s.dir, 0777)
+	}
+	if err != nil {
+		logError("Error creating the directory for jobs")
+		log.Fatal(err)
+		return
+	}
+	if s.root == "" {
+		s.root = s.dir
+	}
+
+	for _, name := range s.names {
+		logFile("load", name, "Adding data from "+name)
+		set, _, release, err := readFromFileLazily(name)
+		if err != nil {
+			logError("Please specify valid filenames for all datasets.")
+			log.Fatal(err)
+			return
+		}
+		defer release()
+		prepareForTrace(set.array, tNum)
+		set.rule = regionRule{kind: RULE_ALL, lo: 0, hi: 255}
+		s.datasets[name] = []traceSet{set}
+		s.sizes[name] = len(set.array)
+	}
+
+	s.queue = make(chan *traceJob, queueLen)
+	for range tNum {
+		go s.work()
+	}
+	if pprofAddr != "" {
+		servePprof(pprofAddr)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", s.submit)
+	mux.HandleFunc("GET /jobs", s.listJobs)
+	mux.HandleFunc("GET /jobs/{id}", s.jobStatus)
+	mux.HandleFunc("GET /jobs/{id}/result", s.jobResult)
+	mux.HandleFunc("DELETE /jobs/{id}", s.deleteJob)
+	mux.HandleFunc("GET /datasets", s.listDatasets)
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: SERVE_HEADER_TIMEOUT,
+		ReadTimeout:       SERVE_READ_TIMEOUT,
+	}
+	logMessage(fmt.Sprintf("Serving %d datasets on %s with %d workers", len(s.names), addr, tNum))
+	log.Fatal(server.ListenAndServe())
+}
+
+/*
+What became of one frame traced by a batch or watched folder: the size
+and modification time of the input, the parameters and output it was
+traced with, and a SHA-256 hash of the output. A frame is traced again if
+any of the first three change.
+*/
+type frameRecord struct {
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"modTime"`
+	Params     string    `json:"params"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	Output     string    `json:"output"`
+	OutputHash string    `json:"outputHash,omitempty"`
+	Finished   time.Time `json:"finished"`
+}
+
+/*A record of the frames traced so far, kept so that a restart does not redo them.*/
+type traceManifest struct {
+	mu     sync.Mutex
+	Frames map[string]frameRecord `json:"frames"`
+}
+
+/*
+Describes an argument to a trace. Files are described by their name, size
+and modification time, so that a dataset or mask rebuilt under the same
+name is told apart, and anything else, such as margins and rules, by
+itself.
+*/
+func fileStamp(name string) string {
+	info, err := os.Stat(name)
+	if err != nil || info.IsDir() {
+		return name
+	}
+	return fmt.Sprintf("%s@%d:%d", name, info.Size(), info.ModTime().UnixNano())
+}
+
+/*
+Describes the parameters of a trace, so that frames traced with different
+ones are not mistaken for each other. The datasets are the arguments
+describing where the grids came from. Everything a trace writes is
+included, so that asking for a heatmap or error statistics traces the
+frames again.
+*/
+func traceParams(datasets []string, opts traceOptions) string {
+	stamps := make([]string, len(datasets))
+	for i, d := range datasets {
+		stamps[i] = fileStamp(d)
+	}
+	mask, labels := opts.mask, opts.labels
+	if mask != "" {
+		mask = fileStamp(mask)
+	}
+	if labels != "" {
+		labels = fileStamp(labels)
+	}
+	return fmt.Sprintf("datasets=%s min=%dx%d max=%dx%d mask=%s labels=%s heatmap=%s stats=%t", strings.Join(stamps, ","), opts.minW, opts.minH, opts.maxW, opts.maxH, mask, labels, opts.heatmap, opts.stats != nil)
+}
+
+/*Hashes a file with SHA-256, returning the hash in hexadecimal.*/
+func hashFile(fName string) (string, error) {
+	f, err := os.Open(fName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+/*
+Starts the record of a frame about to be traced from inPath to outPath,
+with the size and modification time of the input.
+*/
+func newFrameRecord(inPath string, outPath string, params string) frameRecord {
+	rec := frameRecord{Params: params, Output: outPath}
+	if fInfo, err := os.Stat(inPath); err == nil {
+		rec.Size = fInfo.Size()
+		rec.ModTime = fInfo.ModTime()
+	}
+	return rec
+}
+
+/*Finishes the record of a frame once its trace has ended with err.*/
+func finishFrameRecord(rec frameRecord, err error) frameRecord {
+	rec.Finished = time.Now()
+	if err == nil {
+		rec.OutputHash, err = hashFile(rec.Output)
+	}
+	rec.Status = JOB_DONE
+	if err != nil {
+		rec.Status = JOB_FAILED
+		rec.Error = err.Error()
+	}
+	return rec
+}
+
+/*
+Finds the record of a frame if it was last traced from an input of the
+same size and modification time, with the same parameters and output,
+as rec.
+*/
+func (m *traceManifest) unchanged(name string, rec frameRecord) (frameRecord, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	last, found := m.Frames[name]
+	return last, found && last.Size == rec.Size && last.ModTime.Equal(rec.ModTime) && last.Params == rec.Params && last.Output == rec.Output
+}
+
+/*
+Checks whether a frame was traced successfully the same way rec would be,
+to an output which has not changed since.
+*/
+func (m *traceManifest) done(name string, rec frameRecord) bool {
+	last, found := m.unchanged(name, rec)
+	if !found || last.Status != JOB_DONE {
+		return false
+	}
+	hash, err := hashFile(last.Output)
+	return err == nil && hash == last.OutputHash
+}
+
+/*
+Records what became of a frame and saves the manifest to fName. Frames
+may be recorded from several goroutines at once.
+*/
+func (m *traceManifest) record(name string, rec frameRecord, fName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Frames[name] = rec
+	return m.save(fName)
+}
+
+/*Reads a manifest, or starts an empty one if the file does not exist yet.*/
+func loadManifest(fName string) (*traceManifest, error) {
+	m := &traceManifest{Frames: make(map[string]frameRecord)}
+	data, err := os.ReadFile(fName)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid manifest: %w", fName, err)
+	}
+	if m.Frames == nil {
+		m.Frames = make(map[string]frameRecord)
+	}
+	return m, nil
+}
+
+/*
+Writes a manifest under a temporary name and then renames it, so that it
+is never left half-written. The manifest must not be changed meanwhile.
+*/
+func (m *traceManifest) save(fName string) error {
+	data, err := json.MarshalIndent(m, "", "	")
+	if err != nil {
+		return err
+	}
+	tempName := fName + ".tmp"
+	err = os.WriteFile(tempName, data, 0666)
+	if err != nil {
+		return err
 	}
-	return sum + (uint64(minLuma) << 24) + (uint64(maxLuma) << 32)
+	return os.Rename(tempName, fName)
 }
 
-/*A recursive function involved in combining arrays*/
-func combineArraysRec(fileNames []string, a int, b int, margin float64, tNum int) ([]Grid, []uint8, int) {
-	if a < b {
-		array1, naphil1, size1 := combineArraysRec(fileNames, a, a+((b-a)/2), margin, tNum)
-		array2, naphil2, size2 := combineArraysRec(fileNames, a+((b-a)/2)+1, b, margin, tNum)
-		if array1 == nil || size1 == 0 {
-			return array2, naphil2, size2
+/*Checks whether a file name has the extension of an image Luma can read.*/
+func isImageName(fName string) bool {
+	ext := strings.ToUpper(strings.TrimPrefix(filepath.Ext(fName), "."))
+	return slices.Contains([]string{"PNG", "JPG", "JPEG", "BMP", "TIFF", "TIF", "GIF"}, ext)
+}
+
+/*
+The watch command, which traces every image that appears in a folder with
+a dataset loaded once, writing each result under the same name in an
+output folder. A file is only traced once its size and modification time
+have stayed the same for the settle time, so frames still being written
+are left alone. Finished frames are recorded in a manifest, so restarting
+the command does not redo them.
+*/
+func watchMain(args []string) {
+	paths := make([]string, 0)
+	var opts traceOptions
+	tNum := 1
+	interval := 2 * time.Second
+	settle := 2 * time.Second
+	manifestName := ""
+	pprofAddr := ""
+	once := false
+	var err error
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--once" {
+			once = true
+			continue
 		}
-		if array2 == nil || size2 == 0 {
-			return array1, naphil1, size1
+		if !strings.HasPrefix(arg, "-") {
+			paths = append(paths, arg)
+			continue
+		}
+		if i+1 >= len(args) {
+			logError("Please specify a value for " + arg)
+			return
+		}
+		value := args[i+1]
+		i++
+		switch arg {
+		case "--min":
+			opts.minW, opts.minH, err = parseDims(value)
+		case "--max":
+			opts.maxW, opts.maxH, err = parseDims(value)
+		case "--interval":
+			interval, err = time.ParseDuration(value)
+		case "--settle":
+			settle, err = time.ParseDuration(value)
+		case "--manifest":
+			manifestName = value
+		case "--pprof":
+			pprofAddr = value
+		case "-t":
+			tNum, err = strconv.Atoi(value)
+			if err == nil && tNum < 1 {
+				err = fmt.Errorf("thread number %s is not positive", value)
+			}
+		default:
+			err = fmt.Errorf("unknown option %s", arg)
+		}
+		if err != nil {
+			logError("Please specify valid options for watch.")
+			log.Fatal(err)
+			return
 		}
-		return combineArrays(array1, array2, margin, tNum, naphil1, naphil2)
 	}
-	var array []Grid
-	var naphil []uint8
-	var err error
-	var i_, arrayLen int
-	var margInt uint8
-	array, naphil, err = readFromFile(fileNames[a])
+	if len(paths) != 3 {
+		logError("Please specify a dataset, an input folder, and an output folder.")
+		return
+	}
+	if opts.minW == 0 || opts.maxW == 0 {
+		logError("Please specify minimum and maximum grid dimensions with --min and --max.")
+		return
+	}
+	if opts.maxW < opts.minW*2 || opts.maxH < opts.minH*2 {
+		logError("Please specify a maximum size at least twice that of the minimum size, in both width and height.")
+		return
+	}
+	inDir, outDir := paths[1], paths[2]
+	if filepath.Clean(inDir) == filepath.Clean(outDir) {
+		logError("Setting the output folder to the input folder not permitted.")
+		return
+	}
+	err = os.MkdirAll(outDir, 0777)
 	if err != nil {
-		panic("Invalid file")
+		logError("Error creating the output folder")
+		log.Fatal(err)
+		return
 	}
-	i_ = 0
-	arrayLen = len(array)
-	margInt = uint8(256.0 * margin)
-	/*Marks grids with a substantial difference between maximum
-	and minimum value, then sorts.*/
-	for i_ < arrayLen {
-		if array[i_].maxLuma-array[i_].minLuma > margInt {
-			array[i_].dimCornAvg |= 0x0F00000000000000
+	if manifestName == "" {
+		manifestName = filepath.Join(outDir, "luma-manifest.json")
+	}
+	manifest, err := loadManifest(manifestName)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	if pprofAddr != "" {
+		servePprof(pprofAddr)
+	}
+
+	logFile("load", paths[0], "Adding data from "+paths[0])
+	set, _, release, err := readFromFileLazily(paths[0])
+	if err != nil {
+		logError("Please specify a valid dataset.")
+		log.Fatal(err)
+		return
+	}
+	defer release()
+	prepareForTrace(set.array, tNum)
+	set.rule = regionRule{kind: RULE_ALL, lo: 0, hi: 255}
+	sets := []traceSet{set}
+	params := traceParams(paths[:1], opts)
+
+	/*Workers trace frames from the queue and report what became of them*/
+	type frame struct {
+		name   string
+		record frameRecord
+	}
+	queue := make(chan frame)
+	results := make(chan frame)
+	for range tNum {
+		go func() {
+			for f := range queue {
+				logFile("trace", f.name, "Performing luma trace on "+f.name)
+				err := traceFile(filepath.Join(inDir, f.name), f.record.Output, sets, opts, nil)
+				f.record = finishFrameRecord(f.record, err)
+				results <- f
+			}
+		}()
+	}
+
+	/*Files seen but not yet settled, and frames being traced. Frames
+	traced or checked by this run are kept in handled, so that they are
+	not hashed or retried at every poll until they change. Frames which
+	failed are retried when the program restarts.*/
+	handled := &traceManifest{Frames: make(map[string]frameRecord)}
+	seen := make(map[string]frameRecord)
+	seenAt := make(map[string]time.Time)
+	running := make(map[string]bool)
+	ready := make([]frame, 0)
+	logMessage("Watching " + inDir)
+	for {
+		entries, err := os.ReadDir(inDir)
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+		now := time.Now()
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || !isImageName(name) || running[name] || slices.ContainsFunc(ready, func(f frame) bool { return f.name == name }) {
+				continue
+			}
+			fInfo, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			record := frameRecord{Size: fInfo.Size(), ModTime: fInfo.ModTime(), Params: params, Output: filepath.Join(outDir, name)}
+			if _, found := handled.unchanged(name, record); found {
+				continue
+			}
+			if manifest.done(name, record) {
+				handled.Frames[name] = record
+				continue
+			}
+			/*A file which has changed since the last poll starts settling again*/
+			if last, found := seen[name]; !found || last.Size != record.Size || !last.ModTime.Equal(record.ModTime) {
+				seen[name] = record
+				seenAt[name] = now
+				continue
+			}
+			if now.Sub(seenAt[name]) >= settle && record.Size > 0 {
+				delete(seen, name)
+				delete(seenAt, name)
+				ready = append(ready, frame{name: name, record: record})
+			}
+		}
+
+		/*Hand settled frames to the workers while waiting for the next poll*/
+		timer := time.After(interval)
+	waitLoop:
+		for {
+			var send chan frame
+			var next frame
+			if len(ready) > 0 {
+				send = queue
+				next = ready[0]
+			}
+			select {
+			case send <- next:
+				running[next.name] = true
+				ready = ready[1:]
+			case f := <-results:
+				delete(running, f.name)
+				handled.Frames[f.name] = f.record
+				if f.record.Status == JOB_DONE {
+					logFile("output", f.record.Output, "Outputting to "+f.record.Output)
+				} else {
+					writeLog(LOG_QUIET, logEvent{Event: "error", File: f.name}, fmt.Sprintf("Tracing %s failed: %s", f.name, f.record.Error))
+				}
+				err = manifest.record(f.name, f.record, manifestName)
+				if err != nil {
+					logError("Error writing the manifest")
+					log.Fatal(err)
+					return
+				}
+			case <-timer:
+				break waitLoop
+			}
+		}
+		if once && len(seen) == 0 && len(ready) == 0 && len(running) == 0 {
+			return
 		}
-		i_++
 	}
-	parallelSort(array, tNum)
-	return array, naphil, len(array)
 }
 
 func main() {
 	rand.Seed(time.Now().UnixNano())
 
-	proFile, err := os.Create("Luma.prof")
-
+	/*The logging and profiling options apply to every command, so they
+	are taken out of the arguments before anything else reads them.*/
+	rest, err := parseLogOptions(os.Args[1:])
+	if err != nil {
+		logError(err.Error())
+		return
+	}
+	rest, profOpts, err := parseProfileOptions(rest)
+	if err != nil {
+		logError(err.Error())
+		return
+	}
+	os.Args = append(os.Args[:1], rest...)
+	stopProfiling, err := startProfiling(profOpts)
 	if err != nil {
-		fmt.Println(err)
+		logError("Error starting the profiles")
+		log.Fatal(err)
 		return
 	}
+	defer stopProfiling()
 
-	pprof.StartCPUProfile(proFile)
-	defer pprof.StopCPUProfile()
+	/*Commands other than building and tracing come first*/
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		inspectMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "append" {
+		appendMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "filter" {
+		filterMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "compare" {
+		compareMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "coverage" {
+		coverageMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "watch" {
+		watchMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serveMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "export" || os.Args[1] == "import") {
+		atlasMain(os.Args[1], os.Args[2:])
+		return
+	}
 
 	/*The following options are as such:
 	-i	Used to specify an input image or set of input images with a
@@ -2629,6 +7337,24 @@ func main() {
 	-o	Used to specify exactly one output image
 	-k	Used to specify exactly one output file for a grid array
 	-t	Used to specify number of threads in certain processes, default 1
+	-m	Used to specify a mask for a luma trace, either one for every
+		base image or exactly one for all of them
+	-r	Used to specify datasets for regions of a luma trace, each
+		followed by the rule choosing the grids it serves
+	-e	Used to specify a label map for label rules in -r, either one
+		for every base image or exactly one for all of them
+	-w	Used to specify the priority of each input dataset given by -l
+	-z	Used to compress the output file given by -k
+	--max-memory	Used to build the dataset from -i images in chunks
+		fitting in the given amount of memory, e.g. 8G
+	--manifest	Used to specify where a batch of traces records the
+		frames it has finished
+	--resume	Used to skip the frames of a batch already finished
+		with the same parameters
+	--heatmap	Used to write a heatmap of how closely each frame was
+		matched beside its output
+	--error-report	Used to specify a JSON file summarizing how closely
+		each frame was matched
 	*/
 	kArray := make([]string, 0)
 	iArray := make([]string, 0)
@@ -2636,6 +7362,10 @@ func main() {
 	yArray := make([]string, 0)
 	oArray := make([]string, 0)
 	tArray := make([]string, 0)
+	mArray := make([]string, 0)
+	rArray := make([]string, 0)
+	eArray := make([]string, 0)
+	wArray := make([]string, 0)
 	array := make([]Grid, 0)
 	arrayFromImg := make([]Grid, 0)
 	arrayFromFile := make([]Grid, 0)
@@ -2645,6 +7375,15 @@ func main() {
 	var naphilArray []uint8
 	var imageDataNaphil []uint8
 	var fileDataNaphil []uint8
+	var blocks, fileBlocks *pixelBlocks
+	var info, imageInfo, fileInfo datasetInfo
+	compress := false
+	maxMemory := int64(0)
+	manifestName := ""
+	resume := false
+	heatmap := false
+	reportName := ""
+	failedFrames := int32(0)
 	//var traceNaphil []uint8
 	args := os.Args
 	/*The following for loop creates arrays correspdonding to each of the
@@ -2689,13 +7428,55 @@ func main() {
 			fmt.Println("This is Luma. It is a program meant to accept input from an image to create a dataset, use this dataset to trace another image, and recreate that image with the texture of the images used for the dataset. It operates by breaking input images and trace images into fragments, discarding redundant fragments, and replacing fragments of a traced image with fragments from input images. The options for the Luma are as follows:")
 			fmt.Println("	-i	Input one or more images to create a dataset, followed by minimum and maximum dimensions of fragments and the margin of redundancy. For example, 0.1 as a margin will discard a fragment if it is found to be at least 90% similar to another.")
 			fmt.Println("e.g.	-i inputImage.png (inputImage2.png) 4 10 0.2")
+			fmt.Println("	Dimensions can be given as a width and height to bound them separately, up to 2047.")
+			fmt.Println("e.g.	-i inputImage.png 2x8 6x32 0.2")
 			fmt.Println("	-l	Input one or more dataset that has already been generated by Luma. Multiple datasets must be followed by a margin of redundancy as well.")
 			fmt.Println("e.g.	-l dataSet (dataSet2 0.1)")
 			fmt.Println("	-y	Perform a tracing of an image or set of images, with minimum and maximum fragment dimensions.")
 			fmt.Println("e.g	(-i or -l option) -y baseImage.png 4 10")
 			fmt.Println("	-o	Output an image or set of images created by a trace.")
+			fmt.Println("	-w	Give each dataset from -l a priority from 0 to 255, in the same order. When fragments are redundant, the one from the higher-priority source stays, and a trace favours fragments from higher-priority sources by treating others as that many levels of brightness further away per pixel. Datasets without -w keep the priorities saved with them, and fragments from -i images have priority 1.")
+			fmt.Println("e.g.	-l dataSet dataSet2 0.1 -w 3 1")
 			fmt.Println("	-k	Save a dataset")
 			fmt.Println("e.g.	(-i or -l option) -k newDataSet")
+			fmt.Println("	-z	Compress the dataset saved with -k. Compressed datasets are smaller, but are decompressed into memory when loaded instead of being shared between traces.")
+			fmt.Println("e.g.	(-i or -l option) -k newDataSet -z")
+			fmt.Println("	--max-memory	Build the dataset from -i images a few at a time, keeping within roughly this much memory, and merge the results on disk. A K, M, or G suffix counts kibibytes, mebibytes, or gibibytes.")
+			fmt.Println("e.g.	-i image1.png image2.png 4 10 0.05 --max-memory 8G -k newDataSet")
+			fmt.Println("	-t	Use this many threads, 1 unless given. Images and frames are handed to each thread as soon as it is free, and threads left over when there are fewer frames help trace each frame. Removing redundant fragments gives the same result with any number of threads.")
+			fmt.Println("e.g.	(-i or -l option) -y baseImage.png 4 10 -o out.png -t 8")
+			fmt.Println("	--resume	Skip the frames of a batch traced already with the same parameters, from unchanged inputs to unchanged outputs. Datasets, images, masks and label maps count as changed if their size or modification time does, and asking for a heatmap or error report traces the frames again. Batches of more than one frame record the frames they finish in luma-manifest.json beside the output, or in the file given by --manifest.")
+			fmt.Println("e.g.	(-i or -l option) -y frame1.png frame2.png 4 10 -o out%04d.png --resume (--manifest manifest.json)")
+			fmt.Println("	--heatmap	Write a heatmap of how closely each fragment of a frame was matched beside its output, named after it with .heatmap.png. Close matches are blue, running through green and yellow to red at a difference of 64 per pixel, fragments the datasets had no fragments of the same size for are magenta, and fragments copied through are transparent.")
+			fmt.Println("	--error-report	Write the differences between the frames traced and their matches to a JSON file: the mean and percentiles per pixel, the fragments with no candidates of the same size or with none within 255 per pixel, and the same by band of average luma, which shows the tones the datasets are short of. Each frame's summary is also logged.")
+			fmt.Println("e.g.	(-i or -l option) -y frame1.png frame2.png 4 10 -o out%04d.png --heatmap --error-report errors.json")
+			fmt.Println("	-m	Only trace the parts of the base images covered by a mask, copying everything else through untouched. Specify either one mask for all base images or one mask per base image. The alpha channel of a mask is used if it has one, otherwise its brightness.")
+			fmt.Println("e.g.	(-y option) -m mask.png")
+			fmt.Println("	-r	Trace different regions of the base images with different datasets. Each dataset is followed by a rule choosing the fragments it serves: luma:A-B (average brightness), range:A-B (difference between brightest and darkest pixels, high around ink lines), label:N (value of a label map given by -e), or all. The first matching dataset serves a fragment, then the dataset from -i or -l, if any. Fragments no dataset serves are copied through untouched.")
+			fmt.Println("e.g.	-y baseImage.png 4 10 -r ink range:96-255 fills all")
+			fmt.Println("	-e	Label maps for label rules in -r, either one for every base image or one for all of them. A black and white mask is a label map with labels 0 and 255.")
+			fmt.Println("e.g.	-y baseImage.png 4 10 -r backgrounds label:0 characters label:255 -e labels.png")
+			fmt.Println("Datasets can also be examined with the inspect command, optionally as JSON or with a different margin for the shallow/deep split.")
+			fmt.Println("e.g.	inspect dataSet (dataSet2) (--json) (--margin 0.1)")
+			fmt.Println("Datasets can be exported to atlas pages for curation by hand, and imported again. Erasing a tile to transparency deletes it, and painting over it changes it.")
+			fmt.Println("e.g.	export dataSet atlasDirectory (--page 1024x1024)")
+			fmt.Println("e.g.	import atlasDirectory newDataSet (--compress)")
+			fmt.Println("New images can be added to an existing dataset with the append command, without rebuilding it. The dimensions and margin the dataset was built with are used unless given.")
+			fmt.Println("e.g.	append dataSet newDataSet newImage.png (newImage2.png) (--min 4 or 2x8) (--max 10 or 6x32) (--margin 0.05) (--priority 1) (-t 4) (--compress)")
+			fmt.Println("Subsets of datasets can be written with the filter command, selecting fragments by width, height, average, minimum or maximum luma, range, source, depth, or a random sample.")
+			fmt.Println("e.g.	filter dataSet newDataSet (--width 4-6) (--height 4-6) (--avg 200-230) (--min A-B) (--max A-B) (--range 64-255) (--source 'scene12_*.png') (--deep or --shallow) (--margin 0.05) (--sample 0.25) (--seed 1) (--compress)")
+			fmt.Println("Two datasets can be compared with the compare command, which reports how many fragments of the first have an exact copy in the second or are redundant with one of its fragments at the margin, by dimension and average luma. The fragments of the first only it has, and those it shares, can be written as datasets of their own.")
+			fmt.Println("e.g.	compare dataSet dataSet2 (--margin 0.05) (--json) (--minus onlyInFirst) (--intersect inBoth) (-t 4) (--compress)")
+			fmt.Println("Sample frames can be checked against datasets before a trace with the coverage command, which partitions them the way -y would and reports the fragments whose average luma, range and corners no fragment of the same size in the datasets comes within the tolerance of, by dimension, average luma and range.")
+			fmt.Println("e.g.	coverage dataSet (dataSet2) --frames frame1.png (frame2.png) --min 4 --max 10 (--tolerance 16) (--seed 1) (--json) (-t 4)")
+			fmt.Println("Datasets can be kept loaded by the serve command, which traces images submitted over HTTP with a pool of workers. Jobs are submitted to POST /jobs with a path or an uploaded image, and their status and results are at GET /jobs/ID and GET /jobs/ID/result. Finished jobs are forgotten with DELETE /jobs/ID, or once more than --keep of them have finished. Jobs can only read from inside the --root folder and write inside the --dir folder, following symbolic links, requests are limited to --max-upload bytes, and the server listens on localhost unless given --addr.")
+			fmt.Println("e.g.	serve dataSet (dataSet2) --min 4 --max 10 (--addr localhost:8080) (-t 4) (--queue 1024) (--dir jobDirectory) (--root imageDirectory) (--keep 1000) (--max-upload 256M) (--pprof localhost:6060)")
+			fmt.Println("Frames dropped into a folder can be traced as they are finished with the watch command, which keeps a manifest of the frames done so a restart skips them.")
+			fmt.Println("e.g.	watch dataSet inputFolder outputFolder --min 4 --max 10 (-t 4) (--interval 2s) (--settle 2s) (--manifest manifest.json) (--once) (--pprof localhost:6060)")
+			fmt.Println("Progress and errors are logged to standard error, and results to standard output. Any command can be given --quiet to log only errors, --verbose to log more detail, or --log-format json to log one JSON object per line, with the phase, progress, and file of each event.")
+			fmt.Println("e.g.	-i inputImage.png 4 10 0.2 -k newDataSet --log-format json --quiet")
+			fmt.Println("Any command can also write a CPU profile, a heap profile, or an execution trace of its run with --cpuprofile, --memprofile, or --exectrace, which are also written when it is interrupted. serve and watch can serve the pprof endpoints on another address with --pprof.")
+			fmt.Println("e.g.	-l dataSet -y baseImage.png 4 10 -o out.png --cpuprofile cpu.prof --memprofile mem.prof")
 			fmt.Println("The original purpose of this program was to make digitally-created images appear hand-drawn. However, it can be used for texturing of any kind.")
 			return
 		} else if args[i] == "-t" {
@@ -2705,6 +7486,66 @@ func main() {
 				j++
 			}
 			i = j - 1
+		} else if args[i] == "-m" {
+			j := i + 1
+			for j < len(args) && args[j][0] != 45 {
+				mArray = append(mArray, args[j])
+				j++
+			}
+			i = j - 1
+		} else if args[i] == "-r" {
+			j := i + 1
+			for j < len(args) && args[j][0] != 45 {
+				rArray = append(rArray, args[j])
+				j++
+			}
+			i = j - 1
+		} else if args[i] == "-w" {
+			j := i + 1
+			for j < len(args) && args[j][0] != 45 {
+				wArray = append(wArray, args[j])
+				j++
+			}
+			i = j - 1
+		} else if args[i] == "-z" {
+			compress = true
+		} else if args[i] == "--resume" {
+			resume = true
+		} else if args[i] == "--manifest" {
+			if i+1 >= len(args) {
+				logError("Please specify a file after --manifest.")
+				return
+			}
+			manifestName = args[i+1]
+			i++
+		} else if args[i] == "--heatmap" {
+			heatmap = true
+		} else if args[i] == "--error-report" {
+			if i+1 >= len(args) {
+				logError("Please specify a file after --error-report.")
+				return
+			}
+			reportName = args[i+1]
+			i++
+		} else if args[i] == "--max-memory" {
+			if i+1 >= len(args) {
+				logError("Please specify an amount of memory after --max-memory, e.g. 8G.")
+				return
+			}
+			maxMemory, err = parseMemory(args[i+1])
+			if err != nil {
+				logError("Please specify an amount of memory after --max-memory, e.g. 8G.")
+				log.Fatal(err)
+				return
+			}
+			i++
+		} else if args[i] == "-e" {
+			j := i + 1
+			for j < len(args) && args[j][0] != 45 {
+				eArray = append(eArray, args[j])
+				j++
+			}
+			i = j - 1
 		}
 	}
 	/*These handle discoordinate arguments and arguments with an incorrect number of
@@ -2712,71 +7553,122 @@ func main() {
 	*/
 	if len(kArray) == 0 && len(oArray) == 0 {
 		if len(lArray) == 0 && len(iArray) == 0 && len(yArray) == 0 {
-			fmt.Println("See list of options with -h.")
+			logError("See list of options with -h.")
 		} else {
-			fmt.Println("Insufficient arguments, please specify either an output image using -o or an output dataset using -k")
+			logError("Insufficient arguments, please specify either an output image using -o or an output dataset using -k")
 		}
 		return
 	}
 	if len(kArray) > 0 && len(iArray) == 0 && len(lArray) == 0 {
-		fmt.Println("Output dataset specified without specifying input image using -i or input dataset using -l")
+		logError("Output dataset specified without specifying input image using -i or input dataset using -l")
 		return
 	}
-	if len(oArray) > 0 && (len(yArray) == 0 || (len(lArray) == 0 && len(iArray) == 0)) {
-		fmt.Println("Output image specified without base image specified by -y or input image specified with -i or input dataset specified with -l")
+	if len(oArray) > 0 && (len(yArray) == 0 || (len(lArray) == 0 && len(iArray) == 0 && len(rArray) == 0)) {
+		logError("Output image specified without base image specified by -y or input image specified with -i or input dataset specified with -l or -r")
 		return
 	}
 	if len(oArray) > 1 {
-		fmt.Printf("Please specify an output image file or a range with %c%c%cd, with X being the number of leading zeroes.\n", '%', '0', 'X')
+		logError(fmt.Sprintf("Please specify an output image file or a range with %c%c%cd, with X being the number of leading zeroes.", '%', '0', 'X'))
 		return
 	}
-	if len(yArray) > 0 && len(lArray) == 0 && len(iArray) == 0 {
-		fmt.Println("Base image specified without input image specified with -i or input dataset specified with -l")
+	if len(yArray) > 0 && len(lArray) == 0 && len(iArray) == 0 && len(rArray) == 0 {
+		logError("Base image specified without input image specified with -i or input dataset specified with -l or -r")
 		return
 	}
 	if len(yArray) > 0 && len(oArray) == 0 {
-		fmt.Println("Base image specified without output image specified with -o")
+		logError("Base image specified without output image specified with -o")
 		return
 	}
 	if len(kArray) > 1 {
-		fmt.Println("Too many dataset outputs specified. Please specify EXACTLY ONE output dataset.")
+		logError("Too many dataset outputs specified. Please specify EXACTLY ONE output dataset.")
 		return
 	}
 	if len(lArray) == 2 {
-		fmt.Println("Invalid options for dataset inputs. Either specify exactly one input dataset or specify more than one dataset with a margin.")
+		logError("Invalid options for dataset inputs. Either specify exactly one input dataset or specify more than one dataset with a margin.")
 		return
 	}
 	if len(iArray) > 0 && len(iArray) < 4 {
-		fmt.Println("Please specify input image(s), minimum and maximum grid dimensions, and margin, in that exact order.")
+		logError("Please specify input image(s), minimum and maximum grid dimensions, and margin, in that exact order.")
 		return
 	}
 	if len(iArray)-3 > 0x3FFFFF {
-		fmt.Println("Too many images.")
+		logError("Too many images.")
 		return
 	}
 	if len(yArray) > 0 && len(yArray) < 3 {
-		fmt.Println("Please specify at least one base image file, minimum and maximum grid dimensions, in that exact order.")
+		logError("Please specify at least one base image file, minimum and maximum grid dimensions, in that exact order.")
 		return
 	}
 	if len(tArray) > 1 {
-		fmt.Println("Please specify one argument for thread number.")
+		logError("Please specify one argument for thread number.")
+		return
+	}
+	if len(mArray) > 0 && len(yArray) == 0 {
+		logError("Mask specified without base image specified by -y")
+		return
+	}
+	if len(mArray) > 1 && len(mArray) != len(yArray)-2 {
+		logError("Please specify either exactly one mask or one mask for every base image.")
+		return
+	}
+	if (len(rArray) > 0 || len(eArray) > 0) && len(yArray) == 0 {
+		logError("Region datasets or label maps specified without base image specified by -y")
+		return
+	}
+	if len(rArray)%2 != 0 {
+		logError("Please follow every region dataset with exactly one rule.")
+		return
+	}
+	if (resume || manifestName != "") && len(yArray) == 0 {
+		logError("Manifest or resumption specified without base images specified by -y")
+		return
+	}
+	if (heatmap || reportName != "") && len(yArray) == 0 {
+		logError("Heatmap or error report specified without base images specified by -y")
+		return
+	}
+	/*Input datasets keep the priorities saved with them unless given new
+	ones by -w.*/
+	lNum := len(lArray)
+	if lNum > 2 {
+		lNum--
+	}
+	var priorities []uint8
+	if len(wArray) > 0 {
+		priorities = make([]uint8, lNum)
+		if len(lArray) == 0 || len(wArray) != lNum {
+			logError("Please specify exactly one priority for every input dataset specified with -l.")
+			return
+		}
+		for i := range wArray {
+			w, errW := strconv.ParseUint(wArray[i], 10, 8)
+			if errW != nil {
+				logError("Please specify priorities as integers from 0 to 255.")
+				log.Fatal(errW)
+				return
+			}
+			priorities[i] = uint8(w)
+		}
+	}
+	if len(eArray) > 1 && len(eArray) != len(yArray)-2 {
+		logError("Please specify either exactly one label map or one label map for every base image.")
 		return
 	}
 	/*This handles inputting one or more file containing a grid array.*/
 	tNum := 1
 	if len(tArray) == 1 {
 		t64, errT := strconv.ParseUint(tArray[0], 10, 8)
-		tNum := t64
 		if errT != nil {
-			fmt.Println("Please specify an integer for thread number")
-			log.Fatal(err)
+			logError("Please specify an integer for thread number")
+			log.Fatal(errT)
 			return
 		}
+		tNum = int(t64)
 		if tNum < 1 {
-			fmt.Println("Please specify a positive integer for thread number")
+			logError("Please specify a positive integer for thread number")
 			return
 		}
-		fmt.Printf("Thread num: %d\n", tNum)
+		logVerbose(fmt.Sprintf("Thread num: %d", tNum))
 	}
 
 	if len(iArray) > 0 || len(lArray) > 0 {
@@ -2784,19 +7676,15 @@ func main() {
 		margin := float64(-1)
 		/*Take grid data from images*/
 		if len(iArray) > 0 {
-			minIn, errMin := strconv.ParseUint(iArray[len(iArray)-3], 10, 8)
-			maxIn, errMax := strconv.ParseUint(iArray[len(iArray)-2], 10, 8)
-			minIn_64 := uint64(minIn)
-			if maxIn < minIn*2 {
-				fmt.Println("Please specify a maximum size at least twice that of the minimum size.")
+			minW, minH, errMin := parseDims(iArray[len(iArray)-3])
+			maxW, maxH, errMax := parseDims(iArray[len(iArray)-2])
+			if (nil == errMin && nil == errMax) && (maxW < minW*2 || maxH < minH*2) {
+				logError("Please specify a maximum size at least twice that of the minimum size, in both width and height.")
 				return
 			}
-			if maxIn > 255 || minIn > 255 {
-				fmt.Println("Please specify maximum and minimum sizes BELOW 256")
-			}
 			margin, errMarg = strconv.ParseFloat(iArray[len(iArray)-1], 64)
 			if nil != errMin || nil != errMax || nil != errMarg {
-				fmt.Println("Please specify minimum and maximum grid dimensions and margin, in that order, AFTER all input images.")
+				logError("Please specify minimum and maximum grid dimensions and margin, in that order, AFTER all input images.")
 				if nil != errMin {
 					log.Fatal(errMin)
 				} else if nil != errMax {
@@ -2806,451 +7694,35 @@ func main() {
 				}
 				return
 			}
-			startTemp := time.Now().UnixNano()
-			trees := make([]*Tree, len(iArray)-3)
-
-			totalLeafNum := 0
-			fmt.Printf("Generating trees:\n")
-			startTime := time.Now().UnixNano()
-			tempTime := time.Now().UnixNano()
-			var wg sync.WaitGroup
-			widthArray := make([]uint16, len(trees))
-			heightArray := make([]uint16, len(trees))
-			totalArea := 0
-			/*Go image by image*/
-			for jj := 0; jj < len(trees); jj += tNum {
-				if time.Now().UnixNano()-tempTime > 1000000000 {
-					fmt.Printf("%f\n", 100.0*float32(jj)/float32(len(trees)))
-					tempTime = time.Now().UnixNano()
-				}
-				for kk := range tNum {
-					wg.Add(1)
-					go func(kk int) {
-						defer wg.Done()
-						i := jj + kk
-						if i < len(trees) {
-							f, err := os.Open(iArray[i])
-							if err != nil {
-								panic(err)
-							}
-							defer f.Close()
-							config, _, err := image.DecodeConfig(f)
-							if err != nil {
-								panic(err)
-							}
-							w := config.Width
-							h := config.Height
-							if w > 8191 || h > 8191 {
-								fmt.Println("Please choose images with dimensions below 8192.")
-								return
-							}
-							widthArray[i] = uint16(w)
-							heightArray[i] = uint16(h)
-							totalArea += (w * h)
-							/*Generate tree*/
-							trees[i] = generateTree(0, uint64(w), 0, uint64(h), minIn_64, uint64(maxIn), rand.Uint64(), rand.Uint64())
-							totalLeafNum += trees[i].leafNum
-						}
-					}(kk)
-				}
-				wg.Wait()
-			}
-			end := time.Now().UnixNano()
-			timeTotal := (end - startTime)
-			printTime(timeTotal)
-
-			coordArray := make([][]uint64, totalLeafNum)
-			indexArray := make([]int, totalLeafNum)
-			encodedCoordArray := make([]uint64, totalLeafNum)
-			tempLeafNum := 0
-
-			fmt.Printf("Gathering coordinates from trees:\n")
-			tempIndex := 0
-			startTime = time.Now().UnixNano()
-			tempTime = time.Now().UnixNano()
-			/*The changeArray finds where the metadata array changes in terms of the dimensions
-			or source image referred to. Its size will always be
-			(((max-min+1)^2)*img_num)+1
-			where img_num is the number of images.*/
-			img_step := int(maxIn - minIn + 1)
-			img_step *= img_step
-			changeArraySize := img_step * len(trees)
-			changeArraySize++
-			changeArray := make([]int, changeArraySize)
-			changeArray[changeArraySize-1] = totalLeafNum
-			changeArraySize = 1
-			/*Get the total number of leaves which will be the same as the total number of grids.*/
-			for i := range trees {
-				if time.Now().UnixNano()-tempTime > 1000000000 {
-					fmt.Printf("%f\n", 100.0*float32(i)/float32(len(trees)))
-					tempTime = time.Now().UnixNano()
-				}
-				reuse := make([]uint64, 5)
-				coordsFromTree(trees[i], uint64(i), coordArray, tempLeafNum, reuse)
-				/*Encode grid metadata into uint64 array*/
-				encodeCoords(trees[i], uint64(i), encodedCoordArray, tempLeafNum)
-				l := trees[i].leafNum
-				tEnd := tempLeafNum + l
-				/*Sort these grids based on width and height*/
-				sort.Slice(encodedCoordArray[tempLeafNum:tEnd], func(i, j int) bool {
-					return encodedCoordArray[tempLeafNum+i] < encodedCoordArray[tempLeafNum+j]
-				})
-				wh := uint64(0)
-				w_ := 0
-				h_ := 0
-				/*Calculate the offsets for each grid in the naphil array*/
-				for j := tempLeafNum; j < tEnd; j++ {
-					indexArray[j] = tempIndex
-					enc := encodedCoordArray[j]
-					/*If a grid which will not have the same dimensions as
-					the one previous is found, re-extract dimensions.*/
-					if (enc>>26)&0xFFFF != wh {
-						enc >>= 26
-						wh = enc & 0xFFFF
-						h_ = int(enc & 255)
-						enc >>= 8
-						w_ = int(enc & 255)
-					}
-					tempIndex += (w_ * h_)
-				}
-				tempLeafNum = tEnd
-			}
-			x1_ := 0
-			changeArray[0] = 0
-			var m int
-			ignoreCoords := (^uint64(0x3FFFFFF))
-			enc := encodedCoordArray[0]
-			encOld := uint64(0xFFFFFFFFFFFFFFFF)
-			imageEnd := trees[0].leafNum
-			x2_ := imageEnd
-			for x1_ < x2_ {
-				m = x1_ + ((x2_ - x1_) / 2)
-				if encodedCoordArray[m]&ignoreCoords != enc&ignoreCoords {
-					x2_ = m
-				} else {
-					x1_ = m + 1
-				}
-			}
-			for x1_ < totalLeafNum {
-				/*Put the result of the bin search into changeArray*/
-				changeArray[changeArraySize] = x1_
-				/*Increment counter*/
-				changeArraySize++
-				/*Check if the next section of the grids metadata referss to a different
-				source image*/
-				encOld = enc >> 42
-				if x1_ >= totalLeafNum {
-					panic("Out of bounds")
-				}
-				enc = encodedCoordArray[x1_]
-				if enc>>42 != encOld {
-					imageEnd += trees[enc>>42].leafNum
-				}
-				/*Set the end of the next bin search to the last grid to be taken from the
-				same source image*/
-				x2_ = imageEnd
-				/*Peform a binary search for the last grid with equal dimensions
-				and from the same source image as the one at x1_*/
-				for x1_ < x2_ {
-					m = x1_ + ((x2_ - x1_) / 2)
-					if encodedCoordArray[m]&ignoreCoords != enc&ignoreCoords {
-						x2_ = m
-					} else {
-						x1_ = m + 1
-					}
-				}
-			}
-			/*Named after a race of mysterious beings mentioned in Genesis 6, later described of being
-			great stature in Numbers 32 and usually translated as "giants" in other languages. This will
-			indeed be a giant array.*/
-			imageDataNaphil = make([]uint8, indexArray[totalLeafNum-1]+(int(maxIn)*int(maxIn)))
-			end = time.Now().UnixNano()
-			timeTotal = (end - startTemp)
-			printTime(timeTotal)
-
-			arrayFromImg = make([]Grid, totalLeafNum)
-			tempLeafNum = 0
-			fmt.Printf("Generating grids:\n")
-			startTime = time.Now().UnixNano()
-			tempTime = time.Now().UnixNano()
-
-			margInt := uint8(margin * 256.0)
-
-			for jj := 0; jj < len(trees); jj += int(tNum) {
-				tln := 0
-				for j := range jj {
-					tln += trees[j].leafNum
-				}
-				if time.Now().UnixNano()-tempTime > 1000000000 {
-					fmt.Printf("%f\n", 100.0*float32(jj)/float32(len(iArray)-3))
-					tempTime = time.Now().UnixNano()
-				}
-				for kk := range int(tNum) {
-					wg.Add(1)
-					go func(kk int) {
-						defer wg.Done()
-						i := jj + kk
-						i_64 := uint64(i)
-						/*If cursor points to a valid image*/
-						if i < len(trees) {
-							/*Retrive the width of the image, store it as a signed value*/
-							imgW_64 := uint64(widthArray[i])
-							imgH_64 := uint64(heightArray[i])
-							imgW_signed := int(imgW_64)
-							/*Get a grayscale representation of the same image*/
-							pix_data := func(iArray []string, i int) []uint8 {
-								grayImg := gocv.IMRead(iArray[i], gocv.IMReadGrayScale)
-
-								if grayImg.Empty() {
-									panic("Error loading image")
-								}
-								defer grayImg.Close()
-
-								return grayImg.ToBytes()
-							}(iArray, i)
-							/*Find the part of the change array which refer to this image, set a loop to
-							these endpoints*/
-							cng_start := i * img_step
-							cng_end := cng_start + img_step
-							for c_outer := cng_start; c_outer < cng_end; c_outer++ {
-								/*Get the encoded metadata for the first grid in the segment, and ignore
-								all bits besides those containing grid dimensions. Extract these dimensions
-								and save the 16 bits containing all of them for when the dimCornAvg of
-								individual grids is set.*/
-								enc_start := (encodedCoordArray[changeArray[c_outer]] >> 26) & 0xFFFF
-								h_64 := enc_start & 255
-								h_signed := int(h_64)
-								h_8 := uint8(h_64)
-								w_64 := (enc_start >> 8) & 255
-								w_signed := int(w_64)
-								w_8 := uint8(w_64)
-								/*Get the end of the loop for the current segment*/
-								loop_end := changeArray[c_outer+1]
-								area := w_64 * h_64
-								area_signed := h_signed * w_signed
-								var enc, x1, y1, y2, sum, avg, dimCornAvg, crnr_64, corners uint64
-								var x1_signed, offset, offset_n, end_n, start_p, end_p /*, j, end*/ int
-								var y_offset, y2_signed int
-								var maxLuma, minLuma, crnr uint8
-								for c_sub := changeArray[c_outer]; c_sub < loop_end; c_sub++ {
-									/*Get the metadata for an individual grid*/
-									enc = encodedCoordArray[c_sub]
-									if (enc >> 42) != i_64 {
-										panic("Wrong image")
-									}
-									if (enc>>26)&0xFFFF != enc_start {
-										panic("Wrong dimensions")
-									}
-									/*Extract the coordinates from the metadata*/
-									y1 = (^enc) & 8191
-									enc >>= 13
-									x1 = (^enc) & 8191
-									y2 = y1 + h_64
-									if y1 > imgH_64 || y2 > imgH_64 || x1 > imgW_64 || x1+w_64 > imgW_64 {
-										panic("Wrong coordinates")
-									}
-									y2_signed = int(y2)
-									x1_signed = int(x1)
-									offset = indexArray[c_sub]
-									/*The variables offset_n and end_n are endpoints of the naphil array. They increment by the grid's
-									width.*/
-									end_n = offset + w_signed
-									offset_n = offset
-									offset_end := offset + area_signed
-									y_offset = int(y1)
-									/*The variables start_p and end_p are endpoints of the array containing image data. They increment
-									by the image's width.*/
-									start_p = (int(y1) * imgW_signed) + x1_signed
-									end_p = start_p + w_signed
-									/*Copy data from the image into the naphil array*/
-									for y_offset < y2_signed {
-										copy(imageDataNaphil[offset_n:end_n], pix_data[start_p:end_p])
-										offset_n += w_signed
-										end_n += w_signed
-										start_p += imgW_signed
-										end_p += imgW_signed
-										y_offset++
-										if y_offset >= y2_signed {
-											break
-										}
-										copy(imageDataNaphil[offset_n:end_n], pix_data[start_p:end_p])
-										offset_n += w_signed
-										end_n += w_signed
-										start_p += imgW_signed
-										end_p += imgW_signed
-										y_offset++
-										if y_offset >= y2_signed {
-											break
-										}
-										copy(imageDataNaphil[offset_n:end_n], pix_data[start_p:end_p])
-										offset_n += w_signed
-										end_n += w_signed
-										start_p += imgW_signed
-										end_p += imgW_signed
-										y_offset++
-										if y_offset >= y2_signed {
-											break
-										}
-										copy(imageDataNaphil[offset_n:end_n], pix_data[start_p:end_p])
-										offset_n += w_signed
-										end_n += w_signed
-										start_p += imgW_signed
-										end_p += imgW_signed
-										y_offset++
-									}
-
-									/*Add the corners to the total sum, which will be used to calculate
-									the average later*/
-								minMaxLoopStart:
-									crnr = imageDataNaphil[offset]
-									maxLuma = crnr
-									minLuma = crnr
-									crnr_64 = uint64(crnr)
-									corners = crnr_64
-									sum = crnr_64
-									corners <<= 8
-
-									crnr = imageDataNaphil[offset+w_signed-1]
-									if crnr > maxLuma {
-										maxLuma = crnr
-									} else if crnr < minLuma {
-										minLuma = crnr
-									}
-									crnr_64 = uint64(crnr)
-									corners += crnr_64
-									sum += crnr_64
-									corners <<= 8
-
-									crnr = imageDataNaphil[offset_end-w_signed]
-									if crnr > maxLuma {
-										maxLuma = crnr
-									} else if crnr < minLuma {
-										minLuma = crnr
-									}
-									crnr_64 = uint64(crnr)
-									corners += crnr_64
-									sum += crnr_64
-									corners <<= 8
-
-									crnr = imageDataNaphil[offset_end-1]
-									if crnr > maxLuma {
-										maxLuma = crnr
-									} else if crnr < minLuma {
-										minLuma = crnr
-									}
-									crnr_64 = uint64(crnr)
-									corners += crnr_64
-									sum += crnr_64
-									/*Check for the minimum and maximum values of all pixels except the corners,
-									while adding them to the sum. A sweep is done for the top and bottom rows,
-									and another for everything else.*/
-									if minLuma != 0 || maxLuma != 255 {
-										minMaxSum_result := minMaxSum(imageDataNaphil, offset+1, offset+w_signed-1, minLuma, maxLuma)
-										sum += (minMaxSum_result & 0xFFFFFF)
-										minMaxSum_result >>= 24
-										minLuma = uint8(minMaxSum_result & 0xFF)
-										minMaxSum_result >>= 8
-										maxLuma = uint8(minMaxSum_result & 0xFF)
-									} else {
-										sum += sumNaphil(imageDataNaphil, offset+1, offset+w_signed-1)
-									}
-									if minLuma != 0 || maxLuma != 255 {
-										minMaxSum_result := minMaxSum(imageDataNaphil, offset_end-w_signed+1, offset_end-1, minLuma, maxLuma)
-										sum += (minMaxSum_result & 0xFFFFFF)
-										minMaxSum_result >>= 24
-										minLuma = uint8(minMaxSum_result & 0xFF)
-										minMaxSum_result >>= 8
-										maxLuma = uint8(minMaxSum_result & 0xFF)
-									} else {
-										sum += sumNaphil(imageDataNaphil, offset_end-w_signed+1, offset_end-1)
-									}
-									if minLuma != 0 || maxLuma != 255 {
-										minMaxSum_result := minMaxSum(imageDataNaphil, offset+w_signed, offset_end-w_signed, minLuma, maxLuma)
-										sum += (minMaxSum_result & 0xFFFFFF)
-										minMaxSum_result >>= 24
-										minLuma = uint8(minMaxSum_result & 0xFF)
-										minMaxSum_result >>= 8
-										maxLuma = uint8(minMaxSum_result & 0xFF)
-									} else {
-										sum += sumNaphil(imageDataNaphil, offset+w_signed, offset_end-w_signed)
-									}
-
-									/*Calculate the average*/
-									avg = sum / area
-									if avg > 255 {
-										panic("Invalid average.")
-									}
-									if uint8(avg) < minLuma || uint8(avg) > maxLuma {
-										goto minMaxLoopStart
-									}
-
-									/*The main purpose of dimCornAvg is for sorting. The intended algorithm is to sort all
-									"shallow" grids (those with relatively low differences between min and max values) at
-									the beginning, before all "deep" grids (those with relatively high differences). Then,
-									the grids are to be sorted by width, height, average luma, and finally their corners.
-									Since the actual difference between min and max is less important than the binary
-									"deep-shallow" distinction, "deep" grids have some of the top bits set.
-									The variable enc_start from earlier contains the width of the grid as its most signifcant
-									eight bits and height as its least significant.*/
-									dimCornAvg = uint64(0)
-									if maxLuma-minLuma > margInt {
-										dimCornAvg = 15
-									}
-									dimCornAvg <<= 16
-									dimCornAvg += enc_start
-									dimCornAvg <<= 8
-									dimCornAvg += avg
-									dimCornAvg <<= 32
-									dimCornAvg += corners
-									func() {
-										arrayFromImg[c_sub] = Grid{
-											w__:        w_8,
-											h__:        h_8,
-											minLuma:    minLuma,
-											maxLuma:    maxLuma,
-											avgLuma:    uint8(avg),
-											dimCornAvg: dimCornAvg,
-											offset:     offset,
-										}
-									}()
-								}
-							}
-						}
-					}(kk)
+			if maxMemory > 0 {
+				var release func() error
+				arrayFromImg, imageDataNaphil, imageInfo, release, err = buildFromImagesStreaming(iArray[:len(iArray)-3], minW, maxW, minH, maxH, margin, tNum, maxMemory)
+				if nil != err {
+					logError("Please specify valid input images.")
+					log.Fatal(err)
+					return
 				}
-				wg.Wait()
+				/*The pixels are mapped from a temporary file, which is kept until the dataset has been written*/
+				defer release()
+			} else {
+				arrayFromImg, imageDataNaphil, imageInfo = buildFromImages(iArray[:len(iArray)-3], minW, maxW, minH, maxH, margin, tNum)
 			}
-			end = time.Now().UnixNano()
-			timeTotal = (end - startTemp)
-			printTime(timeTotal)
-
 			arrayImgLen = len(arrayFromImg)
-
-			fmt.Printf("Sorting started\n")
-			parallelSort(arrayFromImg, tNum)
-			fmt.Printf("Sorting completed\n")
-
-			if margin > 0 {
-				fmt.Println("Removing redundant grids")
-				start = time.Now().UnixNano()
-				startTemp = time.Now().UnixNano()
-				arrayFromImg = removeRedundantGrids(arrayFromImg, margin, tNum, imageDataNaphil)
-				end = time.Now().UnixNano()
-				arrayImgLen = len(arrayFromImg)
-				timeTotal := (end - startTemp)
-				printTime(timeTotal)
-			}
 		}
 		/*Take grid data from files previously created by Luma*/
 		if len(lArray) > 0 {
 			if len(lArray) == 1 {
-				fmt.Println("Adding data from " + lArray[0])
-				arrayFromFile, fileDataNaphil, err = readFromFile(lArray[0])
+				logFile("load", lArray[0], "Adding data from "+lArray[0])
+				var fileSet traceSet
+				var release func() error
+				fileSet, fileInfo, release, err = readFromFileLazily(lArray[0])
 				if nil != err {
-					fmt.Println("Please specify valid filenames for all input datasets.")
+					logError("Please specify valid filenames for all input datasets.")
 					log.Fatal(err)
 					return
 				}
+				defer release()
+				arrayFromFile, fileDataNaphil, fileBlocks = fileSet.array, fileSet.naphil, fileSet.blocks
 				arrayFileLen = len(arrayFromFile)
 				for i := range arrayFileLen {
 					for arrayFromFile[i].getW() < 1 || arrayFromFile[i].getH() < 1 {
@@ -3258,7 +7730,15 @@ func main() {
 						arrayFileLen--
 					}
 				}
-				fmt.Printf("%v\n", len(arrayFromFile))
+				if priorities != nil {
+					for i := range arrayFromFile {
+						arrayFromFile[i].priority = priorities[0]
+					}
+					for i := range fileInfo.Sources {
+						fileInfo.Sources[i].Priority = priorities[0]
+					}
+				}
+				logVerbose(fmt.Sprintf("%d fragments in %s", len(arrayFromFile), lArray[0]))
 			}
 			/*If there are multiple arguments for -l, a margin must go at the end, following
 			VALID filenames.*/
@@ -3266,49 +7746,77 @@ func main() {
 				if margin < 0 {
 					margin, err = strconv.ParseFloat(lArray[len(lArray)-1], 64)
 					if nil != err {
-						fmt.Println("Please specify margin AFTER all input datasets.")
+						logError("Please specify margin AFTER all input datasets.")
 						log.Fatal(err)
 						return
 					}
 				}
-				fmt.Println("Merging datasets...")
-				arrayFromFile, fileDataNaphil, arrayFileLen = combineArraysRec(lArray, 0, len(lArray)-2, margin, tNum)
-				fmt.Println("Datasets merged.")
+				logMessage("Merging datasets...")
+				var release func() error
+				arrayFromFile, fileDataNaphil, arrayFileLen, fileInfo, release = combineArraysRec(lArray, priorities, 0, len(lArray)-2, margin, tNum)
+				defer release()
+				logMessage("Datasets merged.")
 			}
 		}
 		/*Combine data derived from both images and files*/
 		if len(iArray) > 0 && len(lArray) > 0 {
+			err = fileBlocks.loadAll()
+			if nil != err {
+				logError("Please specify valid filenames for all input datasets.")
+				log.Fatal(err)
+				return
+			}
+			info = mergeDatasetInfo(imageInfo, fileInfo, arrayFromFile, margin)
 			array, naphilArray, arrayLen = combineArrays(arrayFromImg, arrayFromFile, margin, tNum, imageDataNaphil, fileDataNaphil)
 		} else if len(iArray) == 0 {
 			array = arrayFromFile
 			naphilArray = fileDataNaphil
+			blocks = fileBlocks
 			arrayLen = arrayFileLen
+			info = fileInfo
 		} else {
 			array = arrayFromImg
 			naphilArray = imageDataNaphil
 			arrayLen = arrayImgLen
+			info = imageInfo
 		}
 	}
 	/*Trace an image*/
 	if len(yArray) >= 3 {
-		i_ := 0
-		for i_ < arrayLen {
-			g := array[i_]
-			d := g.dimCornAvg
-			d &= 0x00FFFFFF00000000
-			maxL := g.maxLuma
-			minL := g.minLuma
-			d += (uint64(maxL-minL) << 24)
-			d += (uint64(minL) << 16)
-			d += (uint64(maxL) << 8)
-			array[i_].dimCornAvg = d
-			i_++
+		/*Region datasets come first, in the order given, followed by the
+		dataset from -i or -l for all remaining grids.*/
+		sets := make([]traceSet, 0, (len(rArray)/2)+1)
+		for r := 0; r < len(rArray); r += 2 {
+			rule, err := parseRegionRule(rArray[r+1])
+			if nil != err {
+				logError("Please specify a valid rule after every region dataset.")
+				log.Fatal(err)
+				return
+			}
+			logFile("load", rArray[r], "Adding region data from "+rArray[r])
+			regionSet, _, release, err := readFromFileLazily(rArray[r])
+			if nil != err {
+				logError("Please specify valid filenames for all region datasets.")
+				log.Fatal(err)
+				return
+			}
+			defer release()
+			if len(regionSet.array) == 0 {
+				logError("Region dataset " + rArray[r] + " is empty.")
+				return
+			}
+			prepareForTrace(regionSet.array, tNum)
+			regionSet.rule = rule
+			sets = append(sets, regionSet)
 		}
-		parallelSort(array, tNum)
-		minIn, errMin := strconv.ParseUint(yArray[len(yArray)-2], 10, 8)
-		maxIn, errMax := strconv.ParseUint(yArray[len(yArray)-1], 10, 8)
+		if arrayLen > 0 {
+			prepareForTrace(array[:arrayLen], tNum)
+			sets = append(sets, traceSet{array: array[:arrayLen], naphil: naphilArray, blocks: blocks, rule: regionRule{kind: RULE_ALL, lo: 0, hi: 255}})
+		}
+		minW, minH, errMin := parseDims(yArray[len(yArray)-2])
+		maxW, maxH, errMax := parseDims(yArray[len(yArray)-1])
 		if nil != errMin || nil != errMax {
-			fmt.Println("Please specify minimum and maximum grid dimensions and margin, in that order, AFTER all input images.")
+			logError("Please specify minimum and maximum grid dimensions and margin, in that order, AFTER all input images.")
 			if nil != errMin {
 				log.Fatal(errMin)
 			}
@@ -3317,8 +7825,8 @@ func main() {
 			}
 			return
 		}
-		if minIn > 255 || maxIn > 255 {
-			fmt.Println("Please specify minimum and maximum values BELOW 256.")
+		if maxW < minW*2 || maxH < minH*2 {
+			logError("Please specify a maximum size at least twice that of the minimum size, in both width and height.")
 			return
 		}
 		leadingZeroes := uint8(0)
@@ -3357,7 +7865,7 @@ func main() {
 					}
 				}
 				if foundExt != 0 {
-					fmt.Printf("Please note, there is a file extension without a digit string. The extension will be subsumed into the file prefix. Digit strings are written '%c0Xd', where 'X' is the number of leading zeroes.\n", '%')
+					logMessage(fmt.Sprintf("Please note, there is a file extension without a digit string. The extension will be subsumed into the file prefix. Digit strings are written '%c0Xd', where 'X' is the number of leading zeroes.", '%'))
 					foundExt = 1
 				}
 				outputPrefix = oArray[0]
@@ -3367,14 +7875,14 @@ func main() {
 					leadingZeroes++
 				}
 			} else if len(matches) > 1 {
-				fmt.Println("Please specify exactly one digit string.")
+				logError("Please specify exactly one digit string.")
 				return
 			} else {
 				prefEnd := strings.Index(oArray[0], matches[0])
 				outputPrefix = oArray[0][:prefEnd]
 				zz, err := strconv.ParseUint(string(matches[0][2:3]), 10, 8)
 				if nil != err {
-					fmt.Printf("Digit string not accepted: %s\n", matches[0])
+					logError("Digit string not accepted: " + matches[0])
 					log.Fatal(err)
 					return
 				}
@@ -3406,12 +7914,12 @@ func main() {
 						outputSuffix += fmt.Sprintf("%s%s", ".", commonImageFormats[extCursor])
 						/*The input filenames collectively include mutliple common extensions.*/
 					} else if k < cifLength-1 {
-						fmt.Println("Multiple extensions found among input files. Defaulting to PNG for output.")
+						logMessage("Multiple extensions found among input files. Defaulting to PNG for output.")
 						outputSuffix += ".png"
 					}
 					/*The input filenames do not collectively include any (common) file extensions.*/
 				} else {
-					fmt.Println("No valid extensions found among input files.")
+					logError("No valid extensions found among input files.")
 					return
 				}
 			}
@@ -3426,57 +7934,105 @@ func main() {
 		for i := range outputFileNames {
 			for j := range len(yArray) - 2 {
 				if strings.Compare(outputFileNames[i], yArray[j]) == 0 {
-					fmt.Println("Setting output file name to input file name not permitted.")
+					logError("Setting output file name to input file name not permitted.")
 					return
 				}
 			}
 		}
 
-		var wg sync.WaitGroup
-
-		start = time.Now().UnixNano()
-		for i := 0; i < len(yArray)-2; i += tNum {
-			for j := range tNum {
-				wg.Add(1)
-				go func(i, j int) {
-					defer wg.Done()
-					if i+j < len(yArray)-2 {
-						k := i + j
-						img, err := openImage(yArray[k])
-						if nil != err {
-							fmt.Println("Please specify valid filenames for every input image.")
-							log.Fatal(err)
-							return
-						}
-						imgBnd := img.Bounds()
-						w := imgBnd.Max.X
-						h := imgBnd.Max.Y
-						t := generateTree(0, uint64(w), 0, uint64(h), uint64(minIn), uint64(maxIn), rand.Uint64(), rand.Uint64())
-
-						fmt.Println("Performing luma trace on " + yArray[k])
-						grayImg := gocv.IMRead(yArray[k], gocv.IMReadGrayScale)
-
-						if grayImg.Empty() {
-							fmt.Println("Error loading image")
-							os.Exit(1)
-						}
-						defer grayImg.Close()
-
-						pix_data := grayImg.ToBytes()
-						pix_data_out := lumaTrace(w, h, pix_data, array, arrayLen, t, naphilArray)
-
-						matOut, err := gocv.NewMatFromBytes(h, w, gocv.MatTypeCV8U, pix_data_out)
-
-						fmt.Println("Outputting to " + outputFileNames[k])
-						gocv.IMWrite(outputFileNames[k], matOut)
-
-					}
-				}(i, j)
+		/*Batches of more than one frame record every frame they finish in a
+		manifest, so that they can be resumed if they stop partway.*/
+		var manifest *traceManifest
+		if len(yArray)-2 > 1 || manifestName != "" || resume {
+			if manifestName == "" {
+				manifestName = filepath.Join(filepath.Dir(outputFileNames[0]), "luma-manifest.json")
+			}
+			manifest, err = loadManifest(manifestName)
+			if err != nil {
+				log.Fatal(err)
+				return
+			}
+		}
+		datasets := slices.Concat(iArray, lArray, rArray, wArray)
+
+		/*Frames are traced by a pool of workers, each taking the next frame as
+		soon as it finishes its last. When there are fewer frames than threads,
+		the threads left over are shared between the frames, so that a single
+		large frame also uses every thread.*/
+		frameNum := len(yArray) - 2
+		workers := min(tNum, frameNum)
+		var frameStats []*traceStats
+		if heatmap || reportName != "" {
+			frameStats = make([]*traceStats, frameNum)
+		}
+		progress := newProgressLog(LOG_NORMAL, "tracing", "Tracing frames", frameNum)
+		workerPool(frameNum, workers, func(k int) {
+			defer progress.add(1)
+			job := traceOptions{minW: minW, maxW: maxW, minH: minH, maxH: maxH, threads: tNum / workers}
+			if heatmap {
+				job.heatmap = strings.TrimSuffix(outputFileNames[k], filepath.Ext(outputFileNames[k])) + ".heatmap.png"
+			}
+			if len(mArray) > 0 {
+				job.mask = mArray[min(k, len(mArray)-1)]
+			}
+			if len(eArray) > 0 {
+				job.labels = eArray[min(k, len(eArray)-1)]
+			}
+			if frameStats != nil {
+				job.stats = &traceStats{}
+			}
+			rec := newFrameRecord(yArray[k], outputFileNames[k], traceParams(datasets, job))
+			if resume && manifest.done(yArray[k], rec) {
+				logFile("skip", yArray[k], "Skipping "+yArray[k]+", already traced")
+				return
+			}
+			logFile("trace", yArray[k], "Performing luma trace on "+yArray[k])
+			err := traceFile(yArray[k], outputFileNames[k], sets, job, nil)
+			if manifest != nil {
+				errM := manifest.record(yArray[k], finishFrameRecord(rec, err), manifestName)
+				if errM != nil {
+					logError("Error writing the manifest")
+					log.Fatal(errM)
+					return
+				}
+			}
+			if nil != err {
+				writeLog(LOG_QUIET, logEvent{Event: "error", File: yArray[k]}, fmt.Sprintf("Tracing %s failed: %s", yArray[k], err))
+				atomic.AddInt32(&failedFrames, 1)
+				return
+			}
+			logFile("output", outputFileNames[k], "Outputting to "+outputFileNames[k])
+			if job.heatmap != "" {
+				logFile("output", job.heatmap, "Outputting heatmap to "+job.heatmap)
+			}
+			if job.stats != nil {
+				frameStats[k] = job.stats
+				st := job.stats
+				logFile("quality", yArray[k], fmt.Sprintf("Matched %s with a mean difference of %.1f per pixel (50%% %.1f, 90%% %.1f, 99%% %.1f), %d of %d grids without candidates of their size, %d at the ceiling", yArray[k], st.Mean, st.P50, st.P90, st.P99, st.NoCandidates, st.Traced, st.Ceiling))
+			}
+		})
+		progress.finish(frameNum - int(failedFrames))
+
+		/*The report lists the frames traced by this run, leaving out any
+		skipped or failed.*/
+		if reportName != "" {
+			report := make([]*traceStats, 0, frameNum)
+			for _, st := range frameStats {
+				if st != nil {
+					report = append(report, st)
+				}
+			}
+			data, err := json.MarshalIndent(report, "", "  ")
+			if err == nil {
+				err = os.WriteFile(reportName, append(data, '\n'), 0644)
+			}
+			if err != nil {
+				logError("Error writing the error report")
+				log.Fatal(err)
+				return
 			}
-			wg.Wait()
+			logFile("output", reportName, "Outputting error report to "+reportName)
 		}
-		end := time.Now().UnixNano()
-		printTime(end - start)
 	}
 	if len(kArray) == 1 {
 		/*Sort based on range and max and then output*/
@@ -3485,7 +8041,7 @@ func main() {
 			for i_ < arrayLen {
 				g := array[i_]
 				d := g.dimCornAvg
-				d &= 0x00FFFFFF00000000
+				d &= DIM_64 | AVG_64
 				maxL := g.maxLuma
 				d += (uint64(maxL-g.minLuma) << 24)
 				d += (uint64(maxL) << 16)
@@ -3494,7 +8050,22 @@ func main() {
 			}
 		}
 		parallelSort(array, tNum)
-		fmt.Printf("Writing to file\n")
-		writeToFile(array, arrayLen, kArray[0], naphilArray)
+		/*A compressed dataset loaded with -l is only decompressed as far as a trace needed*/
+		err = blocks.loadAll()
+		if err != nil {
+			logError("Please specify valid filenames for all input datasets.")
+			log.Fatal(err)
+		}
+		progress := newProgressLog(LOG_NORMAL, "writing", "Writing to file", arrayLen)
+		err = writeToFile(array, arrayLen, kArray[0], naphilArray, info, compress)
+		progress.finish(arrayLen)
+		if err != nil {
+			logError("Error writing dataset")
+			log.Fatal(err)
+		}
+	}
+	if failedFrames > 0 {
+		logError("Please specify valid base images, and masks and label maps matching their dimensions.")
+		log.Fatal(fmt.Errorf("%d of %d frames failed", failedFrames, len(yArray)-2))
 	}
 }
@@ -0,0 +1,1229 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"image"
+	"image/png"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/golden.json with the current results")
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	logLevel = LOG_QUIET
+	os.Exit(m.Run())
+}
+
+/*
+Replaces the random numbers splitting images into fragments with a
+seeded source for the rest of a test.
+*/
+func seedRandom(tb testing.TB, seed int64) {
+	r := rand.New(rand.NewSource(seed))
+	var mu sync.Mutex
+	old := randomUint64
+	randomUint64 = func() uint64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return r.Uint64()
+	}
+	tb.Cleanup(func() {
+		randomUint64 = old
+	})
+}
+
+/*
+A synthetic grayscale image standing in for a reference still: a
+gradient under soft discs, dark lines like ink, and a little noise, so
+that its grids cover most averages and ranges.
+*/
+func syntheticPixels(w int, h int, seed int64) []uint8 {
+	r := rand.New(rand.NewSource(seed))
+	pix := make([]uint8, w*h)
+	for y := range h {
+		for x := range w {
+			pix[y*w+x] = uint8((x*160)/w + (y*64)/h + r.Intn(16))
+		}
+	}
+	for range (w * h) / 4096 {
+		cx, cy, radius := r.Intn(w), r.Intn(h), 4+r.Intn(24)
+		luma := r.Intn(256)
+		for y := max(0, cy-radius); y < min(h, cy+radius); y++ {
+			for x := max(0, cx-radius); x < min(w, cx+radius); x++ {
+				d := (x-cx)*(x-cx) + (y-cy)*(y-cy)
+				if d < radius*radius {
+					p := &pix[y*w+x]
+					*p = uint8((int(*p) + luma) / 2)
+				}
+			}
+		}
+	}
+	for range (w * h) / 16384 {
+		x, y := r.Intn(w), r.Intn(h)
+		for range w / 2 {
+			if x < 0 || x >= w || y < 0 || y >= h {
+				break
+			}
+			pix[y*w+x] = uint8(r.Intn(32))
+			x += r.Intn(3) - 1
+			y += r.Intn(3) - 1
+		}
+	}
+	return pix
+}
+
+/*Writes a synthetic image to a PNG file in dir and returns its path.*/
+func writeSyntheticImage(tb testing.TB, dir string, name string, w int, h int, seed int64) string {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	copy(img.Pix, syntheticPixels(w, h, seed))
+	path := filepath.Join(dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	err = png.Encode(f, img)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+/*
+Builds a dataset from two synthetic images with a fixed seed, with
+fragments from 4x4 to 10x10 and the given margin.
+*/
+func syntheticDataset(tb testing.TB, w int, h int, margin float64) ([]Grid, []uint8, datasetInfo) {
+	seedRandom(tb, 1)
+	dir := tb.TempDir()
+	paths := []string{
+		writeSyntheticImage(tb, dir, "ref1.png", w, h, 1),
+		writeSyntheticImage(tb, dir, "ref2.png", w, h, 2),
+	}
+	return buildFromImages(paths, 4, 10, 4, 10, margin, 1)
+}
+
+/*Hashes the metadata and pixels of every grid of a dataset.*/
+func hashDataset(array []Grid, naphilArray []uint8) string {
+	h := sha256.New()
+	var entry [24]byte
+	for _, g := range array {
+		area := int(g.getW()) * int(g.getH())
+		binary.LittleEndian.PutUint64(entry[0:8], g.dimCornAvg&^STATE_64)
+		entry[8], entry[9], entry[10] = g.avgLuma, g.minLuma, g.maxLuma
+		entry[11] = g.priority
+		binary.LittleEndian.PutUint32(entry[12:16], g.source)
+		binary.LittleEndian.PutUint64(entry[16:24], uint64(area))
+		h.Write(entry[:])
+		h.Write(naphilArray[g.offset : g.offset+area])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func hashPixels(pix []uint8) string {
+	sum := sha256.Sum256(pix)
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+Compares a result with the one recorded in testdata/golden.json, or
+records it if the tests are run with -update.
+*/
+func checkGolden(t *testing.T, name string, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", "golden.json")
+	golden := make(map[string]string)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &golden)
+	}
+	if err != nil && !(*update && os.IsNotExist(err)) {
+		t.Fatal(err)
+	}
+	if *update {
+		golden[name] = got
+		data, err = json.MarshalIndent(golden, "", "\t")
+		if err == nil {
+			err = os.MkdirAll("testdata", 0777)
+		}
+		if err == nil {
+			err = os.WriteFile(path, append(data, '\n'), 0666)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if golden[name] != got {
+		t.Errorf("%s is %s, want %s from %s; run go test -update if the change is intended", name, got, golden[name], path)
+	}
+}
+
+/*Gathers the leaves of a tree.*/
+func treeLeaves(t *Tree, leaves []*Tree) []*Tree {
+	if t.hasChildren == 0 {
+		return append(leaves, t)
+	}
+	leaves = treeLeaves(t.lTree, leaves)
+	return treeLeaves(t.rTree, leaves)
+}
+
+func TestGenerateTreeTilesImage(t *testing.T) {
+	cases := []struct {
+		w, h                   int
+		minW, maxW, minH, maxH uint64
+	}{
+		{64, 64, 4, 10, 4, 10},
+		{300, 17, 4, 10, 4, 10},
+		{128, 96, 2, 6, 8, 32},
+		{1000, 1000, 16, 400, 16, 400},
+	}
+	for _, c := range cases {
+		for seed := range int64(4) {
+			seedRandom(t, seed)
+			tree := generateTree(0, uint64(c.w), 0, uint64(c.h), c.minW, c.maxW, c.minH, c.maxH, randomUint64(), randomUint64())
+			leaves := treeLeaves(tree, nil)
+			if len(leaves) != tree.leafNum {
+				t.Fatalf("%dx%d: %d leaves, leafNum %d", c.w, c.h, len(leaves), tree.leafNum)
+			}
+			covered := make([]bool, c.w*c.h)
+			for _, l := range leaves {
+				w, h := l.x2-l.x1, l.y2-l.y1
+				if w < c.minW || w > c.maxW || h < c.minH || h > c.maxH {
+					t.Fatalf("%dx%d: leaf of %dx%d outside %d-%dx%d-%d", c.w, c.h, w, h, c.minW, c.maxW, c.minH, c.maxH)
+				}
+				for y := l.y1; y < l.y2; y++ {
+					for x := l.x1; x < l.x2; x++ {
+						if covered[int(y)*c.w+int(x)] {
+							t.Fatalf("%dx%d: leaves overlap at %d,%d", c.w, c.h, x, y)
+						}
+						covered[int(y)*c.w+int(x)] = true
+					}
+				}
+			}
+			if slices.Contains(covered, false) {
+				t.Fatalf("%dx%d: leaves do not cover the image", c.w, c.h)
+			}
+		}
+	}
+}
+
+func TestBuildFromImagesGolden(t *testing.T) {
+	array, naphilArray, info := syntheticDataset(t, 192, 160, 0.1)
+	if len(array) == 0 {
+		t.Fatal("no grids built")
+	}
+	if info.MinW != 4 || info.MaxW != 10 || info.Margin != 0.1 || len(info.Sources) != 2 {
+		t.Errorf("info is %+v", info)
+	}
+	for i, g := range array {
+		if g.dimCornAvg>>62 == 3 {
+			t.Fatalf("grid %d is eliminated", i)
+		}
+		if i > 0 && array[i-1].dimCornAvg > g.dimCornAvg {
+			t.Fatalf("grids %d and %d are out of order", i-1, i)
+		}
+	}
+	checkGolden(t, "build", hashDataset(array, naphilArray))
+}
+
+func TestBuildFromImagesStreaming(t *testing.T) {
+	array, naphilArray, _ := syntheticDataset(t, 192, 160, 0.1)
+
+	/*The same images and seed, built in one chunk and merged from disk*/
+	seedRandom(t, 1)
+	dir := t.TempDir()
+	paths := []string{
+		writeSyntheticImage(t, dir, "ref1.png", 192, 160, 1),
+		writeSyntheticImage(t, dir, "ref2.png", 192, 160, 2),
+	}
+	tempDir := t.TempDir()
+	t.Setenv("TMPDIR", tempDir)
+	streamed, streamedNaphil, _, release, err := buildFromImagesStreaming(paths, 4, 10, 4, 10, 0.1, 1, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, g := range streamed {
+		if i > 0 && streamed[i-1].dimCornAvg > g.dimCornAvg {
+			t.Fatalf("grids %d and %d are out of order", i-1, i)
+		}
+	}
+	/*Grids which sort equally may be in either order*/
+	gridSet := func(array []Grid, naphilArray []uint8) []string {
+		set := make([]string, len(array))
+		for i, g := range array {
+			set[i] = hashDataset([]Grid{g}, naphilArray)
+		}
+		slices.Sort(set)
+		return set
+	}
+	if !slices.Equal(gridSet(streamed, streamedNaphil), gridSet(array, naphilArray)) {
+		t.Errorf("streamed build of %d grids differs from the %d built in memory", len(streamed), len(array))
+	}
+	if err = release(); err != nil {
+		t.Fatal(err)
+	}
+	if left, _ := os.ReadDir(tempDir); len(left) != 0 {
+		t.Errorf("%d temporary files left after release", len(left))
+	}
+
+	if _, _, _, _, err = buildFromImagesStreaming([]string{filepath.Join(dir, "missing.png")}, 4, 10, 4, 10, 0.1, 1, 1<<30); err == nil {
+		t.Error("no error streaming a missing image")
+	}
+}
+
+func TestRemoveRedundantGridsThreads(t *testing.T) {
+	array, naphilArray, _ := syntheticDataset(t, 192, 160, 0)
+	var want string
+	for _, tNum := range []int{1, 3, 8} {
+		removed := removeRedundantGrids(slices.Clone(array), 0.15, tNum, naphilArray, LOG_VERBOSE)
+		if len(removed) == 0 || len(removed) >= len(array) {
+			t.Fatalf("%d threads kept %d of %d grids", tNum, len(removed), len(array))
+		}
+		got := hashDataset(removed, naphilArray)
+		if tNum == 1 {
+			want = got
+			checkGolden(t, "dedup", got)
+		} else if got != want {
+			t.Errorf("%d threads kept different grids than 1", tNum)
+		}
+	}
+}
+
+func TestCombineArraysGolden(t *testing.T) {
+	array, naphilArray, _ := syntheticDataset(t, 192, 160, 0.1)
+	seedRandom(t, 2)
+	dir := t.TempDir()
+	array2, naphilArray2, _ := buildFromImages([]string{writeSyntheticImage(t, dir, "ref3.png", 160, 192, 3)}, 4, 10, 4, 10, 0.1, 1)
+	merged, naphilMerged, mergedLen := combineArrays(slices.Clone(array), slices.Clone(array2), 0.1, 2, naphilArray, naphilArray2)
+	if mergedLen > len(array)+len(array2) || mergedLen < max(len(array), len(array2))/2 {
+		t.Fatalf("combined %d and %d grids into %d", len(array), len(array2), mergedLen)
+	}
+	checkGolden(t, "combine", hashDataset(merged[:mergedLen], naphilMerged))
+}
+
+func TestAppendGridsPriority(t *testing.T) {
+	/*Three flat 2x2 grids, all redundant with each other*/
+	naphilArray := slices.Repeat([]uint8{100}, 8)
+	newNaphil := slices.Repeat([]uint8{100}, 4)
+	grid := func(offset int, priority uint8) Grid {
+		return Grid{w__: 2, h__: 2, avgLuma: 100, minLuma: 100, maxLuma: 100, offset: offset, priority: priority}
+	}
+	array := []Grid{grid(0, 1), grid(4, 5)}
+
+	/*A new grid outranking only one of them replaces neither*/
+	merged, added := appendGrids(array, []Grid{grid(0, 3)}, naphilArray, newNaphil, 0.1)
+	if added != 0 || len(merged) != 2 || merged[0].priority != 1 || merged[1].priority != 5 {
+		t.Errorf("added %d, kept %+v, want both existing grids kept", added, merged)
+	}
+
+	/*A new grid outranking both replaces both, and its pixels follow the existing ones*/
+	merged, added = appendGrids(array, []Grid{grid(0, 9)}, naphilArray, newNaphil, 0.1)
+	if added != 1 || len(merged) != 1 || merged[0].priority != 9 || merged[0].offset != len(naphilArray) {
+		t.Errorf("added %d, kept %+v, want only the new grid", added, merged)
+	}
+}
+
+func TestMatchGrids(t *testing.T) {
+	array, naphilArray, _ := syntheticDataset(t, 192, 160, 0.1)
+	sorted := slices.Clone(array)
+	slices.SortStableFunc(sorted, func(a, b Grid) int {
+		return cmp.Compare(dimAvgKey(a), dimAvgKey(b))
+	})
+	progress := newProgressLog(LOG_VERBOSE, "comparing", "Comparing datasets", len(array))
+	for i, m := range matchGrids(array, naphilArray, sorted, naphilArray, 0.1, 3, progress) {
+		if m != MATCH_EXACT {
+			t.Fatalf("grid %d has no exact copy in its own dataset", i)
+		}
+	}
+
+	seedRandom(t, 2)
+	dir := t.TempDir()
+	array2, naphilArray2, _ := buildFromImages([]string{writeSyntheticImage(t, dir, "ref3.png", 160, 192, 3)}, 4, 10, 4, 10, 0.1, 1)
+	slices.SortStableFunc(array2, func(a, b Grid) int {
+		return cmp.Compare(dimAvgKey(a), dimAvgKey(b))
+	})
+	matches := matchGrids(array, naphilArray, array2, naphilArray2, 0.1, 3, progress)
+	report := compareDatasets("a", "b", array, len(array2), matches, 0.1)
+	if report.Exact+report.Near+report.Unique != len(array) || report.Unique == 0 || report.Near == 0 {
+		t.Fatalf("%d exact, %d near and %d unique of %d grids", report.Exact, report.Near, report.Unique, len(array))
+	}
+	total := 0
+	for _, b := range report.Bands {
+		total += b.Fragments
+	}
+	if total != len(array) {
+		t.Errorf("bands hold %d of %d grids", total, len(array))
+	}
+	/*Every grid of the other dataset is searched here, with the margin of
+	0.1 as matchGrids rounds it.*/
+	for i, m := range matches {
+		redundant := false
+		for _, g2 := range array2 {
+			if g2.getW() == array[i].getW() && g2.getH() == array[i].getH() && gridsRedundant(array[i], g2, naphilArray, naphilArray2, 25) {
+				redundant = true
+				break
+			}
+		}
+		if redundant != (m != MATCH_NONE) {
+			t.Fatalf("grid %d matched %d, but a search of every grid found redundant %v", i, m, redundant)
+		}
+	}
+}
+
+func TestWriteReadRoundTrip(t *testing.T) {
+	array, naphilArray, info := syntheticDataset(t, 128, 128, 0.1)
+	want := hashDataset(array, naphilArray)
+	for _, compress := range []bool{false, true} {
+		fName := filepath.Join(t.TempDir(), "set.dat")
+		err := writeToFile(array, len(array), fName, naphilArray, info, compress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, readNaphil, readInfo, release, err := readFromFile(fName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer release()
+		if got := hashDataset(read, readNaphil); got != want {
+			t.Errorf("compress %v: read back different grids", compress)
+		}
+		if readInfo.MinW != info.MinW || readInfo.MaxW != info.MaxW || readInfo.Margin != info.Margin || len(readInfo.Sources) != len(info.Sources) {
+			t.Errorf("compress %v: read back info %+v, want %+v", compress, readInfo, info)
+		}
+	}
+}
+
+func TestLumaTraceGolden(t *testing.T) {
+	array, naphilArray, _ := syntheticDataset(t, 192, 160, 0.1)
+	prepareForTrace(array, 1)
+	sets := []traceSet{{array: array, naphil: naphilArray, rule: regionRule{kind: RULE_ALL, lo: 0, hi: 255}}}
+	w, h := 320, 240
+	pix := syntheticPixels(w, h, 4)
+	tree := generateTree(0, uint64(w), 0, uint64(h), 4, 10, 4, 10, 0x9E3779B97F4A7C15, 0xD1B54A32D192ED03)
+
+	out, err := lumaTrace(w, h, pix, sets, tree, nil, nil, nil, nil, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(pix) {
+		t.Fatalf("traced %d pixels of %d", len(out), len(pix))
+	}
+	checkGolden(t, "trace", hashPixels(out))
+	if got, _ := lumaTrace(w, h, pix, sets, tree, nil, nil, nil, nil, 4, nil); !slices.Equal(got, out) {
+		t.Error("4 threads traced differently than 1")
+	}
+
+	/*Pixels outside a mask are copied through untouched*/
+	mask := make([]uint8, w*h)
+	for y := range h {
+		for x := w / 2; x < w; x++ {
+			mask[y*w+x] = 255
+		}
+	}
+	masked, _ := lumaTrace(w, h, pix, sets, tree, mask, nil, nil, nil, 1, nil)
+	for y := range h {
+		for x := range w / 2 {
+			if masked[y*w+x] != pix[y*w+x] {
+				t.Fatalf("masked out pixel %d,%d changed", x, y)
+			}
+		}
+	}
+}
+
+func TestMeasureCoverage(t *testing.T) {
+	array, naphilArray, _ := syntheticDataset(t, 192, 160, 0.1)
+	sortByDimAvg(array)
+	w, h := 320, 240
+	pix := syntheticPixels(w, h, 4)
+	tree := generateTree(0, uint64(w), 0, uint64(h), 4, 10, 4, 10, 0x9E3779B97F4A7C15, 0xD1B54A32D192ED03)
+	frame, frameNaphil := traceGrids(w, h, pix, nil, tree)
+	if len(frame) != tree.leafNum {
+		t.Fatalf("partitioned %d grids of %d", len(frame), tree.leafNum)
+	}
+
+	/*The search finds the same closest grid as comparing every grid*/
+	for i, g := range frame {
+		want := 256
+		for _, p := range array {
+			if p.getW() != g.getW() || p.getH() != g.getH() {
+				continue
+			}
+			gw, area := int(g.getW()), int(g.getW())*int(g.getH())
+			sum := 0
+			for _, c := range []int{0, gw - 1, area - gw, area - 1} {
+				sum += int(byteAbsDiff(frameNaphil[g.offset+c], naphilArray[p.offset+c]))
+			}
+			want = min(want, max(int(byteAbsDiff(g.avgLuma, p.avgLuma)), int(byteAbsDiff(g.maxLuma-g.minLuma, p.maxLuma-p.minLuma)), (sum+3)/4))
+		}
+		if got := signatureDistance(g, frameNaphil, array, naphilArray); got != want {
+			t.Fatalf("grid %d is %d from the dataset, want %d", i, got, want)
+		}
+	}
+
+	/*A frame covers itself exactly*/
+	progress := newProgressLog(LOG_VERBOSE, "measuring", "Measuring coverage", len(frame))
+	self := slices.Clone(frame)
+	sortByDimAvg(self)
+	report := measureCoverage([]string{"self"}, []string{"frame"}, [][]Grid{self}, [][]uint8{frameNaphil}, [][]Grid{frame}, [][]uint8{frameNaphil}, 0, 3, progress)
+	if report.Covered != len(frame) || report.CoveredPixels != w*h || len(report.Gaps) != 0 {
+		t.Errorf("frame covers %d of its %d grids and %d of %d pixels, with %d gaps", report.Covered, len(frame), report.CoveredPixels, w*h, len(report.Gaps))
+	}
+
+	/*Grids of a width the dataset lacks are gaps without candidates*/
+	narrow := slices.DeleteFunc(slices.Clone(array), func(g Grid) bool {
+		return g.getW() == 4
+	})
+	report = measureCoverage([]string{"narrow"}, []string{"frame"}, [][]Grid{narrow}, [][]uint8{naphilArray}, [][]Grid{frame}, [][]uint8{frameNaphil}, 16, 3, progress)
+	thin := 0
+	for _, g := range frame {
+		if g.getW() == 4 {
+			thin++
+		}
+	}
+	if report.NoCandidates != thin || report.Covered+thin > report.Grids {
+		t.Errorf("%d grids without candidates and %d covered of %d, want %d without", report.NoCandidates, report.Covered, report.Grids, thin)
+	}
+	total, uncovered := 0, 0
+	for _, b := range report.Bands {
+		total += b.Grids
+	}
+	for _, b := range report.Gaps {
+		uncovered += b.Grids - b.Covered
+		if b.Distance <= float64(report.Tolerance) {
+			t.Errorf("band %+v has uncovered grids within the tolerance on average", b)
+		}
+		if b.W == 4 && b.Candidates != 0 {
+			t.Errorf("band %+v has candidates of a width removed", b)
+		}
+	}
+	if total != report.Grids || uncovered != report.Grids-report.Covered {
+		t.Errorf("bands hold %d of %d grids and gaps %d of %d uncovered", total, report.Grids, uncovered, report.Grids-report.Covered)
+	}
+}
+
+func TestLazyDecompression(t *testing.T) {
+	array, naphilArray, info := syntheticDataset(t, 192, 160, 0.1)
+	fName := filepath.Join(t.TempDir(), "set.dat")
+	if err := writeToFile(array, len(array), fName, naphilArray, info, true); err != nil {
+		t.Fatal(err)
+	}
+	set, _, release, err := readFromFileLazily(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if set.blocks == nil || set.blocks.loaded.Load() != 0 {
+		t.Fatal("compressed blocks were decompressed before they were needed")
+	}
+	prepareForTrace(set.array, 1)
+	set.rule = regionRule{kind: RULE_ALL, lo: 0, hi: 255}
+
+	/*Only the blocks of the dimensions traced are decompressed*/
+	w, h := 64, 48
+	pix := syntheticPixels(w, h, 4)
+	tree := generateTree(0, uint64(w), 0, uint64(h), 8, 16, 8, 16, 0x9E3779B97F4A7C15, 0xD1B54A32D192ED03)
+	out, err := lumaTrace(w, h, pix, []traceSet{set}, tree, nil, nil, nil, nil, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := set.blocks.loaded.Load(); n == 0 || int(n) == len(set.blocks.blocks) {
+		t.Errorf("%d of %d blocks decompressed", n, len(set.blocks.blocks))
+	}
+	prepareForTrace(array, 1)
+	eager := []traceSet{{array: array, naphil: naphilArray, rule: regionRule{kind: RULE_ALL, lo: 0, hi: 255}}}
+	if want, _ := lumaTrace(w, h, pix, eager, tree, nil, nil, nil, nil, 2, nil); !slices.Equal(out, want) {
+		t.Error("trace of a lazily decompressed dataset differs")
+	}
+	_, readNaphil, _, releaseRead, err := readFromFile(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseRead()
+	if err = set.blocks.loadAll(); err != nil || hashPixels(set.naphil) != hashPixels(readNaphil) {
+		t.Errorf("pixels differ once every block is decompressed, error %v", err)
+	}
+}
+
+func TestTraceQuality(t *testing.T) {
+	array, naphilArray, _ := syntheticDataset(t, 192, 160, 0.1)
+	prepareForTrace(array, 1)
+	sets := []traceSet{{array: array, naphil: naphilArray, rule: regionRule{kind: RULE_ALL, lo: 0, hi: 255}}}
+	w, h := 320, 240
+	pix := syntheticPixels(w, h, 4)
+	tree := generateTree(0, uint64(w), 0, uint64(h), 4, 10, 4, 10, 0x9E3779B97F4A7C15, 0xD1B54A32D192ED03)
+
+	quality := &traceQuality{}
+	out, err := lumaTrace(w, h, pix, sets, tree, nil, nil, nil, quality, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, _ := lumaTrace(w, h, pix, sets, tree, nil, nil, nil, nil, 1, nil); !slices.Equal(out, plain) {
+		t.Fatal("collecting the quality changed the trace")
+	}
+
+	/*The difference of each match is the one between the grid and what
+	replaced it*/
+	for i, g := range quality.grids {
+		if quality.status[i] != TRACE_MATCHED {
+			t.Fatalf("grid %d has status %d, want matched", i, quality.status[i])
+		}
+		sum := 0
+		for y := g.getY(); y < g.getY()+int(g.getH()); y++ {
+			for x := g.getX(); x < g.getX()+int(g.getW()); x++ {
+				sum += max(int(pix[y*w+x])-int(out[y*w+x]), int(out[y*w+x])-int(pix[y*w+x]))
+			}
+		}
+		if want := float64(sum) / float64(int(g.getW())*int(g.getH())); quality.errors[i] != want {
+			t.Fatalf("grid %d has difference %g, want %g", i, quality.errors[i], want)
+		}
+	}
+	stats := traceErrorStats(quality)
+	if stats.Grids != tree.leafNum || stats.Traced != stats.Grids || stats.NoCandidates != 0 || stats.Ceiling != 0 {
+		t.Errorf("stats %+v, want every grid of %d matched", stats, tree.leafNum)
+	}
+	if !(stats.P50 <= stats.P90 && stats.P90 <= stats.P99 && stats.P99 <= stats.Max && stats.Mean <= stats.Max) {
+		t.Errorf("percentiles out of order: %+v", stats)
+	}
+	banded := 0
+	for _, b := range stats.Bands {
+		banded += b.Grids
+	}
+	if banded != stats.Traced {
+		t.Errorf("bands hold %d grids, want %d", banded, stats.Traced)
+	}
+
+	/*Grids of a width the dataset lacks have no candidates*/
+	narrow := slices.DeleteFunc(slices.Clone(array), func(g Grid) bool {
+		return g.getW() == 4
+	})
+	sets[0].array = narrow
+	lumaTrace(w, h, pix, sets, tree, nil, nil, nil, quality, 1, nil)
+	for i, g := range quality.grids {
+		if (g.getW() == 4) != (quality.status[i] == TRACE_NO_CANDIDATES) {
+			t.Fatalf("%dx%d grid has status %d", g.getW(), g.getH(), quality.status[i])
+		}
+	}
+	if stats = traceErrorStats(quality); stats.NoCandidates == 0 || stats.Max != 255 {
+		t.Errorf("stats %+v, want grids without candidates at 255", stats)
+	}
+
+	/*When the image is partitioned into sizes only some of which the
+	dataset has, every size it has is still matched, and the rest are
+	copied through*/
+	sets[0].array = array
+	sizes := make(map[[2]uint16]bool)
+	for _, g := range array {
+		sizes[[2]uint16{g.getW(), g.getH()}] = true
+	}
+	tree = generateTree(0, uint64(w), 0, uint64(h), 5, 12, 5, 12, 0x9E3779B97F4A7C15, 0xD1B54A32D192ED03)
+	out, _ = lumaTrace(w, h, pix, sets, tree, nil, nil, nil, quality, 2, nil)
+	matched, missing := 0, 0
+	for i, g := range quality.grids {
+		if sizes[[2]uint16{g.getW(), g.getH()}] {
+			matched++
+			if quality.status[i] != TRACE_MATCHED {
+				t.Fatalf("%dx%d grid has status %d, want matched", g.getW(), g.getH(), quality.status[i])
+			}
+			continue
+		}
+		missing++
+		if quality.status[i] != TRACE_NO_CANDIDATES {
+			t.Fatalf("%dx%d grid has status %d, want no candidates", g.getW(), g.getH(), quality.status[i])
+		}
+		for y := g.getY(); y < g.getY()+int(g.getH()); y++ {
+			if !slices.Equal(out[y*w+g.getX():y*w+g.getX()+int(g.getW())], pix[y*w+g.getX():y*w+g.getX()+int(g.getW())]) {
+				t.Fatalf("%dx%d grid without candidates was not copied through", g.getW(), g.getH())
+			}
+		}
+	}
+	if matched == 0 || missing == 0 {
+		t.Fatalf("%d grids of sizes the dataset has and %d of sizes it lacks, want some of both", matched, missing)
+	}
+	if stats = traceErrorStats(quality); stats.NoCandidates != missing {
+		t.Errorf("%d grids without candidates, want %d", stats.NoCandidates, missing)
+	}
+}
+
+func BenchmarkGenerateTree(b *testing.B) {
+	seedRandom(b, 1)
+	for b.Loop() {
+		generateTree(0, 1920, 0, 1080, 4, 10, 4, 10, randomUint64(), randomUint64())
+	}
+}
+
+func BenchmarkBuildFromImages(b *testing.B) {
+	seedRandom(b, 1)
+	dir := b.TempDir()
+	paths := []string{
+		writeSyntheticImage(b, dir, "ref1.png", 512, 512, 1),
+		writeSyntheticImage(b, dir, "ref2.png", 512, 512, 2),
+	}
+	for b.Loop() {
+		buildFromImages(paths, 4, 10, 4, 10, 0.1, 4)
+	}
+}
+
+func BenchmarkRemoveRedundantGrids(b *testing.B) {
+	array, naphilArray, _ := syntheticDataset(b, 512, 512, 0)
+	work := make([]Grid, len(array))
+	for b.Loop() {
+		copy(work, array)
+		removeRedundantGrids(work, 0.1, 4, naphilArray, LOG_VERBOSE)
+	}
+}
+
+func BenchmarkCombineArrays(b *testing.B) {
+	array, naphilArray, _ := syntheticDataset(b, 384, 384, 0.1)
+	array2, naphilArray2, _ := syntheticDataset(b, 384, 384, 0.05)
+	for b.Loop() {
+		combineArrays(slices.Clone(array), slices.Clone(array2), 0.1, 4, naphilArray, naphilArray2)
+	}
+}
+
+func BenchmarkWriteToFile(b *testing.B) {
+	array, naphilArray, info := syntheticDataset(b, 512, 512, 0.1)
+	for _, compress := range []bool{false, true} {
+		name := "plain"
+		if compress {
+			name = "compressed"
+		}
+		b.Run(name, func(b *testing.B) {
+			fName := filepath.Join(b.TempDir(), "set.dat")
+			for b.Loop() {
+				err := writeToFile(array, len(array), fName, naphilArray, info, compress)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReadFromFile(b *testing.B) {
+	array, naphilArray, info := syntheticDataset(b, 512, 512, 0.1)
+	for _, compress := range []bool{false, true} {
+		name := "plain"
+		if compress {
+			name = "compressed"
+		}
+		b.Run(name, func(b *testing.B) {
+			fName := filepath.Join(b.TempDir(), "set.dat")
+			err := writeToFile(array, len(array), fName, naphilArray, info, compress)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for b.Loop() {
+				_, _, _, release, err := readFromFile(fName)
+				if err != nil {
+					b.Fatal(err)
+				}
+				release()
+			}
+		})
+	}
+}
+
+/*Checks the claim in the README of tracing a 1080p image in under a second.*/
+func BenchmarkLumaTrace1080p(b *testing.B) {
+	array, naphilArray, _ := syntheticDataset(b, 512, 512, 0.1)
+	prepareForTrace(array, 1)
+	sets := []traceSet{{array: array, naphil: naphilArray, rule: regionRule{kind: RULE_ALL, lo: 0, hi: 255}}}
+	pix := syntheticPixels(1920, 1080, 4)
+	tree := generateTree(0, 1920, 0, 1080, 4, 10, 4, 10, randomUint64(), randomUint64())
+	for b.Loop() {
+		lumaTrace(1920, 1080, pix, sets, tree, nil, nil, nil, nil, 1, nil)
+	}
+}
+
+/*The contents of a dataset written by writeToFile.*/
+func datasetBytes(tb testing.TB, array []Grid, naphilArray []uint8, info datasetInfo, compress bool) []byte {
+	fName := filepath.Join(tb.TempDir(), "set.dat")
+	err := writeToFile(array, len(array), fName, naphilArray, info, compress)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	data, err := os.ReadFile(fName)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+/*
+A dataset from before datasets had headers, or with the version 2 header
+when withHeader is set, which records each grid's dimensions, then its
+source if it has a header, then its pixels.
+*/
+func legacyDatasetBytes(array []Grid, naphilArray []uint8, withHeader bool) []byte {
+	data := make([]byte, 0)
+	if withHeader {
+		data = append(data, DATASET_MAGIC...)
+		data = append(data, 2, 2, 0, 0, 0)
+		data = append(data, "{}"...)
+	}
+	data = append(data, byte(len(array)), byte(len(array)>>8), 0, 0, 0, 0)
+	for _, g := range array {
+		data = append(data, byte(g.getW()), byte(g.getH()))
+		if withHeader {
+			data = binary.LittleEndian.AppendUint32(data, g.source)
+		}
+		data = append(data, naphilArray[g.offset:g.offset+int(g.getW())*int(g.getH())]...)
+	}
+	return data
+}
+
+/*Checks that two datasets hold grids of the same dimensions, sources and pixels.*/
+func sameGrids(array1 []Grid, naphilArray1 []uint8, array2 []Grid, naphilArray2 []uint8) bool {
+	if len(array1) != len(array2) {
+		return false
+	}
+	for i := range array1 {
+		g1, g2 := array1[i], array2[i]
+		area := int(g1.getW()) * int(g1.getH())
+		if g1.getW() != g2.getW() || g1.getH() != g2.getH() || g1.source != g2.source {
+			return false
+		}
+		if !slices.Equal(naphilArray1[g1.offset:g1.offset+area], naphilArray2[g2.offset:g2.offset+area]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestConfinePath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.Mkdir(filepath.Join(root, "shot"), 0o755)
+	for name, target := range map[string]string{"inside": filepath.Join(root, "shot"), "outside": outside, "dangling.png": filepath.Join(outside, "new.png")} {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skip(err)
+		}
+	}
+	for _, c := range []struct {
+		name string
+		ok   bool
+	}{
+		{"frame.png", true},
+		{"shot/frame.png", true},
+		{filepath.Join(root, "frame.png"), true},
+		{"../frame.png", false},
+		{"shot/../../frame.png", false},
+		{"/etc/passwd", false},
+		{"inside/frame.png", true},
+		{"outside/frame.png", false},
+		{"dangling.png", false},
+	} {
+		got, err := confinePath(root, c.name)
+		if (err == nil) != c.ok {
+			t.Errorf("%s resolved to %q with error %v, want allowed %v", c.name, got, err, c.ok)
+		}
+	}
+}
+
+func TestServeJobs(t *testing.T) {
+	array, naphilArray, _ := syntheticDataset(t, 64, 64, 0.1)
+	prepareForTrace(array, 1)
+	dir := t.TempDir()
+	writeSyntheticImage(t, dir, "frame.png", 48, 32, 4)
+	s := &traceServer{
+		jobs:      make(map[int]*traceJob),
+		queue:     make(chan *traceJob, 4),
+		datasets:  map[string][]traceSet{"set": {{array: array, naphil: naphilArray, rule: regionRule{kind: RULE_ALL, lo: 0, hi: 255}}}},
+		names:     []string{"set"},
+		dir:       dir,
+		root:      dir,
+		opts:      traceOptions{minW: 4, maxW: 10, minH: 4, maxH: 10},
+		keep:      1,
+		maxUpload: 1 << 16,
+	}
+	submit := func(form url.Values) int {
+		r := httptest.NewRequest("POST", "/jobs", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		s.submit(w, r)
+		return w.Code
+	}
+	if code := submit(url.Values{"path": {"frame.png"}, "mask": {"../mask.png"}}); code != http.StatusForbidden {
+		t.Errorf("mask outside of the root gave status %d", code)
+	}
+	if code := submit(url.Values{"path": {"frame.png"}, "labels": {strings.Repeat("x", 1<<16)}}); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("request over the upload limit gave status %d", code)
+	}
+	for range 2 {
+		if code := submit(url.Values{"path": {"frame.png"}}); code != http.StatusAccepted {
+			t.Fatalf("job gave status %d", code)
+		}
+	}
+	close(s.queue)
+	s.work()
+
+	/*Only the last finished job is kept*/
+	if len(s.jobs) != 1 || s.jobs[2] == nil || s.jobs[2].Status != JOB_DONE || s.jobs[2].Progress != 1 {
+		t.Fatalf("jobs left are %v", s.jobs)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "job_1.png")); !os.IsNotExist(err) {
+		t.Errorf("output of the forgotten job is left, error %v", err)
+	}
+	remove := func(id string) int {
+		r := httptest.NewRequest("DELETE", "/jobs/"+id, nil)
+		r.SetPathValue("id", id)
+		w := httptest.NewRecorder()
+		s.deleteJob(w, r)
+		return w.Code
+	}
+	if code := remove("2"); code != http.StatusNoContent {
+		t.Errorf("deleting a finished job gave status %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "job_2.png")); !os.IsNotExist(err) {
+		t.Errorf("output of the deleted job is left, error %v", err)
+	}
+	if code := remove("2"); code != http.StatusNotFound {
+		t.Errorf("deleting a deleted job gave status %d", code)
+	}
+}
+
+func TestReadDatasetTruncated(t *testing.T) {
+	array, naphilArray, info := syntheticDataset(t, 32, 32, 0.1)
+	array = array[:min(len(array), 40)]
+	for _, compress := range []bool{false, true} {
+		data := datasetBytes(t, array, naphilArray, info, compress)
+		for n := range len(data) {
+			_, _, _, err := readDataset("set.dat", data[:n])
+			if err == nil {
+				t.Fatalf("compress %v: no error reading the first %d of %d bytes", compress, n, len(data))
+			}
+		}
+	}
+}
+
+func TestWriteToFileInvalid(t *testing.T) {
+	array, naphilArray, info := syntheticDataset(t, 32, 32, 0.1)
+	fName := filepath.Join(t.TempDir(), "set.dat")
+	if err := writeToFile(array, len(array)+1, fName, naphilArray, info, false); err == nil {
+		t.Error("no error writing more grids than given")
+	}
+	if err := writeToFile(array, len(array), fName, naphilArray[:len(naphilArray)/2], info, false); err == nil {
+		t.Error("no error writing grids with pixels past the end of those given")
+	}
+	empty := slices.Clone(array)
+	empty[0].w__ = 0
+	if err := writeToFile(empty, len(empty), fName, naphilArray, info, true); err == nil {
+		t.Error("no error writing an empty grid")
+	}
+}
+
+func TestWriteSplitToFile(t *testing.T) {
+	array, naphilArray, info := syntheticDataset(t, 32, 32, 0.1)
+	fName := filepath.Join(t.TempDir(), "split.dat")
+
+	/*The same grids, with the pixels of the second half in their own array*/
+	split := slices.Clone(array)
+	naphilArray1 := make([]uint8, 0)
+	naphilArray2 := make([]uint8, 0)
+	for i, g := range array {
+		pixels := naphilArray[g.offset : g.offset+(int(g.getW())*int(g.getH()))]
+		if i < len(array)/2 {
+			split[i].offset = len(naphilArray1)
+			naphilArray1 = append(naphilArray1, pixels...)
+		} else {
+			split[i].offset = len(naphilArray1) + len(naphilArray2)
+			naphilArray2 = append(naphilArray2, pixels...)
+		}
+	}
+	for _, compress := range []bool{false, true} {
+		if err := writeSplitToFile(split, len(split), fName, naphilArray1, naphilArray2, info, compress); err != nil {
+			t.Fatal(err)
+		}
+		readArray, readNaphil, _, release, err := readFromFile(fName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer release()
+		if hashDataset(readArray, readNaphil) != hashDataset(array, naphilArray) {
+			t.Errorf("dataset written from split pixels differs, compressed %v", compress)
+		}
+	}
+}
+
+func FuzzReadDataset(f *testing.F) {
+	array, naphilArray, info := syntheticDataset(f, 32, 32, 0.1)
+	array = array[:min(len(array), 20)]
+	f.Add(datasetBytes(f, array, naphilArray, info, false))
+	f.Add(datasetBytes(f, array, naphilArray, info, true))
+	f.Add(legacyDatasetBytes(array, naphilArray, false))
+	f.Add(legacyDatasetBytes(array, naphilArray, true))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		array, naphilArray, info, err := readDataset("fuzz.dat", data)
+		if err != nil {
+			return
+		}
+		for i, g := range array {
+			w, h := int(g.getW()), int(g.getH())
+			if w == 0 || h == 0 || w > MAX_DIM || h > MAX_DIM || g.offset < 0 || g.offset+(w*h) > len(naphilArray) {
+				t.Fatalf("grid %d of %dx%d at %d read from %d bytes of pixels", i, w, h, g.offset, len(naphilArray))
+			}
+		}
+		for _, compress := range []bool{false, true} {
+			written := datasetBytes(t, array, naphilArray, info, compress)
+			array2, naphilArray2, _, err := readDataset("fuzz.dat", written)
+			if err != nil {
+				t.Fatalf("compress %v: reading a dataset written from one read: %v", compress, err)
+			}
+			if !sameGrids(array, naphilArray, array2, naphilArray2) {
+				t.Fatalf("compress %v: read back different grids", compress)
+			}
+		}
+	})
+}
+
+func FuzzWriteReadRoundTrip(f *testing.F) {
+	f.Add([]byte{3, 3, 0, 10, 20, 30, 40, 50, 60, 70, 80}, false)
+	f.Add([]byte{12, 1, 255, 0, 255, 0, 128, 7, 7, 7, 7, 7, 7, 7}, true)
+	f.Add(syntheticPixels(16, 16, 1), true)
+	f.Fuzz(func(t *testing.T, data []byte, compress bool) {
+		/*Every grid takes its dimensions and source from three bytes, and
+		its pixels from the bytes after them, starting over if they run out.*/
+		array := make([]Grid, 0)
+		naphilArray := make([]uint8, 0)
+		for i := 0; i+3 <= len(data) && len(array) < 64; {
+			w, h := uint16(1+data[i]%16), uint16(1+data[i+1]%16)
+			source := uint32(data[i+2] % 2)
+			i += 3
+			g := Grid{w__: w, h__: h, source: source, offset: len(naphilArray)}
+			for range int(w) * int(h) {
+				naphilArray = append(naphilArray, data[i%len(data)])
+				i++
+			}
+			array = append(array, g)
+		}
+		info := newDatasetInfo(1, 16, 1, 16, 0.1)
+		info.Sources = []sourceInfo{{Name: "a", Priority: 1}, {Name: "b", Priority: 2}}
+		written := datasetBytes(t, array, naphilArray, info, compress)
+		array2, naphilArray2, _, err := readDataset("fuzz.dat", written)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameGrids(array, naphilArray, array2, naphilArray2) {
+			t.Fatal("read back different grids")
+		}
+		for i, g := range array2 {
+			area := int(g.getW()) * int(g.getH())
+			minMaxSum_result := minMaxSum(naphilArray2, g.offset, g.offset+area, 255, 0)
+			if g.avgLuma != uint8((minMaxSum_result&0xFFFFFFFF)/uint64(area)) || g.minLuma != uint8(minMaxSum_result>>32) || g.maxLuma != uint8(minMaxSum_result>>40) {
+				t.Fatalf("grid %d has lumas %d %d %d that do not match its pixels", i, g.avgLuma, g.minLuma, g.maxLuma)
+			}
+			if g.priority != info.Sources[g.source].Priority {
+				t.Fatalf("grid %d has priority %d, not that of its source", i, g.priority)
+			}
+		}
+	})
+}
+
+func TestAtlasRoundTrip(t *testing.T) {
+	array, naphilArray, info := syntheticDataset(t, 64, 64, 0.1)
+	dir := t.TempDir()
+	index, err := exportAtlas(array, naphilArray, info, dir, 128, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Pages) < 2 {
+		t.Fatalf("%d grids fit on %d page", len(array), len(index.Pages))
+	}
+
+	/*Erase the first tile, and all but one pixel of the second*/
+	page := filepath.Join(dir, index.Pages[0].File)
+	gray, alpha, pageW, pageH, err := readGrayAlpha(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, tile := range index.Pages[0].Tiles[:2] {
+		for row := range int(tile.H) {
+			for col := range int(tile.W) {
+				alpha[((tile.Y+row)*pageW)+tile.X+col] = 0
+			}
+		}
+		if n == 1 {
+			alpha[(tile.Y*pageW)+tile.X] = 64
+		}
+	}
+	if err = writeGrayAlpha(page, pageW, pageH, gray, alpha); err != nil {
+		t.Fatal(err)
+	}
+
+	imported, importedNaphil, importedInfo, deleted, err := importAtlas(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 || len(imported) != len(array)-1 {
+		t.Fatalf("imported %d of %d grids with %d deleted, want 1 deleted", len(imported), len(array), deleted)
+	}
+	if len(importedInfo.Sources) != len(info.Sources) {
+		t.Errorf("imported %d sources, want %d", len(importedInfo.Sources), len(info.Sources))
+	}
+	/*Every grid but the erased one comes back with the same pixels and source*/
+	count := make(map[string]int)
+	gridKey := func(g Grid, naphilArray []uint8) string {
+		area := int(g.getW()) * int(g.getH())
+		return hashPixels(append([]uint8{uint8(g.getW()), uint8(g.getH()), uint8(g.source)}, naphilArray[g.offset:g.offset+area]...))
+	}
+	for _, g := range array {
+		count[gridKey(g, naphilArray)]++
+	}
+	for i, g := range imported {
+		area := int(g.getW()) * int(g.getH())
+		minMaxSum_result := minMaxSum(importedNaphil, g.offset, g.offset+area, 255, 0)
+		if g.avgLuma != uint8((minMaxSum_result&0xFFFFFFFF)/uint64(area)) || g.minLuma != uint8(minMaxSum_result>>32) || g.maxLuma != uint8(minMaxSum_result>>40) {
+			t.Fatalf("grid %d has lumas %d %d %d that do not match its pixels", i, g.avgLuma, g.minLuma, g.maxLuma)
+		}
+		count[gridKey(g, importedNaphil)]--
+	}
+	missing := 0
+	for _, n := range count {
+		if n < 0 {
+			t.Fatal("imported a grid which was not exported")
+		}
+		missing += n
+	}
+	if missing != 1 {
+		t.Errorf("%d grids are missing, want 1", missing)
+	}
+
+	/*Tiles pointing past the sources of the atlas are rejected*/
+	index.Pages[0].Tiles[0].Source = uint32(len(info.Sources))
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, ATLAS_INDEX), indexJSON, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err = importAtlas(dir); err == nil {
+		t.Error("no error importing a tile with an unknown source")
+	}
+}
+
+func TestFilterGrids(t *testing.T) {
+	array, _, info := syntheticDataset(t, 64, 64, 0.1)
+	rng := rand.New(rand.NewSource(1))
+	if kept := filterGrids(array, info, newGridFilter(), rng); len(kept) != len(array) {
+		t.Errorf("the default filter kept %d of %d grids", len(kept), len(array))
+	}
+
+	f := newGridFilter()
+	f.wLo, f.wHi, f.hLo, f.hHi = 4, 6, 5, 5
+	f.avgLo, f.avgHi = 64, 192
+	f.sources = []string{filepath.Join(filepath.Dir(info.Sources[1].Name), "ref2*")}
+	kept := filterGrids(array, info, f, rng)
+	if len(kept) == 0 {
+		t.Fatal("the filter kept no grids")
+	}
+	for _, g := range kept {
+		if g.getW() < 4 || g.getW() > 6 || g.getH() != 5 || g.avgLuma < 64 || g.avgLuma > 192 || g.source != 1 {
+			t.Fatalf("kept a %dx%d grid of average %d from source %d", g.getW(), g.getH(), g.avgLuma, g.source)
+		}
+	}
+	if !slices.IsSortedFunc(kept, func(g1 Grid, g2 Grid) int { return cmp.Compare(g1.dimCornAvg, g2.dimCornAvg) }) {
+		t.Error("the kept grids are out of order")
+	}
+
+	/*Deep and shallow grids split the dataset between them*/
+	f = newGridFilter()
+	f.margin = info.Margin
+	f.depth = 1
+	shallow := filterGrids(array, info, f, rng)
+	f.depth = 2
+	deep := filterGrids(array, info, f, rng)
+	if len(shallow) == 0 || len(deep) == 0 || len(shallow)+len(deep) != len(array) {
+		t.Errorf("split %d grids into %d shallow and %d deep", len(array), len(shallow), len(deep))
+	}
+
+	f = newGridFilter()
+	f.sample = 0.5
+	sampled := filterGrids(array, info, f, rng)
+	if len(sampled) == 0 || len(sampled) >= len(array) {
+		t.Errorf("sampled %d of %d grids at a half", len(sampled), len(array))
+	}
+	f.sample = 0
+	if sampled = filterGrids(array, info, f, rng); len(sampled) != 0 {
+		t.Errorf("sampled %d grids at none", len(sampled))
+	}
+}
+
+func TestManifestSkipRetry(t *testing.T) {
+	dir := t.TempDir()
+	fName := filepath.Join(dir, "manifest.json")
+	in := writeSyntheticImage(t, dir, "frame.png", 16, 16, 1)
+	out := filepath.Join(dir, "out.png")
+	m, err := loadManifest(fName)
+	if err != nil || len(m.Frames) != 0 {
+		t.Fatalf("a missing manifest loaded %v with error %v", m.Frames, err)
+	}
+
+	/*A failed frame is retried*/
+	rec := newFrameRecord(in, out, "params")
+	if err = m.record("frame.png", finishFrameRecord(rec, os.ErrNotExist), fName); err != nil {
+		t.Fatal(err)
+	}
+	if m.done("frame.png", rec) {
+		t.Error("a failed frame is skipped")
+	}
+
+	if err = os.WriteFile(out, []byte("traced"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.record("frame.png", finishFrameRecord(rec, nil), fName); err != nil {
+		t.Fatal(err)
+	}
+	m, err = loadManifest(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.done("frame.png", newFrameRecord(in, out, "params")) {
+		t.Error("a finished frame is traced again after a restart")
+	}
+	if m.done("frame.png", newFrameRecord(in, out, "other params")) {
+		t.Error("a frame traced with other parameters is skipped")
+	}
+
+	/*A changed output or input is traced again*/
+	if err = os.WriteFile(out, []byte("edited"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if m.done("frame.png", newFrameRecord(in, out, "params")) {
+		t.Error("a frame whose output changed is skipped")
+	}
+	if err = os.WriteFile(out, []byte("traced"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	later := rec.ModTime.Add(time.Second)
+	if err = os.Chtimes(in, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if m.done("frame.png", newFrameRecord(in, out, "params")) {
+		t.Error("a frame whose input changed is skipped")
+	}
+
+	if err = os.WriteFile(fName, []byte("{"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadManifest(fName); err == nil {
+		t.Error("no error loading a broken manifest")
+	}
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+/*
+Maps a file into memory read-only, so that every process reading the
+same dataset shares one copy of it in the page cache, and only the parts
+of it that are used are ever read from disk. Returns nil if the file
+cannot be mapped, and otherwise a function which unmaps it again.
+*/
+func mapFile(f *os.File, size int64) ([]uint8, func() error) {
+	if size <= 0 || int64(int(size)) != size {
+		return nil, nil
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil
+	}
+	return data, func() error {
+		return syscall.Munmap(data)
+	}
+}
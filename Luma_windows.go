@@ -0,0 +1,35 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+/*
+Maps a file into memory read-only, so that every process reading the
+same dataset shares one copy of it in the page cache, and only the parts
+of it that are used are ever read from disk. Returns nil if the file
+cannot be mapped, and otherwise a function which unmaps it again. The
+view keeps the mapping open once both handles are closed.
+*/
+func mapFile(f *os.File, size int64) ([]uint8, func() error) {
+	if size <= 0 || int64(int(size)) != size {
+		return nil, nil
+	}
+	m, err := syscall.CreateFileMapping(syscall.Handle(f.Fd()), nil, syscall.PAGE_READONLY, 0, 0, nil)
+	if err != nil {
+		return nil, nil
+	}
+	defer syscall.CloseHandle(m)
+	addr, err := syscall.MapViewOfFile(m, syscall.FILE_MAP_READ, 0, 0, uintptr(size))
+	if err != nil {
+		return nil, nil
+	}
+	data := unsafe.Slice(*(**uint8)(unsafe.Pointer(&addr)), int(size))
+	return data, func() error {
+		return syscall.UnmapViewOfFile(addr)
+	}
+}
@@ -0,0 +1,8 @@
+module luma
+
+go 1.26.0
+
+require (
+	gocv.io/x/gocv v0.41.0
+	golang.org/x/image v0.46.0
+)